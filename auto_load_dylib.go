@@ -5,18 +5,19 @@ package rwkv
 
 import (
 	"fmt"
+	"log/slog"
 
 	"os"
 )
 
-func dumpRwkvLibrary(gpu bool) (*os.File, error) {
+func dumpRwkvLibrary(gpu bool, logger *slog.Logger) (*os.File, error) {
 	file, err := os.CreateTemp("", libName)
 	if err != nil {
 		return nil, fmt.Errorf("error creating temp file: %w", err)
 	}
 	defer file.Close()
 
-	if err := os.WriteFile(file.Name(), getDl(gpu), 0400); err != nil {
+	if err := os.WriteFile(file.Name(), getDl(gpu, logger), 0400); err != nil {
 		return nil, fmt.Errorf("error writing file: %w", err)
 	}
 
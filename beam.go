@@ -0,0 +1,263 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+)
+
+const defaultBeamWidth = 4
+
+// BeamOptions configures BeamSearch.
+type BeamOptions struct {
+	// Width is the number of beams kept at every step, 4 by default.
+	Width int
+	// LengthPenalty is the exponent of the length the log probability is divided by.
+	// 0 ranks hypotheses by their log probability, larger values favor longer ones.
+	LengthPenalty float64
+	// EarlyStopping ends the search as soon as Width hypotheses are finished.
+	// Otherwise it goes on while a live beam can still beat the worst finished hypothesis.
+	EarlyStopping bool
+	// Results is the number of hypotheses returned, 1 by default.
+	Results int
+}
+
+// Hypothesis is a finished beam.
+type Hypothesis struct {
+	Text   string
+	Tokens []int
+	// Logprob is the log probability of the tokens, Score the one with the length penalty.
+	Logprob float64
+	Score   float64
+	// State is the state after the hypothesis, the conversation can continue from it.
+	State *RwkvState
+}
+
+type beam struct {
+	state   *RwkvState
+	tokens  []int
+	text    string
+	logprob float64
+	match   matchState
+}
+
+type beamCandidate struct {
+	parent  int
+	token   int
+	logprob float64
+}
+
+// BeamSearch feeds the input into the state and searches the most likely continuations.
+// Every beam carries its own fork of the state, s only receives the input.
+// The max tokens, stop strings, logit bias and constraint of the options are used,
+// the search is deterministic so temperature and top-p are ignored.
+func (s *RwkvState) BeamSearch(input string, beamOpts BeamOptions, opts ...PredictOption) ([]Hypothesis, error) {
+	if err := checkState(s); err != nil {
+		return nil, err
+	}
+	width, results := beamOpts.Width, beamOpts.Results
+	if width <= 0 {
+		width = defaultBeamWidth
+	}
+	if results <= 0 {
+		results = 1
+	}
+	if results > width {
+		return nil, errors.New("beam search can't return more results than its width")
+	}
+	o := newPredictOptions(s.rwkvModel.options, opts)
+	var tokens [][]byte
+	var trie *tokenTrie
+	if o.constraint != nil {
+		var err error
+		if tokens, trie, err = s.rwkvModel.vocabulary(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.handelInput(o.ctx, input); err != nil {
+		return nil, err
+	}
+
+	root, err := s.Fork()
+	if err != nil {
+		return nil, err
+	}
+	beams := []*beam{{state: root}}
+	if o.constraint != nil {
+		beams[0].match = o.constraint.start()
+	}
+	var finished []Hypothesis
+	finish := func(b *beam, text string) {
+		finished = append(finished, Hypothesis{
+			Text:    text,
+			Tokens:  b.tokens,
+			Logprob: b.logprob,
+			Score:   lengthPenalized(b.logprob, len(b.tokens), beamOpts.LengthPenalty),
+			State:   b.state,
+		})
+	}
+
+	for step := 0; step < o.maxTokens && len(beams) > 0; step++ {
+		var candidates []beamCandidate
+		for i, b := range beams {
+			logits := append([]float32(nil), b.state.logits...)
+			for token, bias := range o.logitBias {
+				if token >= 0 && token < len(logits) {
+					logits[token] += bias
+				}
+			}
+			if b.match != nil {
+				d := &constrainedDecoder{tokens: tokens, trie: trie, state: b.match}
+				d.mask(logits)
+			}
+			lse := logSumExp(logits)
+			for _, token := range topTokens(logits, width) {
+				if math.IsInf(float64(logits[token]), -1) {
+					break
+				}
+				candidates = append(candidates, beamCandidate{parent: i, token: token, logprob: b.logprob + float64(logits[token]) - lse})
+			}
+		}
+		sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].logprob > candidates[j].logprob })
+
+		var next []*beam
+		for rank, c := range candidates {
+			if len(next) == width {
+				break
+			}
+			parent := beams[c.parent]
+			if c.token == endOfTextToken {
+				// a finished hypothesis only counts when it is among the best candidates
+				if rank < width {
+					finish(&beam{state: parent.state, tokens: parent.tokens, logprob: c.logprob}, parent.text)
+				}
+				continue
+			}
+			b, err := parent.extend(c, tokens)
+			if err != nil {
+				return nil, err
+			}
+			if stop := firstStop(b.text, o.stopStrings); len(stop) > 0 {
+				finish(b, strings.Split(b.text, stop)[0])
+				continue
+			}
+			if b.match != nil && b.match.done() && !canContinue(b.match, trie) {
+				finish(b, b.text)
+				continue
+			}
+			next = append(next, b)
+		}
+		beams = next
+
+		if len(finished) >= width {
+			if beamOpts.EarlyStopping || len(beams) == 0 {
+				break
+			}
+			// the log probability only decreases, so the best live beam scores at most its current log probability
+			// penalized with the longest possible length, or the current one when short hypotheses are favored
+			length := o.maxTokens
+			if beamOpts.LengthPenalty < 0 {
+				length = len(beams[0].tokens)
+			}
+			best := lengthPenalized(beams[0].logprob, length, beamOpts.LengthPenalty)
+			sort.SliceStable(finished, func(i, j int) bool { return finished[i].Score > finished[j].Score })
+			if finished[width-1].Score >= best {
+				break
+			}
+		}
+	}
+	for _, b := range beams {
+		finish(b, b.text)
+	}
+	sort.SliceStable(finished, func(i, j int) bool { return finished[i].Score > finished[j].Score })
+	if len(finished) > results {
+		finished = finished[:results]
+	}
+	return finished, nil
+}
+
+// extend forks the beam and feeds the token of the candidate.
+func (b *beam) extend(c beamCandidate, tokens [][]byte) (*beam, error) {
+	state, err := b.state.Fork()
+	if err != nil {
+		return nil, err
+	}
+	if err = state.eval(c.token); err != nil {
+		return nil, err
+	}
+	state.record(RoleOutput, c.token)
+
+	next := &beam{
+		state:   state,
+		tokens:  append(append([]int(nil), b.tokens...), c.token),
+		logprob: c.logprob,
+		match:   b.match,
+	}
+	if b.match != nil {
+		// constrained output keeps the exact bytes, like generate
+		for _, by := range tokens[c.token] {
+			next.match = next.match.next(by)
+		}
+		next.text = b.text + string(tokens[c.token])
+	} else {
+		next.text = b.text + state.rwkvModel.tokenizer.Decode([]int{c.token})
+	}
+	return next, nil
+}
+
+// canContinue reports whether any token of the vocabulary continues the match.
+func canContinue(match matchState, trie *tokenTrie) bool {
+	for _, edge := range trie.nodes[0].edges {
+		if match.next(edge.b) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func firstStop(text string, stops []string) string {
+	for _, stop := range stops {
+		if len(stop) > 0 && strings.Contains(text, stop) {
+			return stop
+		}
+	}
+	return ""
+}
+
+// lengthPenalized divides the log probability by length^penalty.
+func lengthPenalized(logprob float64, length int, penalty float64) float64 {
+	if length == 0 || penalty == 0 {
+		return logprob
+	}
+	return logprob / math.Pow(float64(length), penalty)
+}
+
+// PredictN feeds the input into the state and samples n independent generations from it.
+// Every generation runs on its own fork, s only receives the input.
+func (s *RwkvState) PredictN(input string, n int, opts ...PredictOption) ([]*Generation, error) {
+	if err := checkState(s); err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, errors.New("n must be positive")
+	}
+	o := newPredictOptions(s.rwkvModel.options, opts)
+	if err := s.handelInput(o.ctx, input); err != nil {
+		return nil, err
+	}
+	generations := make([]*Generation, n)
+	for i := range generations {
+		fork, err := s.Fork()
+		if err != nil {
+			return nil, err
+		}
+		if generations[i], err = fork.generate(nil, o); err != nil {
+			return nil, err
+		}
+	}
+	return generations, nil
+}
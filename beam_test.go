@@ -0,0 +1,23 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLengthPenalized(t *testing.T) {
+	assert(t, lengthPenalized(-4, 4, 0) == -4)
+	assert(t, lengthPenalized(-4, 4, 1) == -1)
+	assert(t, math.Abs(lengthPenalized(-4, 4, 0.5)+2) < 1e-12)
+	assert(t, lengthPenalized(-4, 0, 1) == -4)
+	// with a positive penalty a longer hypothesis can beat a shorter more likely one
+	assert(t, lengthPenalized(-6, 6, 1) > lengthPenalized(-3, 2, 1))
+}
+
+func TestFirstStop(t *testing.T) {
+	assert(t, firstStop("hello\n\nworld", []string{"", "\n\n"}) == "\n\n")
+	assert(t, firstStop("hello", []string{"\n"}) == "")
+}
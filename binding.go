@@ -6,6 +6,7 @@ package rwkv
 import (
 	"errors"
 	"github.com/ebitengine/purego"
+	"sync"
 	"unsafe"
 )
 
@@ -31,6 +32,8 @@ const (
 	cRwkvEval             = "rwkv_eval"
 	cRwkvEvalSequence     = "rwkv_eval_sequence"
 
+	cRwkvEvalSequenceInChunks = "rwkv_eval_sequence_in_chunks"
+
 	cRwkvGetNVocab      = "rwkv_get_n_vocab"
 	cRwkvGetNEmbedding  = "rwkv_get_n_embed"
 	cRwkvGetNLayer      = "rwkv_get_n_layer"
@@ -106,6 +109,19 @@ type CRwkv interface {
 	// - logits_out: FP32 buffer of size rwkv_get_logits_len(). This buffer will be written to if non-NULL.
 	RwkvEvalSequence(ctx *RwkvCtx, token uint32, sequenceLen uint64, stateIn []float32, stateOut []float32, logitsOut []float32) error
 
+	// RwkvEvalSequenceInChunks Evaluates the model for a sequence of tokens using rwkv_eval_sequence, splitting a potentially long sequence into fixed-length chunks.
+	// This function is useful for processing complete prompts and user input in chat & role-playing use-cases.
+	// Chunking allows processing sequences of thousands of tokens, while not reaching the ggml's node limit and not consuming too much memory.
+	// A reasonable and recommended value of chunk size is 16.
+	// Not thread-safe. For parallel inference, call rwkv_clone_context to create one rwkv_context for each thread.
+	// Returns false on any error.
+	// - tokens: the tokens to evaluate.
+	// - chunk_size: size of each chunk in tokens, must be positive.
+	// - state_in: FP32 buffer of size rwkv_get_state_len(), or NULL if this is a first pass.
+	// - state_out: FP32 buffer of size rwkv_get_state_len(). This buffer will be written to if non-NULL.
+	// - logits_out: FP32 buffer of size rwkv_get_logits_len(). This buffer will be written to if non-NULL.
+	RwkvEvalSequenceInChunks(ctx *RwkvCtx, tokens []uint32, chunkSize uint64, stateIn []float32, stateOut []float32, logitsOut []float32) error
+
 	// RwkvGetNVocab Returns the number of tokens in the given model's vocabulary.
 	// Useful for telling 20B_tokenizer models (n_vocab = 50277) apart from World models (n_vocab = 65536).
 	RwkvGetNVocab(ctx *RwkvCtx) uint64
@@ -134,6 +150,7 @@ type CRwkv interface {
 
 	// RwkvFree Frees all allocated memory and the context.
 	// Does not need to be called on the same thread that created the rwkv_context.
+	// The dynamic library is closed once the last context (including clones) has been freed.
 	RwkvFree(ctx *RwkvCtx) error
 
 	// RwkvQuantizeModelFile Quantizes FP32 or FP16 model to one of quantized formats.
@@ -154,24 +171,29 @@ type CRwkv interface {
 }
 
 type CRwkvImpl struct {
-	libRwkv                  uintptr
-	cRwkvSetPrintErrors      func(uintptr, bool)
-	cRwkvGetPrintErrors      func(uintptr) bool
-	cRwkvGetLastError        func(uintptr) uint32
-	cRwkvInitFromFile        func(modelFilePath string, nThreads uint32) uintptr
-	cRwkvCloneContext        func(ctx uintptr, nThreads uint32) uintptr
-	cRwkvGpuOffloadLayers    func(ctx uintptr, nGpuLayers uint32) bool
-	cRwkvEval                func(ctx uintptr, token uint32, stateIn uintptr, stateOut uintptr, logitsOut uintptr) bool
-	cRwkvEvalSequence        func(ctx uintptr, token uint32, sequenceLen uint64, stateIn uintptr, stateOut uintptr, logitsOut uintptr) bool
-	cRwkvGetNVocab           func(ctx uintptr) uint64
-	cRwkvGetNEmbedding       func(ctx uintptr) uint64
-	cRwkvGetNLayer           func(ctx uintptr) uint64
-	cRwkvGetStateLength      func(ctx uintptr) uint64
-	cRwkvGetLogitsLength     func(ctx uintptr) uint64
-	cRwkvInitState           func(ctx uintptr, state uintptr)
-	cRwkvFree                func(ctx uintptr)
-	cRwkvQuantizeModelFile   func(modelFilePathIn string, modelFilePathOut string, formatName string) bool
-	cRwkvGetSystemInfoString func() string
+	libRwkv uintptr
+	// number of live contexts, the library is closed when it drops to zero
+	ctxCount int
+	ctxMutex sync.Mutex
+
+	cRwkvSetPrintErrors       func(uintptr, bool)
+	cRwkvGetPrintErrors       func(uintptr) bool
+	cRwkvGetLastError         func(uintptr) uint32
+	cRwkvInitFromFile         func(modelFilePath string, nThreads uint32) uintptr
+	cRwkvCloneContext         func(ctx uintptr, nThreads uint32) uintptr
+	cRwkvGpuOffloadLayers     func(ctx uintptr, nGpuLayers uint32) bool
+	cRwkvEval                 func(ctx uintptr, token uint32, stateIn uintptr, stateOut uintptr, logitsOut uintptr) bool
+	cRwkvEvalSequence         func(ctx uintptr, token uint32, sequenceLen uint64, stateIn uintptr, stateOut uintptr, logitsOut uintptr) bool
+	cRwkvEvalSequenceInChunks func(ctx uintptr, tokens uintptr, sequenceLen uint64, chunkSize uint64, stateIn uintptr, stateOut uintptr, logitsOut uintptr) bool
+	cRwkvGetNVocab            func(ctx uintptr) uint64
+	cRwkvGetNEmbedding        func(ctx uintptr) uint64
+	cRwkvGetNLayer            func(ctx uintptr) uint64
+	cRwkvGetStateLength       func(ctx uintptr) uint64
+	cRwkvGetLogitsLength      func(ctx uintptr) uint64
+	cRwkvInitState            func(ctx uintptr, state uintptr)
+	cRwkvFree                 func(ctx uintptr)
+	cRwkvQuantizeModelFile    func(modelFilePathIn string, modelFilePathOut string, formatName string) bool
+	cRwkvGetSystemInfoString  func() string
 }
 
 func NewCRwkv(libraryPath string) (*CRwkvImpl, error) {
@@ -180,23 +202,24 @@ func NewCRwkv(libraryPath string) (*CRwkvImpl, error) {
 		return nil, err
 	}
 	var (
-		rwkvSetPrintErrors      func(uintptr, bool)
-		rwkvGetPrintErrors      func(uintptr) bool
-		rwkvGetLastError        func(uintptr) uint32
-		rwkvInitFromFile        func(modelFilePath string, nThreads uint32) uintptr
-		rwkvCloneContext        func(ctx uintptr, nThreads uint32) uintptr
-		rwkvGpuOffloadLayers    func(ctx uintptr, nGpuLayers uint32) bool
-		rwkvEval                func(ctx uintptr, token uint32, stateIn uintptr, stateOut uintptr, logitsOut uintptr) bool
-		rwkvEvalSequence        func(ctx uintptr, token uint32, sequenceLen uint64, stateIn uintptr, stateOut uintptr, logitsOut uintptr) bool
-		rwkvGetNVocab           func(ctx uintptr) uint64
-		rwkvGetNEmbedding       func(ctx uintptr) uint64
-		rwkvGetNLayer           func(ctx uintptr) uint64
-		rwkvGetStateLength      func(ctx uintptr) uint64
-		rwkvGetLogitsLength     func(ctx uintptr) uint64
-		rwkvInitState           func(ctx uintptr, state uintptr)
-		rwkvFree                func(ctx uintptr)
-		rwkvQuantizeModelFile   func(modelFilePathIn string, modelFilePathOut string, formatName string) bool
-		rwkvGetSystemInfoString func() string
+		rwkvSetPrintErrors       func(uintptr, bool)
+		rwkvGetPrintErrors       func(uintptr) bool
+		rwkvGetLastError         func(uintptr) uint32
+		rwkvInitFromFile         func(modelFilePath string, nThreads uint32) uintptr
+		rwkvCloneContext         func(ctx uintptr, nThreads uint32) uintptr
+		rwkvGpuOffloadLayers     func(ctx uintptr, nGpuLayers uint32) bool
+		rwkvEval                 func(ctx uintptr, token uint32, stateIn uintptr, stateOut uintptr, logitsOut uintptr) bool
+		rwkvEvalSequence         func(ctx uintptr, token uint32, sequenceLen uint64, stateIn uintptr, stateOut uintptr, logitsOut uintptr) bool
+		rwkvEvalSequenceInChunks func(ctx uintptr, tokens uintptr, sequenceLen uint64, chunkSize uint64, stateIn uintptr, stateOut uintptr, logitsOut uintptr) bool
+		rwkvGetNVocab            func(ctx uintptr) uint64
+		rwkvGetNEmbedding        func(ctx uintptr) uint64
+		rwkvGetNLayer            func(ctx uintptr) uint64
+		rwkvGetStateLength       func(ctx uintptr) uint64
+		rwkvGetLogitsLength      func(ctx uintptr) uint64
+		rwkvInitState            func(ctx uintptr, state uintptr)
+		rwkvFree                 func(ctx uintptr)
+		rwkvQuantizeModelFile    func(modelFilePathIn string, modelFilePathOut string, formatName string) bool
+		rwkvGetSystemInfoString  func() string
 	)
 	purego.RegisterLibFunc(&rwkvSetPrintErrors, libRwkv, cRwkvSetPrintErrors)
 	purego.RegisterLibFunc(&rwkvGetPrintErrors, libRwkv, cRwkvGetPrintErrors)
@@ -207,6 +230,7 @@ func NewCRwkv(libraryPath string) (*CRwkvImpl, error) {
 	purego.RegisterLibFunc(&rwkvGpuOffloadLayers, libRwkv, cRwkvGpuOffloadLayers)
 	purego.RegisterLibFunc(&rwkvEval, libRwkv, cRwkvEval)
 	purego.RegisterLibFunc(&rwkvEvalSequence, libRwkv, cRwkvEvalSequence)
+	purego.RegisterLibFunc(&rwkvEvalSequenceInChunks, libRwkv, cRwkvEvalSequenceInChunks)
 
 	purego.RegisterLibFunc(&rwkvGetNVocab, libRwkv, cRwkvGetNVocab)
 	purego.RegisterLibFunc(&rwkvGetNEmbedding, libRwkv, cRwkvGetNEmbedding)
@@ -233,6 +257,8 @@ func NewCRwkv(libraryPath string) (*CRwkvImpl, error) {
 		cRwkvEval:             rwkvEval,
 		cRwkvEvalSequence:     rwkvEvalSequence,
 
+		cRwkvEvalSequenceInChunks: rwkvEvalSequenceInChunks,
+
 		cRwkvGetNVocab:      rwkvGetNVocab,
 		cRwkvGetNEmbedding:  rwkvGetNEmbedding,
 		cRwkvGetNLayer:      rwkvGetNLayer,
@@ -266,11 +292,13 @@ func (c *CRwkvImpl) RwkvGetLastError(ctx *RwkvCtx) error {
 
 func (c *CRwkvImpl) RwkvInitFromFile(filePath string, threads uint32) *RwkvCtx {
 	ctx := c.cRwkvInitFromFile(filePath, threads)
+	c.retainCtx(ctx)
 	return &RwkvCtx{ctx: ctx}
 }
 
 func (c *CRwkvImpl) RwkvCloneContext(ctx *RwkvCtx, threads uint32) *RwkvCtx {
 	newCtx := c.cRwkvCloneContext(ctx.ctx, threads)
+	c.retainCtx(newCtx)
 	return &RwkvCtx{ctx: newCtx}
 }
 
@@ -298,6 +326,17 @@ func (c *CRwkvImpl) RwkvEvalSequence(ctx *RwkvCtx, token uint32, sequenceLen uin
 	return nil
 }
 
+func (c *CRwkvImpl) RwkvEvalSequenceInChunks(ctx *RwkvCtx, tokens []uint32, chunkSize uint64, stateIn []float32, stateOut []float32, logitsOut []float32) error {
+	if len(tokens) == 0 {
+		return errors.New("tokens can not be empty")
+	}
+	ok := c.cRwkvEvalSequenceInChunks(ctx.ctx, uintptr(unsafe.Pointer(&tokens[0])), uint64(len(tokens)), chunkSize, floatsPtr(stateIn), floatsPtr(stateOut), floatsPtr(logitsOut))
+	if !ok {
+		return c.RwkvGetLastError(ctx)
+	}
+	return nil
+}
+
 func (c *CRwkvImpl) RwkvGetNVocab(ctx *RwkvCtx) uint64 {
 	return c.cRwkvGetNVocab(ctx.ctx)
 }
@@ -324,6 +363,9 @@ func (c *CRwkvImpl) RwkvInitState(ctx *RwkvCtx, state []float32) {
 
 func (c *CRwkvImpl) RwkvFree(ctx *RwkvCtx) error {
 	c.cRwkvFree(ctx.ctx)
+	if !c.releaseCtx(ctx.ctx) {
+		return nil
+	}
 	if c.libRwkv != 0 {
 		err := closeLibrary(c.libRwkv)
 		if err != nil {
@@ -345,3 +387,30 @@ func (c *CRwkvImpl) RwkvQuantizeModelFile(ctx *RwkvCtx, in, out string, format Q
 func (c *CRwkvImpl) RwkvGetSystemInfoString() string {
 	return c.cRwkvGetSystemInfoString()
 }
+
+func (c *CRwkvImpl) retainCtx(ctx uintptr) {
+	if ctx == 0 {
+		return
+	}
+	c.ctxMutex.Lock()
+	defer c.ctxMutex.Unlock()
+	c.ctxCount++
+}
+
+// releaseCtx reports whether the last live context has been released.
+func (c *CRwkvImpl) releaseCtx(ctx uintptr) bool {
+	c.ctxMutex.Lock()
+	defer c.ctxMutex.Unlock()
+	if ctx != 0 && c.ctxCount > 0 {
+		c.ctxCount--
+	}
+	return c.ctxCount == 0
+}
+
+// floatsPtr returns the address of the first element, or NULL for an empty buffer.
+func floatsPtr(buf []float32) uintptr {
+	if len(buf) == 0 {
+		return 0
+	}
+	return uintptr(unsafe.Pointer(&buf[0]))
+}
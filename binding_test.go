@@ -4,6 +4,7 @@
 package rwkv
 
 import (
+	"errors"
 	"testing"
 )
 
@@ -27,6 +28,70 @@ func assertNonNil(t *testing.T, obj any, message ...string) {
 	}
 }
 
+// fakeRwkv evaluates an RWKV v5 model of 2 layers, 4 embeddings, wkv heads of size 2 and a vocabulary
+// of 65536 tokens without the library. The first two values of the state are replaced by the number of
+// evaluated tokens and the last one. The logits are uniform, or after a token
+// of reply they give all the probability to the next one and after any other token to the first one,
+// so that a greedy generation writes reply.
+type fakeRwkv struct {
+	CRwkv
+	reply      []int
+	chunkSizes []uint64
+	evals      int
+}
+
+// newFakeModel returns a model evaluated by a fakeRwkv, with the world tokenizer.
+func newFakeModel(t *testing.T, options RwkvOptions) (*RwkvModel, *fakeRwkv) {
+	tk, err := NewWorldTokenizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.TokenizerType = World
+	c := &fakeRwkv{}
+	return &RwkvModel{cRwkv: c, tokenizer: tk, ctx: &RwkvCtx{ctx: 1}, options: &options}, c
+}
+
+func (r *fakeRwkv) RwkvGetNLayer(*RwkvCtx) uint64       { return 2 }
+func (r *fakeRwkv) RwkvGetNEmbedding(*RwkvCtx) uint64   { return 4 }
+func (r *fakeRwkv) RwkvGetStateLength(*RwkvCtx) uint64  { return 2 * 4 * (2 + 2) }
+func (r *fakeRwkv) RwkvGetLogitsLength(*RwkvCtx) uint64 { return 65536 }
+
+func (r *fakeRwkv) RwkvInitState(_ *RwkvCtx, state []float32) {
+	clear(state)
+}
+
+func (r *fakeRwkv) RwkvEval(_ *RwkvCtx, token uint32, _, state, logits []float32) error {
+	r.evals++
+	r.step(token, state, logits)
+	return nil
+}
+
+func (r *fakeRwkv) RwkvEvalSequenceInChunks(_ *RwkvCtx, tokens []uint32, chunkSize uint64, _, state, logits []float32) error {
+	if chunkSize == 0 {
+		return errors.New("chunk size must be positive")
+	}
+	r.chunkSizes = append(r.chunkSizes, chunkSize)
+	for _, token := range tokens {
+		r.step(token, state, logits)
+	}
+	return nil
+}
+
+func (r *fakeRwkv) step(token uint32, state, logits []float32) {
+	state[0]++
+	state[1] = float32(token)
+	clear(logits)
+	if len(r.reply) > 0 {
+		next := r.reply[0]
+		for i := 0; i+1 < len(r.reply); i++ {
+			if r.reply[i] == int(token) {
+				next = r.reply[i+1]
+			}
+		}
+		logits[next] = 100
+	}
+}
+
 func TestNewCRwkv(t *testing.T) {
 	rwkv, err := NewCRwkv(getLibrary())
 	if err != nil {
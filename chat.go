@@ -0,0 +1,328 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+type ChatRole string
+
+const (
+	ChatRoleSystem    ChatRole = "system"
+	ChatRoleUser      ChatRole = "user"
+	ChatRoleAssistant ChatRole = "assistant"
+	// ChatRoleInput carries the supporting text of an instruction, see InstructChatTemplate.
+	ChatRoleInput ChatRole = "input"
+	// ChatRoleTool carries the result of a tool call, see Agent.
+	ChatRoleTool ChatRole = "tool"
+)
+
+type ChatMessage struct {
+	Role    ChatRole
+	Content string
+}
+
+// ChatTemplate renders chat messages into the prompt format a model has been trained on.
+type ChatTemplate interface {
+	// Format renders a complete message, including the separator that ends it.
+	Format(msg ChatMessage) string
+	// Prefix starts a message of the role, the model generates the rest of it.
+	Prefix(role ChatRole) string
+	// Separator ends a message, the generation stops when the model writes it.
+	Separator() string
+}
+
+// RoleTemplate renders every message as "Name: content" followed by the separator.
+type RoleTemplate struct {
+	// Names maps a role to the name written in front of its messages.
+	// A role without name is written as plain text.
+	Names map[ChatRole]string
+	// Separator between two messages, "\n\n" for RWKV models.
+	MessageSeparator string
+	// StripSeparator replaces the separator inside a message with a single new line,
+	// so that a message can't end early. RWKV World models are trained this way.
+	StripSeparator bool
+}
+
+var blankLines = regexp.MustCompile(`\n\s*\n`)
+
+// WorldChatTemplate is the "User: ...\n\nAssistant: ..." format of RWKV World models.
+func WorldChatTemplate() *RoleTemplate {
+	return &RoleTemplate{
+		Names: map[ChatRole]string{
+			ChatRoleSystem:    "System",
+			ChatRoleUser:      "User",
+			ChatRoleAssistant: "Assistant",
+			ChatRoleInput:     "Input",
+			ChatRoleTool:      "Tool",
+		},
+		MessageSeparator: "\n\n",
+		StripSeparator:   true,
+	}
+}
+
+// RavenChatTemplate is the "Bob: ...\n\nAlice: ..." format of RWKV Raven models,
+// the system message is written as plain text.
+func RavenChatTemplate() *RoleTemplate {
+	return &RoleTemplate{
+		Names: map[ChatRole]string{
+			ChatRoleUser:      "Bob",
+			ChatRoleAssistant: "Alice",
+			ChatRoleInput:     "Input",
+			ChatRoleTool:      "Tool",
+		},
+		MessageSeparator: "\n\n",
+		StripSeparator:   true,
+	}
+}
+
+// InstructChatTemplate is the "Instruction: ...\n\nInput: ...\n\nResponse: ..." format,
+// user messages are instructions and ChatRoleInput messages their supporting text.
+func InstructChatTemplate() *RoleTemplate {
+	return &RoleTemplate{
+		Names: map[ChatRole]string{
+			ChatRoleUser:      "Instruction",
+			ChatRoleInput:     "Input",
+			ChatRoleAssistant: "Response",
+			ChatRoleTool:      "Tool",
+		},
+		MessageSeparator: "\n\n",
+		StripSeparator:   true,
+	}
+}
+
+func (t *RoleTemplate) Format(msg ChatMessage) string {
+	content := strings.ReplaceAll(msg.Content, "\r\n", "\n")
+	if t.StripSeparator {
+		content = blankLines.ReplaceAllString(content, "\n")
+	}
+	content = strings.TrimSpace(content)
+	if name := t.Names[msg.Role]; len(name) > 0 {
+		return name + ": " + content + t.MessageSeparator
+	}
+	return content + t.MessageSeparator
+}
+
+func (t *RoleTemplate) Prefix(role ChatRole) string {
+	if name := t.Names[role]; len(name) > 0 {
+		return name + ":"
+	}
+	return ""
+}
+
+func (t *RoleTemplate) Separator() string {
+	return t.MessageSeparator
+}
+
+// defaultChatCheckpoints keeps the checkpoints of the last turn, a user message and its reply.
+const defaultChatCheckpoints = 2
+
+// Chat keeps a conversation and its RwkvState in sync.
+// Every message is evaluated once when it is added, so a turn only costs the new tokens.
+// Before every message the state is checkpointed, so the last messages can be rolled back
+// without replaying the conversation.
+type Chat struct {
+	state          *RwkvState
+	template       ChatTemplate
+	messages       []ChatMessage
+	checkpoints    []chatCheckpoint
+	maxCheckpoints int
+}
+
+// chatCheckpoint is the state before the message at index messages was added.
+type chatCheckpoint struct {
+	state    *RwkvState
+	messages int
+}
+
+// NewChat starts a conversation on top of the state, which may already contain a prompt.
+func NewChat(state *RwkvState, template ChatTemplate) (*Chat, error) {
+	if err := checkState(state); err != nil {
+		return nil, err
+	}
+	if template == nil {
+		return nil, errors.New("chat template can not be nil")
+	}
+	return &Chat{
+		state:          state,
+		template:       template,
+		maxCheckpoints: defaultChatCheckpoints,
+	}, nil
+}
+
+// SetMaxCheckpoints sets how many messages can be rolled back, every checkpoint holds a copy of the state.
+func (c *Chat) SetMaxCheckpoints(n int) {
+	c.maxCheckpoints = n
+	c.trimCheckpoints()
+}
+
+// State returns the state holding the whole conversation.
+func (c *Chat) State() *RwkvState {
+	return c.state
+}
+
+// Messages returns a copy of the conversation.
+func (c *Chat) Messages() []ChatMessage {
+	return append([]ChatMessage(nil), c.messages...)
+}
+
+// Add renders the messages and feeds them into the state.
+// Assistant messages can be added too, for example to restore a conversation.
+func (c *Chat) Add(messages ...ChatMessage) error {
+	for _, msg := range messages {
+		role := RoleInput
+		if msg.Role == ChatRoleAssistant {
+			role = RoleOutput
+		}
+		if err := c.checkpoint(); err != nil {
+			return err
+		}
+		if err := c.state.evalText(nil, role, c.template.Format(msg)); err != nil {
+			return err
+		}
+		c.messages = append(c.messages, msg)
+	}
+	return nil
+}
+
+// Send adds a user message and returns the assistant reply.
+func (c *Chat) Send(content string, opts ...PredictOption) (string, error) {
+	if err := c.Add(ChatMessage{Role: ChatRoleUser, Content: content}); err != nil {
+		return "", err
+	}
+	return c.Reply(opts...)
+}
+
+// Reply lets the model write the next assistant message.
+func (c *Chat) Reply(opts ...PredictOption) (string, error) {
+	return c.reply(nil, opts)
+}
+
+// ReplyStream is the streaming version of Reply, the output channel is closed at the end.
+func (c *Chat) ReplyStream(output chan string, opts ...PredictOption) {
+	go func() {
+		_, err := c.reply(func(s string) bool {
+			output <- s
+			return true
+		}, opts)
+		if err != nil {
+			output <- err.Error()
+		}
+		close(output)
+	}()
+}
+
+func (c *Chat) reply(callback func(s string) bool, opts []PredictOption) (string, error) {
+	gen, err := c.generate(callback, opts, c.template.Separator())
+	if err != nil {
+		return "", err
+	}
+	return c.finish(gen.Text, gen.Stop)
+}
+
+// generate starts an assistant message and lets the model write it until one of the stop strings.
+func (c *Chat) generate(callback func(s string) bool, opts []PredictOption, stop ...string) (*Generation, error) {
+	if err := c.checkpoint(); err != nil {
+		return nil, err
+	}
+	opts = append([]PredictOption{WithStopStrings(stop...)}, opts...)
+	o := newPredictOptions(c.state.rwkvModel.options, opts)
+	if err := c.state.evalText(o.ctx, RoleInput, c.template.Prefix(ChatRoleAssistant)); err != nil {
+		return nil, err
+	}
+	return c.state.generate(callback, o)
+}
+
+// finish ends the assistant message and adds it to the conversation.
+func (c *Chat) finish(text, stop string) (string, error) {
+	// keep the state in the template format when the reply has been cut
+	if stop != c.template.Separator() {
+		if err := c.state.evalText(nil, RoleInput, c.template.Separator()); err != nil {
+			return "", err
+		}
+	}
+	text = strings.TrimSpace(text)
+	c.messages = append(c.messages, ChatMessage{Role: ChatRoleAssistant, Content: text})
+	return text, nil
+}
+
+// Rollback removes the last message and restores the state from before it was added.
+func (c *Chat) Rollback() error {
+	n := len(c.messages)
+	if n == 0 {
+		return errors.New("chat has no message to roll back")
+	}
+	return c.rollbackTo(n - 1)
+}
+
+// rollbackTo removes the messages from index n and restores the state from before they were added.
+// Nothing changes when there is no checkpoint of message n.
+func (c *Chat) rollbackTo(n int) error {
+	for i := len(c.checkpoints) - 1; i >= 0; i-- {
+		cp := c.checkpoints[i]
+		if cp.messages != n {
+			continue
+		}
+		c.state.restore(cp.state)
+		c.messages = c.messages[:n]
+		c.checkpoints = c.checkpoints[:i]
+		return nil
+	}
+	return errors.New("no checkpoint for the message, increase the max checkpoints")
+}
+
+// Regenerate drops the last assistant reply and samples a new one.
+func (c *Chat) Regenerate(opts ...PredictOption) (string, error) {
+	if n := len(c.messages); n == 0 || c.messages[n-1].Role != ChatRoleAssistant {
+		return "", errors.New("the last message is not an assistant reply")
+	}
+	if err := c.Rollback(); err != nil {
+		return "", err
+	}
+	return c.Reply(opts...)
+}
+
+// EditLast replaces the last user message, drops everything after it and returns the new reply.
+func (c *Chat) EditLast(content string, opts ...PredictOption) (string, error) {
+	last := -1
+	for i := len(c.messages) - 1; i >= 0; i-- {
+		if c.messages[i].Role == ChatRoleUser {
+			last = i
+			break
+		}
+	}
+	if last < 0 {
+		return "", errors.New("chat has no user message to edit")
+	}
+	if err := c.rollbackTo(last); err != nil {
+		return "", err
+	}
+	return c.Send(content, opts...)
+}
+
+// checkpoint saves the state before the next message.
+func (c *Chat) checkpoint() error {
+	if err := checkState(c.state); err != nil {
+		return err
+	}
+	if c.maxCheckpoints <= 0 {
+		return nil
+	}
+	state, err := c.state.Fork()
+	if err != nil {
+		return err
+	}
+	c.checkpoints = append(c.checkpoints, chatCheckpoint{state: state, messages: len(c.messages)})
+	c.trimCheckpoints()
+	return nil
+}
+
+func (c *Chat) trimCheckpoints() {
+	if n := len(c.checkpoints) - c.maxCheckpoints; n > 0 {
+		c.checkpoints = append([]chatCheckpoint(nil), c.checkpoints[n:]...)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChatTemplate(t *testing.T) {
+	t.Run("world template strips blank lines", func(t *testing.T) {
+		tpl := WorldChatTemplate()
+		out := tpl.Format(ChatMessage{Role: ChatRoleUser, Content: "first line\n\n\nsecond line\r\n\r\nthird line \n"})
+		assert(t, out == "User: first line\nsecond line\nthird line\n\n", out)
+		assert(t, tpl.Prefix(ChatRoleAssistant) == "Assistant:")
+		assert(t, tpl.Separator() == "\n\n")
+	})
+
+	t.Run("raven template writes system as plain text", func(t *testing.T) {
+		tpl := RavenChatTemplate()
+		assert(t, tpl.Format(ChatMessage{Role: ChatRoleSystem, Content: "Alice is friendly."}) == "Alice is friendly.\n\n")
+		assert(t, tpl.Format(ChatMessage{Role: ChatRoleUser, Content: "hi"}) == "Bob: hi\n\n")
+		assert(t, tpl.Prefix(ChatRoleAssistant) == "Alice:")
+	})
+
+	t.Run("instruct template", func(t *testing.T) {
+		tpl := InstructChatTemplate()
+		out := tpl.Format(ChatMessage{Role: ChatRoleUser, Content: "Translate to French"}) +
+			tpl.Format(ChatMessage{Role: ChatRoleInput, Content: "hello"}) +
+			tpl.Prefix(ChatRoleAssistant)
+		assert(t, out == "Instruction: Translate to French\n\nInput: hello\n\nResponse:", out)
+	})
+}
+
+func TestChat_Rollback(t *testing.T) {
+	m, c := newFakeModel(t, RwkvOptions{MaxTokens: 10})
+	reply, err := m.tokenizer.Encode(" ok\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.reply = reply
+	state, err := m.InitState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat, err := NewChat(state, WorldChatTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	evaluated := func() int { return int(chat.State().state[0]) }
+	messages := func() string {
+		var out []string
+		for _, msg := range chat.Messages() {
+			out = append(out, string(msg.Role)+":"+msg.Content)
+		}
+		return strings.Join(out, ",")
+	}
+
+	assert(t, chat.Rollback() != nil, "no message")
+	_, err = chat.EditLast("hello")
+	assert(t, err != nil, "no user message")
+
+	answer, err := chat.Send("hi")
+	assert(t, err == nil && answer == "ok", answer)
+	turn := evaluated()
+	tokens := chat.State().TokenCount()
+
+	t.Run("regenerate", func(t *testing.T) {
+		answer, err := chat.Regenerate()
+		assert(t, err == nil && answer == "ok", answer)
+		assert(t, messages() == "user:hi,assistant:ok", messages())
+		assert(t, evaluated() == turn && chat.State().TokenCount() == tokens, "the reply is replaced")
+	})
+
+	t.Run("edit", func(t *testing.T) {
+		answer, err := chat.EditLast("hello")
+		assert(t, err == nil && answer == "ok", answer)
+		assert(t, messages() == "user:hello,assistant:ok", messages())
+	})
+
+	t.Run("rollback past the checkpoints", func(t *testing.T) {
+		_, err := chat.Send("again")
+		assert(t, err == nil)
+		before, history := evaluated(), messages()
+
+		// the checkpoints of the last turn are kept, not the one of the first user message
+		assert(t, chat.Rollback() == nil && chat.Rollback() == nil)
+		assert(t, messages() == "user:hello,assistant:ok", messages())
+		assert(t, chat.Rollback() != nil)
+
+		_, err = chat.Send("again")
+		assert(t, err == nil && evaluated() == before && messages() == history)
+		chat.SetMaxCheckpoints(1)
+		_, err = chat.EditLast("edited")
+		assert(t, err != nil, "the user message has no checkpoint")
+		assert(t, evaluated() == before && messages() == history, "nothing is rolled back when the edit fails", messages())
+	})
+
+	t.Run("rollback without checkpoints", func(t *testing.T) {
+		chat.SetMaxCheckpoints(0)
+		assert(t, chat.Rollback() != nil)
+		_, err := chat.Regenerate()
+		assert(t, err != nil)
+	})
+}
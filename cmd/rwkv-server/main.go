@@ -0,0 +1,209 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+// rwkv-server serves models with the OpenAI and Ollama APIs, and over gRPC with -grpc:
+//
+//	go run ./cmd/rwkv-server -model ./models/RWKV-5-World-0.4B-v2-20231113-ctx4096-F16.bin
+//	go run ./cmd/rwkv-server -models ./models
+package main
+
+import (
+	"flag"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc"
+
+	"github.com/seasonjs/rwkv"
+	"github.com/seasonjs/rwkv/rpc"
+	"github.com/seasonjs/rwkv/server"
+)
+
+func main() {
+	var (
+		addr      = flag.String("addr", ":8080", "address to listen on")
+		modelPath = flag.String("model", "", "path of the model file")
+		modelDir  = flag.String("models", "", "directory of .bin model files loaded on first use, served instead of -model")
+		memory    = flag.Int64("memory", 0, "memory budget of the models of -models in MiB, the least recently used ones are unloaded")
+		idle      = flag.Duration("idle", 0, "unload the models of -models which have not been used for that long")
+		name      = flag.String("name", "", "model name of the requests, the file name by default")
+		library   = flag.String("library", "", "path of the rwkv.cpp library, the embedded one by default")
+		tokenizer = flag.String("tokenizer", "world", "tokenizer of the model, world or normal")
+		threads   = flag.Uint("threads", 4, "cpu threads per context")
+		pool      = flag.Int("pool", 2, "number of contexts, the number of requests served at the same time")
+		maxTokens = flag.Int("max-tokens", 256, "default max tokens of a completion")
+		gpu       = flag.Bool("gpu", false, "offload the model to the gpu")
+		gpuLayers = flag.Uint("gpu-layers", 0, "number of layers offloaded to the gpu, all by default")
+		sessions  = flag.String("sessions", "", "directory the sessions are stored in, they are kept in memory by default")
+		metrics   = flag.Bool("metrics", false, "serve prometheus metrics on /metrics")
+		logLevel  = flag.String("log-level", "info", "level of the model logs: debug, info, warn or error")
+		apiKeys   = flag.String("api-keys", "", "JSON file of the api keys and their limits, RWKV_API_KEYS holds a comma separated list of keys too")
+		keyTPM    = flag.Int("key-tpm", 0, "tokens per minute of the keys of RWKV_API_KEYS, 0 means no limit")
+		keyConc   = flag.Int("key-concurrency", 0, "concurrent requests of the keys of RWKV_API_KEYS, 0 means no limit")
+		grpcAddr  = flag.String("grpc", "", "address to serve the gRPC Inference service on, only with -model")
+	)
+	flag.Parse()
+	if len(*modelPath) == 0 && len(*modelDir) == 0 {
+		log.Fatal("-model or -models is required")
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Fatal(err)
+	}
+
+	options := rwkv.RwkvOptions{
+		MaxTokens:        *maxTokens,
+		StopString:       "\n\n",
+		Temperature:      1,
+		TopP:             0.5,
+		TokenizerType:    rwkv.World,
+		CpuThreads:       uint32(*threads),
+		GpuEnable:        *gpu,
+		GpuOffLoadLayers: uint32(*gpuLayers),
+		Logger:           slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})),
+	}
+	var collector *server.Metrics
+	if *metrics {
+		collector = server.NewMetrics()
+		options.Metrics = collector
+	}
+	if len(*modelDir) > 0 {
+		if len(*grpcAddr) > 0 {
+			log.Fatal("-grpc is only supported with -model")
+		}
+		registry := rwkv.NewRegistry(rwkv.RegistryOptions{MemoryBudget: *memory << 20, IdleTimeout: *idle})
+		defer registry.Close()
+		names, err := registry.RegisterDir(*modelDir, rwkv.ModelSpec{Library: *library, Options: options, Contexts: *pool})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(names) == 0 {
+			log.Fatalf("no .bin model in %s", *modelDir)
+		}
+		srv, err := server.New()
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.UseRegistry(registry)
+		useSessions(srv, *sessions)
+		useAPIKeys(srv, *apiKeys, *keyTPM, *keyConc)
+		if collector != nil {
+			srv.UseMetrics(collector)
+		}
+		for _, name := range names {
+			log.Printf("serving %s on %s", name, *addr)
+		}
+		log.Fatal(http.ListenAndServe(*addr, srv))
+	}
+
+	template := rwkv.WorldChatTemplate()
+	switch *tokenizer {
+	case "world":
+	case "normal":
+		options.TokenizerType = rwkv.Normal
+		template = rwkv.RavenChatTemplate()
+	default:
+		log.Fatalf("unknown tokenizer %q", *tokenizer)
+	}
+
+	var model *rwkv.RwkvModel
+	var err error
+	if len(*library) > 0 {
+		model, err = rwkv.NewRwkvModel(*library, options)
+	} else {
+		model, err = rwkv.NewRwkvAutoModel(options)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer model.Close()
+	if err = model.LoadFromFile(*modelPath); err != nil {
+		log.Fatal(err)
+	}
+	contexts, err := model.NewContextPool(*pool, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer contexts.Close()
+
+	if len(*name) == 0 {
+		*name = strings.TrimSuffix(filepath.Base(*modelPath), filepath.Ext(*modelPath))
+	}
+	srv, err := server.New(&server.Model{Name: *name, Pool: contexts, Template: template})
+	if err != nil {
+		log.Fatal(err)
+	}
+	useSessions(srv, *sessions)
+	authenticated := useAPIKeys(srv, *apiKeys, *keyTPM, *keyConc)
+	if collector != nil {
+		srv.UseMetrics(collector)
+	}
+	if len(*grpcAddr) > 0 {
+		var auth rpc.Auth
+		if authenticated {
+			auth = srv
+		}
+		go serveGRPC(*grpcAddr, &rpc.Model{Name: *name, Pool: contexts, Template: template}, auth)
+	}
+	log.Printf("serving %s on %s", *name, *addr)
+	log.Fatal(http.ListenAndServe(*addr, srv))
+}
+
+// serveGRPC serves the model over gRPC, the calls authenticate with the keys of auth when it is not nil.
+func serveGRPC(addr string, model *rpc.Model, auth rpc.Auth) {
+	srv, err := rpc.NewServer(model)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if auth != nil {
+		srv.UseAuth(auth)
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(srv.UnaryInterceptor), grpc.StreamInterceptor(srv.StreamInterceptor))
+	rpc.RegisterInferenceServer(grpcServer, srv)
+	log.Printf("serving %s over gRPC on %s", model.Name, addr)
+	log.Fatal(grpcServer.Serve(lis))
+}
+
+func useSessions(srv *server.Server, dir string) {
+	if len(dir) == 0 {
+		return
+	}
+	store, err := server.NewDirStore(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv.UseSessionStore(store)
+}
+
+// useAPIKeys authenticates the requests with the keys of the file and of RWKV_API_KEYS, if any,
+// and returns whether there are keys.
+func useAPIKeys(srv *server.Server, file string, tokensPerMinute, concurrency int) bool {
+	var keys []server.APIKey
+	if len(file) > 0 {
+		fileKeys, err := server.LoadAPIKeys(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keys = append(keys, fileKeys...)
+	}
+	for _, key := range server.ParseAPIKeys(os.Getenv("RWKV_API_KEYS")) {
+		key.TokensPerMinute, key.MaxConcurrent = tokensPerMinute, concurrency
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return false
+	}
+	if err := srv.UseAPIKeys(keys...); err != nil {
+		log.Fatal(err)
+	}
+	return true
+}
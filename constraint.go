@@ -0,0 +1,117 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"math"
+)
+
+// Constraint restricts the generated text to a formal language, such as JSON or a grammar.
+// At every step the tokens whose bytes can't continue a valid text are masked before sampling.
+type Constraint interface {
+	// start returns the automaton state before the first byte.
+	start() matchState
+}
+
+// matchState is an immutable state of a byte level automaton.
+type matchState interface {
+	// next returns the state after the byte, or nil if the byte is not allowed.
+	next(b byte) matchState
+	// done reports whether the text may end here.
+	done() bool
+}
+
+// WithConstraint restricts the generated text to the constraint.
+// The generation ends as soon as the constraint is complete and can't be continued,
+// or when the model chooses <|endoftext|> at a point where the text may end.
+func WithConstraint(c Constraint) PredictOption {
+	return func(o *predictOptions) {
+		o.constraint = c
+	}
+}
+
+// constrainedDecoder masks the logits of a generation according to a constraint.
+type constrainedDecoder struct {
+	tokens [][]byte
+	trie   *tokenTrie
+	state  matchState
+}
+
+func newConstrainedDecoder(m *RwkvModel, c Constraint) (*constrainedDecoder, error) {
+	tokens, trie, err := m.vocabulary()
+	if err != nil {
+		return nil, err
+	}
+	return &constrainedDecoder{
+		tokens: tokens,
+		trie:   trie,
+		state:  c.start(),
+	}, nil
+}
+
+// mask sets the logits of all forbidden tokens to -Inf.
+// It returns false if no token is allowed, which means the constrained text is complete.
+func (d *constrainedDecoder) mask(logits []float32) bool {
+	allowed := make([]bool, len(logits))
+	found := d.walk(0, d.state, allowed)
+	if d.state.done() && endOfTextToken < len(allowed) {
+		allowed[endOfTextToken] = true
+	}
+	negInf := float32(math.Inf(-1))
+	for i := range logits {
+		if !allowed[i] {
+			logits[i] = negInf
+		}
+	}
+	return found
+}
+
+// walk visits all trie nodes reachable from the state and marks their tokens.
+func (d *constrainedDecoder) walk(node int, state matchState, allowed []bool) bool {
+	found := false
+	for _, edge := range d.trie.nodes[node].edges {
+		next := state.next(edge.b)
+		if next == nil {
+			continue
+		}
+		for _, token := range d.trie.nodes[edge.node].tokens {
+			if token < len(allowed) {
+				allowed[token] = true
+				found = true
+			}
+		}
+		if d.walk(int(edge.node), next, allowed) {
+			found = true
+		}
+	}
+	return found
+}
+
+// accept advances the constraint by the bytes of the sampled token.
+func (d *constrainedDecoder) accept(token int) bool {
+	if token < 0 || token >= len(d.tokens) {
+		return false
+	}
+	state := d.state
+	for _, b := range d.tokens[token] {
+		state = state.next(b)
+		if state == nil {
+			return false
+		}
+	}
+	d.state = state
+	return true
+}
+
+// matchString runs the constraint over the text and reports whether it is a complete match.
+func matchString(c Constraint, text string) bool {
+	state := c.start()
+	for i := 0; i < len(text); i++ {
+		state = state.next(text[i])
+		if state == nil {
+			return false
+		}
+	}
+	return state.done()
+}
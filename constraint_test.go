@@ -0,0 +1,60 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"math"
+	"testing"
+)
+
+func newTestDecoder(c Constraint, vocab []string) *constrainedDecoder {
+	tokens := make([][]byte, len(vocab))
+	for i, token := range vocab {
+		tokens[i] = []byte(token)
+	}
+	return &constrainedDecoder{
+		tokens: tokens,
+		trie:   newTokenTrie(tokens),
+		state:  c.start(),
+	}
+}
+
+func TestConstrainedDecoder(t *testing.T) {
+	// token 0 is <|endoftext|>
+	vocab := []string{"", "{", "}", "{}", `"a"`, ":", "1", "x", `{"`, `a":`}
+	d := newTestDecoder(NewJSONConstraint(), vocab)
+	negInf := float32(math.Inf(-1))
+
+	allowed := func(logits []float32) []int {
+		var ids []int
+		for i, l := range logits {
+			if l != negInf {
+				ids = append(ids, i)
+			}
+		}
+		return ids
+	}
+
+	logits := make([]float32, len(vocab))
+	assert(t, d.mask(logits))
+	ids := allowed(logits)
+	assert(t, len(ids) == 3 && ids[0] == 1 && ids[1] == 3 && ids[2] == 8, "start of object")
+
+	assert(t, d.accept(8))
+	logits = make([]float32, len(vocab))
+	assert(t, d.mask(logits))
+	ids = allowed(logits)
+	// inside a key every token is allowed, except one that closes the key and continues without colon
+	assert(t, len(ids) == len(vocab)-2 && logits[4] == negInf && logits[endOfTextToken] == negInf, "inside a key")
+
+	assert(t, d.accept(9))
+	assert(t, d.accept(6))
+	assert(t, !d.accept(7))
+	assert(t, d.accept(2))
+
+	logits = make([]float32, len(vocab))
+	assert(t, !d.mask(logits), "the object is complete")
+	ids = allowed(logits)
+	assert(t, len(ids) == 1 && ids[0] == endOfTextToken)
+}
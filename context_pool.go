@@ -0,0 +1,231 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultQuantum is the number of tokens a job evaluates before it lets another job use its context.
+const defaultQuantum = 16
+
+// ContextPool holds clones of the model context, so that several states can be evaluated at the same time.
+// A context must only be used by one goroutine at a time: acquire it, bind states to it with
+// RwkvState.Bind and release it once they are done, or attach the states to jobs, see Attach.
+type ContextPool struct {
+	model *RwkvModel
+	size  int
+
+	mu      sync.Mutex
+	free    []*RwkvCtx
+	waiting waitQueue
+	seq     uint64
+	quantum int
+	jobs    int
+	stats   schedulerCounters
+	closed  bool
+}
+
+// NewContextPool clones the model context size times, every clone uses the given number of threads,
+// 0 means RwkvOptions.CpuThreads. The clones share the weights of the model.
+func (m *RwkvModel) NewContextPool(size int, threads uint32) (*ContextPool, error) {
+	if err := hasCtx(m.ctx); err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return nil, errors.New("context pool size must be positive")
+	}
+	if threads == 0 {
+		threads = m.options.CpuThreads
+	}
+	p := &ContextPool{model: m, size: size, quantum: defaultQuantum, stats: newSchedulerCounters()}
+	for i := 0; i < size; i++ {
+		ctx := m.cRwkv.RwkvCloneContext(m.ctx, threads)
+		if ctx.ctx == 0 {
+			_ = p.Close()
+			return nil, errors.New("clone context failed")
+		}
+		p.free = append(p.free, ctx)
+	}
+	return p, nil
+}
+
+// Model returns the model the contexts are cloned from.
+func (p *ContextPool) Model() *RwkvModel {
+	return p.model
+}
+
+// Acquire takes a free context, waiting until one is released or ctx is done.
+// The waiting requests are served with the jobs, by priority then in order, Acquire has priority 0.
+func (p *ContextPool) Acquire(ctx context.Context) (*RwkvCtx, error) {
+	return p.acquire(ctx, 0)
+}
+
+func (p *ContextPool) acquire(ctx context.Context, priority int) (*RwkvCtx, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errors.New("context pool is closed")
+	}
+	if len(p.free) > 0 && len(p.waiting) == 0 {
+		c := p.free[len(p.free)-1]
+		p.free = p.free[:len(p.free)-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.seq++
+	w := &waiter{priority: priority, seq: p.seq, grant: make(chan *RwkvCtx, 1)}
+	heap.Push(&p.waiting, w)
+	p.mu.Unlock()
+
+	start := time.Now()
+	select {
+	case c := <-w.grant:
+		wait := time.Since(start)
+		p.mu.Lock()
+		p.stats.wait += wait
+		p.mu.Unlock()
+		if metrics := p.model.options.Metrics; metrics != nil {
+			metrics.QueueWait(wait)
+		}
+		if c == nil {
+			return nil, errors.New("context pool is closed")
+		}
+		return c, nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		if w.index >= 0 {
+			heap.Remove(&p.waiting, w.index)
+			p.mu.Unlock()
+			return nil, ctx.Err()
+		}
+		p.mu.Unlock()
+		// the context has been granted meanwhile, give it to the next one
+		if c := <-w.grant; c != nil {
+			p.Release(c)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Release gives a context back to the pool, states bound to it must not be evaluated anymore.
+func (p *ContextPool) Release(c *RwkvCtx) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.release(c)
+}
+
+// release hands the context to the first waiting request, p.mu must be held.
+func (p *ContextPool) release(c *RwkvCtx) {
+	if p.closed {
+		_ = p.model.cRwkv.RwkvFree(c)
+		return
+	}
+	if len(p.waiting) > 0 {
+		w := heap.Pop(&p.waiting).(*waiter)
+		w.grant <- c
+		return
+	}
+	p.free = append(p.free, c)
+}
+
+// InitState returns a new state bound to the context.
+func (p *ContextPool) InitState(c *RwkvCtx) (*RwkvState, error) {
+	s, err := p.model.InitState()
+	if err != nil {
+		return nil, err
+	}
+	s.Bind(c)
+	return s, nil
+}
+
+// Embed computes the embedding of the text on a context of the pool, like EmbedBatch.
+func (p *ContextPool) Embed(ctx context.Context, text string, opts EmbedOptions) ([]float32, error) {
+	c, err := p.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Release(c)
+	return p.model.embed(c, text, opts)
+}
+
+// Size returns the number of contexts of the pool.
+func (p *ContextPool) Size() int {
+	return p.size
+}
+
+// InUse returns the number of acquired contexts.
+func (p *ContextPool) InUse() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size - len(p.free)
+}
+
+// Close frees the free contexts, the acquired ones are freed when they are released.
+// The waiting requests fail.
+func (p *ContextPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	for len(p.waiting) > 0 {
+		heap.Pop(&p.waiting).(*waiter).grant <- nil
+	}
+	free := p.free
+	p.free = nil
+	for _, c := range free {
+		if err := p.model.cRwkv.RwkvFree(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waiter is a request waiting for a context.
+type waiter struct {
+	priority int
+	seq      uint64
+	grant    chan *RwkvCtx
+	// index in the queue, -1 once it has been granted
+	index int
+}
+
+// waitQueue is a heap of the waiters, the highest priority first, then the oldest.
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waitQueue) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waitQueue) Pop() any {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
@@ -7,6 +7,7 @@ package rwkv
 
 import (
 	_ "embed" // Needed for go:embed
+	"log/slog"
 )
 
 //go:embed deps/darwin/librwkv.dylib
@@ -14,10 +15,11 @@ var libRwkv []byte
 
 var libName = "librwkv-*.dylib"
 
-func getDl(gpu bool) []byte {
+func getDl(gpu bool, logger *slog.Logger) []byte {
 	if gpu {
 		panic("Automatic loading of dynamic library failed, GPU Setting Not support darwin Now. Push request is welcome.")
 	}
 
+	logger.Debug("embedded library selected", "variant", "cpu")
 	return libRwkv
 }
@@ -7,6 +7,7 @@ package rwkv
 
 import (
 	_ "embed" // Needed for go:embed
+	"log/slog"
 )
 
 //go:embed deps/linux/librwkv.so
@@ -14,10 +15,11 @@ var libRwkv []byte
 
 var libName = "librwkv-*.so"
 
-func getDl(gpu bool) []byte {
+func getDl(gpu bool, logger *slog.Logger) []byte {
 	if gpu {
 		panic("Automatic loading of dynamic library failed, GPU Setting Not support linux Now. Push request is welcome.")
 	}
 
+	logger.Debug("embedded library selected", "variant", "cpu")
 	return libRwkv
 }
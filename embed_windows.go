@@ -9,7 +9,7 @@ import (
 	_ "embed"
 	"errors"
 	"golang.org/x/sys/cpu"
-	"log"
+	"log/slog"
 	"os/exec"
 	"strings"
 ) // Needed for go:embed
@@ -31,39 +31,39 @@ var rwkvCuda []byte
 
 var libName = "rwkv-*.dll"
 
-func getDl(gpu bool) []byte {
+func getDl(gpu bool, logger *slog.Logger) []byte {
 	if gpu {
 		info, err := getGPUInfo()
 		if err != nil {
-			log.Println(err)
+			logger.Warn("get gpu info failed", "error", err)
 		}
-		log.Print("get gpu info: ", info["Name"])
+		gpuName := info["Name"]
 
-		if strings.Contains(info["Name"], "AMD") {
-			log.Println("Use GPU ROCM5.5 instead.")
+		if strings.Contains(gpuName, "AMD") {
+			logger.Info("embedded library selected", "variant", "rocm5.5", "gpu", gpuName)
 			return libRwkvRocm
 		}
 
-		if strings.Contains(info["Name"], "NVIDIA") {
-			log.Println("Use GPU CUDA12 instead.")
+		if strings.Contains(gpuName, "NVIDIA") {
+			logger.Info("embedded library selected", "variant", "cuda12", "gpu", gpuName)
 			return rwkvCuda
 		}
 
-		log.Println("GPU not support, use CPU instead.")
+		logger.Warn("gpu not supported, use the cpu instead", "gpu", gpuName)
 	}
 
 	if cpu.X86.HasAVX512 {
-		log.Println("Use CPU AVX512 instead.")
+		logger.Info("embedded library selected", "variant", "avx512")
 		return libRwkvAvx512
 	}
 
 	if cpu.X86.HasAVX2 {
-		log.Println("Use CPU AVX2 instead.")
+		logger.Info("embedded library selected", "variant", "avx2")
 		return libRwkvAvx2
 	}
 
 	if cpu.X86.HasAVX {
-		log.Println("Use CPU AVX instead.")
+		logger.Info("embedded library selected", "variant", "avx")
 		return libRwkvAvx
 	}
 
@@ -0,0 +1,151 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// EmbedOptions controls how EmbedBatch spreads the work.
+type EmbedOptions struct {
+	// Workers is the number of cloned contexts evaluating texts in parallel.
+	// Defaults to runtime.NumCPU() divided by the threads per context.
+	Workers int
+	// ThreadsPerWorker is the thread count of every cloned context, defaults to 1.
+	ThreadsPerWorker uint32
+	// ChunkSize is passed to rwkv_eval_sequence_in_chunks, defaults to 16.
+	ChunkSize uint64
+	// Distill keeps only the first n_embed elements of the state, same as GetEmbedding.
+	Distill bool
+	// Progress is called after every finished text with the number of finished texts.
+	// It may be called from several goroutines, but never concurrently.
+	Progress func(done, total int)
+}
+
+// EmbedBatch computes the embedding of every text, starting from a fresh state each time.
+// The texts are distributed across cloned contexts so that large corpora can be indexed in parallel.
+// The result is in the same order as texts.
+func (m *RwkvModel) EmbedBatch(ctx context.Context, texts []string, opts EmbedOptions) ([][]float32, error) {
+	if err := hasCtx(m.ctx); err != nil {
+		return nil, err
+	}
+	if opts.ThreadsPerWorker == 0 {
+		opts.ThreadsPerWorker = 1
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU() / int(opts.ThreadsPerWorker)
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.Workers > len(texts) {
+		opts.Workers = len(texts)
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = 16
+	}
+
+	result := make([][]float32, len(texts))
+	jobs := make(chan int)
+	errs := make(chan error, opts.Workers)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		progress sync.Mutex
+		done     int
+	)
+	workerCtxs := make([]*RwkvCtx, 0, opts.Workers)
+	for w := 0; w < opts.Workers; w++ {
+		workerCtx := m.cRwkv.RwkvCloneContext(m.ctx, opts.ThreadsPerWorker)
+		if workerCtx.ctx == 0 {
+			for _, c := range workerCtxs {
+				_ = m.cRwkv.RwkvFree(c)
+			}
+			return nil, errors.New("clone context failed")
+		}
+		workerCtxs = append(workerCtxs, workerCtx)
+	}
+
+	for _, workerCtx := range workerCtxs {
+		wg.Add(1)
+		go func(workerCtx *RwkvCtx) {
+			defer wg.Done()
+			defer m.cRwkv.RwkvFree(workerCtx)
+			for i := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				emb, err := m.embed(workerCtx, texts[i], opts)
+				if err != nil {
+					errs <- err
+					cancel()
+					continue
+				}
+				result[i] = emb
+				if opts.Progress != nil {
+					progress.Lock()
+					done++
+					opts.Progress(done, len(texts))
+					progress.Unlock()
+				}
+			}
+		}(workerCtx)
+	}
+
+feed:
+	for i := range texts {
+		select {
+		case <-ctx.Done():
+			break feed
+		case jobs <- i:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// embed evaluates the text from a fresh state on the given context.
+func (m *RwkvModel) embed(ctx *RwkvCtx, text string, opts EmbedOptions) ([]float32, error) {
+	state := make([]float32, m.cRwkv.RwkvGetStateLength(ctx))
+	m.resetState(ctx, state)
+
+	encode, err := m.tokenizer.Encode(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(encode) > 0 {
+		tokens := make([]uint32, len(encode))
+		for i, token := range encode {
+			tokens[i] = uint32(token)
+		}
+		err = m.cRwkv.RwkvEvalSequenceInChunks(ctx, tokens, opts.ChunkSize, state, state, nil)
+		if err != nil {
+			m.observeError(err)
+			return nil, err
+		}
+	}
+
+	if opts.Distill {
+		state = state[:m.cRwkv.RwkvGetNEmbedding(ctx)]
+	}
+	emb := make([]float32, len(state))
+	copy(emb, state)
+	return emb, nil
+}
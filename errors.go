@@ -3,6 +3,8 @@
 
 package rwkv
 
+import "strings"
+
 type RwkvErrors uint32
 
 // Represents an error encountered during a function call.
@@ -58,5 +60,24 @@ var rwkvErrorMap = map[RwkvErrors]string{
 }
 
 func (err RwkvErrors) Error() string {
-	return rwkvErrorMap[err]
+	if name, ok := rwkvErrorMap[err]; ok {
+		return name
+	}
+	var names []string
+	for _, flag := range err.Flags() {
+		names = append(names, rwkvErrorMap[flag])
+	}
+	return strings.Join(names, " | ")
+}
+
+// Flags splits the error into its category, like RwkvErrorFile, and its code, like RwkvErrorFileOpen.
+func (err RwkvErrors) Flags() []RwkvErrors {
+	var flags []RwkvErrors
+	if category := err & 0xff00; category != 0 {
+		flags = append(flags, category)
+	}
+	if code := err & 0xff; code != 0 {
+		flags = append(flags, code)
+	}
+	return flags
 }
@@ -0,0 +1,14 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import "testing"
+
+func TestRwkvErrors_Flags(t *testing.T) {
+	err := RwkvErrorFile | RwkvErrorFileOpen
+	flags := err.Flags()
+	assert(t, len(flags) == 2 && flags[0] == RwkvErrorFile && flags[1] == RwkvErrorFileOpen)
+	assert(t, err.Error() == "RWKV_ERROR_FILE | RWKV_ERROR_FILE_OPEN", err.Error())
+	assert(t, RwkvErrors(RwkvErrorCtx).Error() == "RWKV_ERROR_CTX")
+}
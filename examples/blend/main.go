@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"github.com/seasonjs/rwkv"
+)
+
+func main() {
+	model, err := rwkv.NewRwkvAutoModel(rwkv.RwkvOptions{
+		MaxTokens:     100,
+		StopString:    "\n\n",
+		Temperature:   0.8,
+		TopP:          0.5,
+		TokenizerType: rwkv.World, //or World
+		PrintError:    true,
+		CpuThreads:    10,
+		GpuEnable:     false,
+	})
+
+	if err != nil {
+		fmt.Print(err.Error())
+		return
+	}
+
+	defer model.Close()
+
+	err = model.LoadFromFile("./models/RWKV-5-World-0.4B-v2-20231113-ctx4096-F16.bin")
+	if err != nil {
+		fmt.Print(err.Error())
+		return
+	}
+
+	pirate, err := model.InitState("The following is a conversation with Alice, an old pirate who talks about the sea all the time.\n\n")
+	if err != nil {
+		fmt.Print(err.Error())
+		return
+	}
+
+	poet, err := model.InitState("The following is a conversation with Alice, a romantic poet who answers everything in verses.\n\n")
+	if err != nil {
+		fmt.Print(err.Error())
+		return
+	}
+
+	user := "Bob: What did you do today?\n\nAlice:"
+
+	// the answer drifts from the pirate persona to the poet persona
+	for _, alpha := range []float32{0, 0.25, 0.5, 0.75, 1} {
+		ctx, err := pirate.Blend(poet, alpha)
+		if err != nil {
+			fmt.Print(err.Error())
+			return
+		}
+
+		out, err := ctx.Predict(user)
+		if err != nil {
+			fmt.Print(err.Error())
+			return
+		}
+
+		fmt.Printf("alpha %.2f:%s\n\n", alpha, out)
+	}
+}
@@ -29,35 +29,41 @@ func main() {
 		fmt.Print(err.Error())
 		return
 	}
-	prompt := `The following is a coherent verbose detailed conversation between a Chinese girl named Alice and her friend Bob.
-Alice is very intelligent, creative and friendly.
-Alice likes to tell Bob a lot about herself and her opinions.
-Alice usually gives Bob kind, helpful and informative advices.
-
-Bob: lhc
-Alice: LHC是指大型强子对撞机（Large Hadron Collider），是世界最大最强的粒子加速器，由欧洲核子中心（CERN）在瑞士日内瓦地下建造。
-LHC的原理是加速质子（氢离子）并让它们相撞，让科学家研究基本粒子和它们之间的相互作用，并在2012年证实了希格斯玻色子的存在。
-
-Bob: 企鹅会飞吗
-Alice: 企鹅是不会飞的。企鹅的翅膀短而扁平，更像是游泳时的一对桨。企鹅的身体结构和羽毛密度也更适合在水中游泳，而不是飞行。
-
-`
-	user := `Bob: 请介绍北京的旅游景点？
-Alice: `
-
-	ctx, err := model.InitState(prompt)
-
+	ctx, err := model.InitState()
 	if err != nil {
 		print(err.Error())
 		return
 	}
 
-	out, err := ctx.Predict(user)
+	chat, err := rwkv.NewChat(ctx, rwkv.RavenChatTemplate())
+	if err != nil {
+		print(err.Error())
+		return
+	}
 
+	err = chat.Add(
+		rwkv.ChatMessage{Role: rwkv.ChatRoleSystem, Content: `The following is a coherent verbose detailed conversation between a Chinese girl named Alice and her friend Bob.
+Alice is very intelligent, creative and friendly.
+Alice likes to tell Bob a lot about herself and her opinions.
+Alice usually gives Bob kind, helpful and informative advices.`},
+		rwkv.ChatMessage{Role: rwkv.ChatRoleUser, Content: "lhc"},
+		rwkv.ChatMessage{Role: rwkv.ChatRoleAssistant, Content: `LHC是指大型强子对撞机（Large Hadron Collider），是世界最大最强的粒子加速器，由欧洲核子中心（CERN）在瑞士日内瓦地下建造。
+LHC的原理是加速质子（氢离子）并让它们相撞，让科学家研究基本粒子和它们之间的相互作用，并在2012年证实了希格斯玻色子的存在。`},
+		rwkv.ChatMessage{Role: rwkv.ChatRoleUser, Content: "企鹅会飞吗"},
+		rwkv.ChatMessage{Role: rwkv.ChatRoleAssistant, Content: "企鹅是不会飞的。企鹅的翅膀短而扁平，更像是游泳时的一对桨。企鹅的身体结构和羽毛密度也更适合在水中游泳，而不是飞行。"},
+	)
 	if err != nil {
 		print(err.Error())
 		return
 	}
 
-	print(out)
+	// only the new message is evaluated on every turn
+	for _, user := range []string{"请介绍北京的旅游景点？", "那上海呢？"} {
+		out, err := chat.Send(user)
+		if err != nil {
+			print(err.Error())
+			return
+		}
+		fmt.Printf("Bob: %s\n\nAlice: %s\n\n", user, out)
+	}
 }
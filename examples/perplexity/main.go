@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/seasonjs/rwkv"
+)
+
+// compare the perplexity of a F16 model and its quantized version on a text file:
+//
+//	go run ./examples/perplexity ./models/wiki.test.raw
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("usage: perplexity <text file>")
+		return
+	}
+
+	base, err := loadModel("./models/RWKV-5-World-0.4B-v2-20231113-ctx4096-F16.bin")
+	if err != nil {
+		fmt.Print(err.Error())
+		return
+	}
+	defer base.Close()
+
+	quantized, err := loadModel("./models/RWKV-5-World-0.4B-v2-20231113-ctx4096-Q5_1.bin")
+	if err != nil {
+		fmt.Print(err.Error())
+		return
+	}
+	defer quantized.Close()
+
+	file, err := os.Open(os.Args[1])
+	if err != nil {
+		fmt.Print(err.Error())
+		return
+	}
+	defer file.Close()
+
+	result, err := rwkv.ComparePerplexity(context.Background(), file, base, quantized, rwkv.PerplexityOptions{
+		Window: 1024,
+		Stride: 512,
+		Progress: func(done, _ int) {
+			if done%1000 == 0 {
+				fmt.Printf("\r%d tokens", done)
+			}
+		},
+	})
+	if err != nil {
+		fmt.Print(err.Error())
+		return
+	}
+	fmt.Println()
+	fmt.Printf("F16:  perplexity %.4f, %.4f bits per byte\n", result.Base.Perplexity, result.Base.BitsPerByte)
+	fmt.Printf("Q5_1: perplexity %.4f, %.4f bits per byte\n", result.Other.Perplexity, result.Other.BitsPerByte)
+	fmt.Printf("quality loss: %+.2f%%\n", (result.Ratio()-1)*100)
+}
+
+func loadModel(path string) (*rwkv.RwkvModel, error) {
+	model, err := rwkv.NewRwkvAutoModel(rwkv.RwkvOptions{
+		TokenizerType: rwkv.World,
+		PrintError:    true,
+		CpuThreads:    10,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := model.LoadFromFile(path); err != nil {
+		model.Close()
+		return nil, err
+	}
+	return model, nil
+}
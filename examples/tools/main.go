@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/seasonjs/rwkv"
+)
+
+func main() {
+	model, err := rwkv.NewRwkvAutoModel(rwkv.RwkvOptions{
+		MaxTokens:     200,
+		StopString:    "\n\n",
+		Temperature:   0.8,
+		TopP:          0.5,
+		TokenizerType: rwkv.World, //or World
+		PrintError:    true,
+		CpuThreads:    10,
+		GpuEnable:     false,
+	})
+
+	if err != nil {
+		fmt.Print(err.Error())
+		return
+	}
+
+	defer model.Close()
+
+	err = model.LoadFromFile("./models/RWKV-5-World-3B-v2-f16.bin")
+	if err != nil {
+		fmt.Print(err.Error())
+		return
+	}
+
+	ctx, err := model.InitState()
+	if err != nil {
+		fmt.Print(err.Error())
+		return
+	}
+
+	chat, err := rwkv.NewChat(ctx, rwkv.WorldChatTemplate())
+	if err != nil {
+		fmt.Print(err.Error())
+		return
+	}
+
+	agent, err := rwkv.NewAgent(chat, &rwkv.Tool{
+		Name:        "get_weather",
+		Description: "Get the current weather of a city.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`),
+		Func: func(args json.RawMessage) (string, error) {
+			var in struct {
+				City string `json:"city"`
+			}
+			if err := json.Unmarshal(args, &in); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf(`{"city": %q, "weather": "sunny", "temperature": 23}`, in.City), nil
+		},
+	})
+	if err != nil {
+		fmt.Print(err.Error())
+		return
+	}
+
+	out, calls, err := agent.Send("What is the weather like in Paris today?")
+	if err != nil {
+		fmt.Print(err.Error())
+		return
+	}
+
+	for _, call := range calls {
+		fmt.Printf("called %s with %s: %s\n", call.Name, call.Arguments, call.Result)
+	}
+	fmt.Println(out)
+}
@@ -0,0 +1,145 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"math"
+	"sort"
+)
+
+// FinishReason tells why a generation ended, the values are the ones of the OpenAI API.
+type FinishReason string
+
+const (
+	// FinishStop means a stop string, the end of a constraint, <|endoftext|> or the callback ended the generation.
+	FinishStop FinishReason = "stop"
+	// FinishLength means the generation reached the max tokens.
+	FinishLength FinishReason = "length"
+)
+
+// Generation is the result of Generate.
+type Generation struct {
+	Text   string
+	Tokens []int
+	// Stop is the stop string which ended the generation, it is not part of the text.
+	Stop         string
+	FinishReason FinishReason
+	// Logprobs has one entry per generated token when WithLogprobs is set.
+	Logprobs []TokenLogprob
+}
+
+// TokenLogprob is the log probability of a generated token and of its most likely alternatives.
+type TokenLogprob struct {
+	Token int
+	Text  string
+	Bytes []byte
+	// Logprob and TopLogprobs come from the model logits, before the sampling options change them.
+	Logprob     float64
+	TopLogprobs []TokenAlternative
+	// SampledLogprob and SampledTopLogprobs come from the distribution the token has been sampled from,
+	// after the logit bias, constraint, top-p and temperature. Tokens which could not be sampled are left out.
+	SampledLogprob     float64
+	SampledTopLogprobs []TokenAlternative
+}
+
+// TokenAlternative is a token which could have been generated.
+type TokenAlternative struct {
+	Token   int
+	Text    string
+	Logprob float64
+}
+
+// WithLogprobs returns the log probability of every generated token and of its topN alternatives.
+// Use Generate to read them.
+func WithLogprobs(topN int) PredictOption {
+	return func(o *predictOptions) {
+		o.logprobs = true
+		o.topLogprobs = topN
+	}
+}
+
+// Generate is like Predict, but returns the generated tokens, the finish reason and the log probabilities.
+func (s *RwkvState) Generate(input string, opts ...PredictOption) (*Generation, error) {
+	if err := checkState(s); err != nil {
+		return nil, err
+	}
+	o := newPredictOptions(s.rwkvModel.options, opts)
+	if err := s.handelInput(o.ctx, input); err != nil {
+		return nil, err
+	}
+	return s.generate(nil, o)
+}
+
+// GenerateStream is like Generate, but calls callback with the text of every generated token.
+// The generation stops when callback returns false.
+func (s *RwkvState) GenerateStream(input string, callback func(text string) bool, opts ...PredictOption) (*Generation, error) {
+	if err := checkState(s); err != nil {
+		return nil, err
+	}
+	o := newPredictOptions(s.rwkvModel.options, opts)
+	if err := s.handelInput(o.ctx, input); err != nil {
+		return nil, err
+	}
+	return s.generate(callback, o)
+}
+
+// tokenLogprob computes the log probabilities of the chosen token from the raw logits and the sampled probabilities.
+func (m *RwkvModel) tokenLogprob(token int, logits []float32, probs []float32, topN int) TokenLogprob {
+	lp := TokenLogprob{
+		Token:          token,
+		Text:           m.tokenizer.Decode([]int{token}),
+		Logprob:        logSoftmax(logits, token),
+		SampledLogprob: math.Log(float64(probs[token])),
+	}
+	if tokenBytes, _, err := m.vocabulary(); err == nil && token < len(tokenBytes) {
+		lp.Bytes = tokenBytes[token]
+	} else {
+		lp.Bytes = []byte(lp.Text)
+	}
+	if topN <= 0 {
+		return lp
+	}
+
+	lse := logSumExp(logits)
+	for _, id := range topTokens(logits, topN) {
+		lp.TopLogprobs = append(lp.TopLogprobs, TokenAlternative{
+			Token:   id,
+			Text:    m.tokenizer.Decode([]int{id}),
+			Logprob: float64(logits[id]) - lse,
+		})
+	}
+	for _, id := range topTokens(probs, topN) {
+		if probs[id] <= 0 {
+			break
+		}
+		lp.SampledTopLogprobs = append(lp.SampledTopLogprobs, TokenAlternative{
+			Token:   id,
+			Text:    m.tokenizer.Decode([]int{id}),
+			Logprob: math.Log(float64(probs[id])),
+		})
+	}
+	return lp
+}
+
+// topTokens returns the ids of the n largest values, in decreasing order.
+func topTokens(values []float32, n int) []int {
+	n = min(n, len(values))
+	if n <= 0 {
+		return nil
+	}
+	top := make([]int, 0, n+1)
+	for id, val := range values {
+		if len(top) == n && val <= values[top[n-1]] {
+			continue
+		}
+		i := sort.Search(len(top), func(i int) bool { return values[top[i]] < val })
+		top = append(top, 0)
+		copy(top[i+1:], top[i:])
+		top[i] = id
+		if len(top) > n {
+			top = top[:n]
+		}
+	}
+	return top
+}
@@ -0,0 +1,55 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTopTokens(t *testing.T) {
+	values := []float32{0.1, 0.5, 0.3, 0.9, 0.5, 0}
+	assert(t, fmt.Sprint(topTokens(values, 3)) == "[3 1 4]", fmt.Sprint(topTokens(values, 3)))
+	assert(t, fmt.Sprint(topTokens(values, 10)) == "[3 1 4 2 0 5]")
+	assert(t, len(topTokens(values, 0)) == 0)
+}
+
+func TestAdjustProbs(t *testing.T) {
+	probs := []float32{0.1, 0.6, 0.3}
+	assert(t, adjustProbs(probs, 0, 1, nil) == nil)
+	assert(t, fmt.Sprint(probs) == "[0 1 0]", "greedy sampling is one hot")
+	assert(t, chooseToken(probs, 0) == 1)
+
+	probs = []float32{0.1, 0.6, 0.3}
+	assert(t, adjustProbs(probs, 1, 0.7, nil) == nil)
+	assert(t, probs[0] == 0 && probs[1]+probs[2] > 0.999, "top-p cuts the tail")
+
+	assert(t, adjustProbs(probs, -1, 1, nil) != nil)
+
+	probs = []float32{0.1, 0.6, 0.3}
+	assert(t, adjustProbs(probs, 1, 1, map[int]float32{0: 10}) == nil)
+	assert(t, probs[0] > 0.99, "logit bias")
+	assert(t, adjustProbs(probs, 1, 1, map[int]float32{3: 1}) != nil, "token out of the vocabulary")
+	assert(t, adjustProbs(probs, 1, 1, map[int]float32{-1: 1}) != nil, "negative token")
+	_, err := SampleLogits([]float32{1, 2}, 1, 1, map[int]float32{999999: 1})
+	assert(t, err != nil)
+}
+
+func TestGenerate_KeepsLogits(t *testing.T) {
+	m, c := newFakeModel(t, RwkvOptions{MaxTokens: 10})
+	open, _ := m.tokenizer.Encode("{")
+	closing, _ := m.tokenizer.Encode("}")
+	c.reply = append(open, closing...)
+	s, err := m.InitState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, s.FeedTokens(closing) == nil)
+	logits := append([]float32(nil), s.logits...)
+
+	gen, err := s.Generate("", WithConstraint(NewJSONConstraint()), WithLogprobs(1))
+	assert(t, err == nil && gen.Text == "{}" && gen.FinishReason == FinishStop)
+	assert(t, fmt.Sprint(s.logits) == fmt.Sprint(logits), "the constraint doesn't mask the logits of the state")
+	assert(t, gen.Logprobs[0].TopLogprobs[0].Token == open[0], "logprobs come from the logits")
+}
@@ -5,6 +5,8 @@ go 1.21
 require (
 	github.com/ebitengine/purego v0.5.1
 	github.com/sugarme/tokenizer v0.2.2
+	google.golang.org/grpc v1.66.2
+	google.golang.org/protobuf v1.34.1
 )
 
 require (
@@ -13,6 +15,8 @@ require (
 	github.com/rivo/uniseg v0.4.4 // indirect
 	github.com/schollz/progressbar/v2 v2.15.0 // indirect
 	github.com/sugarme/regexpset v0.0.0-20200920021344-4d4ec8eaf93c // indirect
-	golang.org/x/sys v0.15.0
-	golang.org/x/text v0.14.0 // indirect
+	golang.org/x/net v0.26.0 // indirect
+	golang.org/x/sys v0.21.0
+	golang.org/x/text v0.16.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240604185151-ef581f913117 // indirect
 )
@@ -0,0 +1,732 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Grammar is a context free grammar in GBNF syntax, the format used by llama.cpp:
+//
+//	root   ::= answer "."
+//	answer ::= "yes" | "no" | [0-9]+ ("," [0-9]+)*
+//
+// Rules are made of literals ("..."), character classes ([a-z], [^"]), any character (.),
+// rule references, groups and the repetitions *, +, ? and {m,n}. Comments start with #.
+// The generation starts at the rule named root.
+// A Grammar is a Constraint and can be used with WithGrammar or WithConstraint.
+type Grammar struct {
+	rules []grammarRule
+	names map[string]int
+	root  int
+}
+
+type grammarRule struct {
+	name string
+	alts [][]grammarElement
+}
+
+type runeRange struct {
+	lo, hi rune
+}
+
+// grammarElement is either a character set, a reference to a rule or a pattern.
+type grammarElement struct {
+	ref    int
+	ranges []runeRange
+	negate bool
+	// pattern matches the content of a JSON string whose decoded text matches the regex,
+	// see JSONSchema.Pattern. It can't be written in GBNF.
+	pattern *Regex
+}
+
+func (e *grammarElement) isRef() bool {
+	return e.ranges == nil && !e.negate && e.pattern == nil
+}
+
+func (e *grammarElement) match(r rune) bool {
+	for _, rr := range e.ranges {
+		if r >= rr.lo && r <= rr.hi {
+			return !e.negate
+		}
+	}
+	return e.negate
+}
+
+// matchAny reports whether any rune in [lo, hi] matches the set, a pattern may match any of them.
+func (e *grammarElement) matchAny(lo, hi rune) bool {
+	if e.pattern != nil {
+		return true
+	}
+	if e.negate {
+		// a negated set only fails to match runes it covers completely
+		for _, rr := range e.ranges {
+			if rr.lo <= lo && rr.hi >= hi {
+				return false
+			}
+		}
+		return true
+	}
+	for _, rr := range e.ranges {
+		if rr.lo <= hi && rr.hi >= lo {
+			return true
+		}
+	}
+	return false
+}
+
+// WithGrammar restricts the generated text to the grammar.
+func WithGrammar(g *Grammar) PredictOption {
+	return WithConstraint(g)
+}
+
+// ParseGrammar parses a grammar in GBNF syntax.
+func ParseGrammar(src string) (*Grammar, error) {
+	p := &grammarParser{
+		src: src,
+		g:   &Grammar{names: make(map[string]int)},
+	}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	g := p.g
+	for i, rule := range g.rules {
+		if rule.alts == nil {
+			return nil, fmt.Errorf("grammar rule %s is used but not defined", g.rules[i].name)
+		}
+	}
+	root, ok := g.names["root"]
+	if !ok {
+		return nil, fmt.Errorf("grammar has no root rule")
+	}
+	g.root = root
+	if err := g.checkLeftRecursion(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// MustParseGrammar is like ParseGrammar but panics on error.
+func MustParseGrammar(src string) *Grammar {
+	g, err := ParseGrammar(src)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+type grammarParser struct {
+	src string
+	pos int
+	g   *Grammar
+	// counter for the names of generated rules
+	generated int
+}
+
+// ruleId returns the id of a rule, rules can be referenced before they are defined.
+func (p *grammarParser) ruleId(name string) int {
+	if id, ok := p.g.names[name]; ok {
+		return id
+	}
+	p.g.rules = append(p.g.rules, grammarRule{name: name})
+	id := len(p.g.rules) - 1
+	p.g.names[name] = id
+	return id
+}
+
+func (p *grammarParser) newRule(base string, alts [][]grammarElement) int {
+	p.generated++
+	id := p.ruleId(fmt.Sprintf("%s_%d", base, p.generated))
+	p.g.rules[id].alts = alts
+	return id
+}
+
+func (p *grammarParser) errorf(format string, args ...any) error {
+	line := strings.Count(p.src[:p.pos], "\n") + 1
+	return fmt.Errorf("grammar line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *grammarParser) parse() error {
+	p.skipSpace(true)
+	for p.pos < len(p.src) {
+		if err := p.parseRule(); err != nil {
+			return err
+		}
+		p.skipSpace(true)
+	}
+	return nil
+}
+
+// skipSpace skips blanks and comments, and new lines too if newline is set.
+func (p *grammarParser) skipSpace(newline bool) {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case newline && (c == '\n' || c == '\r'):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isNameChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_'
+}
+
+func (p *grammarParser) parseName() string {
+	start := p.pos
+	for p.pos < len(p.src) && isNameChar(p.src[p.pos]) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *grammarParser) parseRule() error {
+	name := p.parseName()
+	if len(name) == 0 {
+		return p.errorf("expect a rule name")
+	}
+	p.skipSpace(false)
+	if !strings.HasPrefix(p.src[p.pos:], "::=") {
+		return p.errorf("expect ::= after rule %s", name)
+	}
+	p.pos += 3
+	p.skipSpace(true)
+
+	id := p.ruleId(name)
+	if p.g.rules[id].alts != nil {
+		return p.errorf("rule %s is defined twice", name)
+	}
+	alts, err := p.parseAlternatives(name, false)
+	if err != nil {
+		return err
+	}
+	p.g.rules[id].alts = alts
+
+	if p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+		return p.errorf("unexpected %q at the end of rule %s", p.src[p.pos], name)
+	}
+	return nil
+}
+
+func (p *grammarParser) parseAlternatives(name string, nested bool) ([][]grammarElement, error) {
+	var alts [][]grammarElement
+	for {
+		seq, err := p.parseSequence(name, nested)
+		if err != nil {
+			return nil, err
+		}
+		alts = append(alts, seq)
+		// an alternative may also start on the next line
+		end := p.pos
+		p.skipSpace(true)
+		if p.pos >= len(p.src) || p.src[p.pos] != '|' {
+			p.pos = end
+			return alts, nil
+		}
+		p.pos++
+		p.skipSpace(true)
+	}
+}
+
+func (p *grammarParser) parseSequence(name string, nested bool) ([]grammarElement, error) {
+	seq := []grammarElement{}
+	// last is the start of the last atom, which a repetition applies to
+	last := -1
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			last = len(seq)
+			for {
+				if p.pos >= len(p.src) {
+					return nil, p.errorf("unterminated literal in rule %s", name)
+				}
+				if p.src[p.pos] == '"' {
+					p.pos++
+					break
+				}
+				r, err := p.parseChar()
+				if err != nil {
+					return nil, err
+				}
+				seq = append(seq, grammarElement{ranges: []runeRange{{r, r}}})
+			}
+		case c == '[':
+			p.pos++
+			last = len(seq)
+			elem := grammarElement{ranges: []runeRange{}}
+			if p.pos < len(p.src) && p.src[p.pos] == '^' {
+				elem.negate = true
+				p.pos++
+			}
+			for {
+				if p.pos >= len(p.src) {
+					return nil, p.errorf("unterminated character class in rule %s", name)
+				}
+				if p.src[p.pos] == ']' {
+					p.pos++
+					break
+				}
+				lo, err := p.parseChar()
+				if err != nil {
+					return nil, err
+				}
+				hi := lo
+				if p.pos+1 < len(p.src) && p.src[p.pos] == '-' && p.src[p.pos+1] != ']' {
+					p.pos++
+					if hi, err = p.parseChar(); err != nil {
+						return nil, err
+					}
+				}
+				elem.ranges = append(elem.ranges, runeRange{lo, hi})
+			}
+			seq = append(seq, elem)
+		case c == '.':
+			p.pos++
+			last = len(seq)
+			seq = append(seq, grammarElement{ranges: []runeRange{}, negate: true})
+		case c == '(':
+			p.pos++
+			p.skipSpace(true)
+			alts, err := p.parseAlternatives(name, true)
+			if err != nil {
+				return nil, err
+			}
+			if p.pos >= len(p.src) || p.src[p.pos] != ')' {
+				return nil, p.errorf("expect ) in rule %s", name)
+			}
+			p.pos++
+			last = len(seq)
+			seq = append(seq, grammarElement{ref: p.newRule(name, alts)})
+		case isNameChar(c):
+			last = len(seq)
+			seq = append(seq, grammarElement{ref: p.ruleId(p.parseName())})
+		case c == '*' || c == '+' || c == '?' || c == '{':
+			if last < 0 {
+				return nil, p.errorf("expect an item before %q in rule %s", c, name)
+			}
+			minTimes, maxTimes, err := p.parseRepetition()
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq[:last], p.repeat(name, seq[last:], minTimes, maxTimes)...)
+			last = -1
+		default:
+			return seq, nil
+		}
+		p.skipSpace(nested)
+	}
+	return seq, nil
+}
+
+// parseRepetition returns the bounds of a repetition, maxTimes is -1 without upper bound.
+func (p *grammarParser) parseRepetition() (int, int, error) {
+	c := p.src[p.pos]
+	p.pos++
+	switch c {
+	case '*':
+		return 0, -1, nil
+	case '+':
+		return 1, -1, nil
+	case '?':
+		return 0, 1, nil
+	}
+	end := strings.IndexByte(p.src[p.pos:], '}')
+	if end < 0 {
+		return 0, 0, p.errorf("unterminated repetition")
+	}
+	body := strings.ReplaceAll(p.src[p.pos:p.pos+end], " ", "")
+	p.pos += end + 1
+	lo, hi, hasComma := strings.Cut(body, ",")
+	minTimes, err := strconv.Atoi(lo)
+	if err != nil {
+		return 0, 0, p.errorf("invalid repetition {%s}", body)
+	}
+	maxTimes := minTimes
+	if hasComma {
+		maxTimes = -1
+		if len(hi) > 0 {
+			if maxTimes, err = strconv.Atoi(hi); err != nil || maxTimes < minTimes {
+				return 0, 0, p.errorf("invalid repetition {%s}", body)
+			}
+		}
+	}
+	return minTimes, maxTimes, nil
+}
+
+// repeat rewrites an atom repeated between minTimes and maxTimes into generated rules.
+func (p *grammarParser) repeat(name string, atom []grammarElement, minTimes, maxTimes int) []grammarElement {
+	atom = append([]grammarElement(nil), atom...)
+	if len(atom) > 1 {
+		atom = []grammarElement{{ref: p.newRule(name, [][]grammarElement{atom})}}
+	}
+	var seq []grammarElement
+	for i := 0; i < minTimes; i++ {
+		seq = append(seq, atom...)
+	}
+	if maxTimes < 0 {
+		// star ::= atom star | ε
+		star := p.newRule(name, nil)
+		p.g.rules[star].alts = [][]grammarElement{append(append([]grammarElement(nil), atom...), grammarElement{ref: star}), {}}
+		return append(seq, grammarElement{ref: star})
+	}
+	// opt_k ::= atom opt_k-1 | ε, nested so that at most maxTimes-minTimes atoms are added
+	optional := -1
+	for i := minTimes; i < maxTimes; i++ {
+		alt := append([]grammarElement(nil), atom...)
+		if optional >= 0 {
+			alt = append(alt, grammarElement{ref: optional})
+		}
+		optional = p.newRule(name, [][]grammarElement{alt, {}})
+	}
+	if optional >= 0 {
+		seq = append(seq, grammarElement{ref: optional})
+	}
+	return seq
+}
+
+// parseChar parses a single, possibly escaped, character of a literal or class.
+func (p *grammarParser) parseChar() (rune, error) {
+	if p.src[p.pos] != '\\' {
+		r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+		p.pos += size
+		return r, nil
+	}
+	if p.pos+1 >= len(p.src) {
+		return 0, p.errorf("unterminated escape")
+	}
+	c := p.src[p.pos+1]
+	p.pos += 2
+	hexLen := 0
+	switch c {
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case '\\', '"', '[', ']', '-', '^':
+		return rune(c), nil
+	case 'x':
+		hexLen = 2
+	case 'u':
+		hexLen = 4
+	case 'U':
+		hexLen = 8
+	default:
+		return 0, p.errorf("unknown escape \\%c", c)
+	}
+	if p.pos+hexLen > len(p.src) {
+		return 0, p.errorf("unterminated escape")
+	}
+	v, err := strconv.ParseUint(p.src[p.pos:p.pos+hexLen], 16, 32)
+	if err != nil {
+		return 0, p.errorf("invalid escape \\%c%s", c, p.src[p.pos:p.pos+hexLen])
+	}
+	p.pos += hexLen
+	return rune(v), nil
+}
+
+// checkLeftRecursion rejects rules that can reference themselves without consuming a character,
+// the matcher would loop forever on them.
+func (g *Grammar) checkLeftRecursion() error {
+	nullable := make([]bool, len(g.rules))
+	for changed := true; changed; {
+		changed = false
+		for i, rule := range g.rules {
+			if nullable[i] {
+				continue
+			}
+			for _, alt := range rule.alts {
+				empty := true
+				for _, elem := range alt {
+					if !elem.isRef() || !nullable[elem.ref] {
+						empty = false
+						break
+					}
+				}
+				if empty {
+					nullable[i], changed = true, true
+					break
+				}
+			}
+		}
+	}
+
+	// visiting: 1 on the current path, 2 done
+	visiting := make([]int, len(g.rules))
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch visiting[i] {
+		case 1:
+			return fmt.Errorf("grammar rule %s is left recursive", g.rules[i].name)
+		case 2:
+			return nil
+		}
+		visiting[i] = 1
+		for _, alt := range g.rules[i].alts {
+			for _, elem := range alt {
+				if !elem.isRef() {
+					break
+				}
+				if err := visit(elem.ref); err != nil {
+					return err
+				}
+				if !nullable[elem.ref] {
+					break
+				}
+			}
+		}
+		visiting[i] = 2
+		return nil
+	}
+	for i := range g.rules {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grammarPos points at an element of an alternative of a rule.
+type grammarPos struct {
+	rule, alt, idx int32
+}
+
+// grammarStack is an immutable linked stack of positions, stacks share their tails.
+// The top is always a character set or a pattern, a nil stack means the grammar is complete.
+type grammarStack struct {
+	pos    grammarPos
+	parent *grammarStack
+	// pattern is the progress in the pattern on top
+	pattern patternMatch
+}
+
+// patternMatch is the DFA state of the text decoded so far from a JSON string and the escape sequence
+// being read, the zero value is before the pattern.
+type patternMatch struct {
+	state  *dfaState
+	escape string
+}
+
+// jsonEscapes are the characters of the two character escape sequences of JSON.
+var jsonEscapes = map[rune]rune{'"': '"', '\\': '\\', '/': '/', 'b': '\b', 'f': '\f', 'n': '\n', 'r': '\r', 't': '\t'}
+
+func (p patternMatch) done() bool {
+	return len(p.escape) == 0 && p.state.match
+}
+
+// advance reads a character of the JSON string, the characters which must be escaped end it.
+func (p patternMatch) advance(r rune) (patternMatch, bool) {
+	switch {
+	case len(p.escape) == 0:
+		if r == '"' || r < 0x20 {
+			return p, false
+		}
+		if r == '\\' {
+			return patternMatch{state: p.state, escape: `\`}, true
+		}
+		return p.feed(r)
+	case p.escape == `\`:
+		if r == 'u' {
+			return patternMatch{state: p.state, escape: `\u`}, true
+		}
+		if c, ok := jsonEscapes[r]; ok {
+			return p.feed(c)
+		}
+		return p, false
+	}
+	if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+		return p, false
+	}
+	escape := p.escape + string(r)
+	if len(escape) < len(`\u0000`) {
+		return patternMatch{state: p.state, escape: escape}, true
+	}
+	code, _ := strconv.ParseUint(escape[2:], 16, 16)
+	// surrogate pairs are not supported
+	if utf16.IsSurrogate(rune(code)) {
+		return p, false
+	}
+	return p.feed(rune(code))
+}
+
+// feed runs the DFA over the utf-8 bytes of a decoded character.
+func (p patternMatch) feed(r rune) (patternMatch, bool) {
+	state := p.state
+	if state == deadState {
+		return p, false
+	}
+	for _, b := range utf8.AppendRune(nil, r) {
+		next := state.next(b)
+		if next == nil {
+			return p, false
+		}
+		state = next.(*dfaState)
+	}
+	return patternMatch{state: state}, true
+}
+
+// grammarState holds every stack the text so far can be parsed with,
+// and the bytes of an incomplete utf-8 character.
+type grammarState struct {
+	g       *Grammar
+	stacks  []*grammarStack
+	pending []byte
+}
+
+func (g *Grammar) start() matchState {
+	var stacks []*grammarStack
+	for alt := range g.rules[g.root].alts {
+		stacks = g.expand(&grammarStack{pos: grammarPos{int32(g.root), int32(alt), 0}}, stacks)
+	}
+	return &grammarState{g: g, stacks: stacks}
+}
+
+// expand follows rule references and ends of alternatives until every stack has a character set on top.
+func (g *Grammar) expand(s *grammarStack, out []*grammarStack) []*grammarStack {
+	if s == nil {
+		return appendStack(out, nil)
+	}
+	seq := g.rules[s.pos.rule].alts[s.pos.alt]
+	if int(s.pos.idx) == len(seq) {
+		return g.expand(s.parent, out)
+	}
+	elem := &seq[s.pos.idx]
+	if elem.pattern != nil {
+		if s.pattern.state == nil {
+			s = &grammarStack{pos: s.pos, parent: s.parent, pattern: patternMatch{state: elem.pattern.initial}}
+		}
+		out = appendStack(out, s)
+		if s.pattern.done() {
+			out = g.expand(&grammarStack{pos: grammarPos{s.pos.rule, s.pos.alt, s.pos.idx + 1}, parent: s.parent}, out)
+		}
+		return out
+	}
+	if !elem.isRef() {
+		return appendStack(out, s)
+	}
+	// skip the continuation when the reference ends the alternative, so repetitions don't grow the stack
+	next := s.parent
+	if int(s.pos.idx)+1 < len(seq) {
+		next = &grammarStack{pos: grammarPos{s.pos.rule, s.pos.alt, s.pos.idx + 1}, parent: s.parent}
+	}
+	for alt := range g.rules[elem.ref].alts {
+		out = g.expand(&grammarStack{pos: grammarPos{int32(elem.ref), int32(alt), 0}, parent: next}, out)
+	}
+	return out
+}
+
+func appendStack(stacks []*grammarStack, s *grammarStack) []*grammarStack {
+	for _, other := range stacks {
+		if other == s || (other != nil && s != nil && other.pos == s.pos && other.parent == s.parent && other.pattern == s.pattern) {
+			return stacks
+		}
+	}
+	return append(stacks, s)
+}
+
+func (g *Grammar) element(s *grammarStack) *grammarElement {
+	return &g.rules[s.pos.rule].alts[s.pos.alt][s.pos.idx]
+}
+
+func (s *grammarState) done() bool {
+	if len(s.pending) > 0 {
+		return false
+	}
+	for _, stack := range s.stacks {
+		if stack == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *grammarState) next(b byte) matchState {
+	if len(s.pending) == 0 && b < utf8.RuneSelf {
+		return s.advance(rune(b))
+	}
+	pending := append(append(make([]byte, 0, len(s.pending)+1), s.pending...), b)
+	size := utf8SequenceLength(pending[0])
+	if size == 0 || (len(pending) > 1 && b&0xC0 != 0x80) {
+		return nil
+	}
+	if len(pending) == size {
+		r, _ := utf8.DecodeRune(pending)
+		if r == utf8.RuneError {
+			return nil
+		}
+		return s.advance(r)
+	}
+	// prune as soon as no character starting with these bytes can match
+	lo, hi := utf8Bounds(pending, size)
+	for _, stack := range s.stacks {
+		if stack != nil && s.g.element(stack).matchAny(lo, hi) {
+			return &grammarState{g: s.g, stacks: s.stacks, pending: pending}
+		}
+	}
+	return nil
+}
+
+func (s *grammarState) advance(r rune) matchState {
+	var stacks []*grammarStack
+	for _, stack := range s.stacks {
+		if stack != nil && stack.pattern.state != nil {
+			if pattern, ok := stack.pattern.advance(r); ok {
+				stacks = s.g.expand(&grammarStack{pos: stack.pos, parent: stack.parent, pattern: pattern}, stacks)
+			}
+			continue
+		}
+		if stack == nil || !s.g.element(stack).match(r) {
+			continue
+		}
+		pos := stack.pos
+		pos.idx++
+		stacks = s.g.expand(&grammarStack{pos: pos, parent: stack.parent}, stacks)
+	}
+	if len(stacks) == 0 {
+		return nil
+	}
+	return &grammarState{g: s.g, stacks: stacks}
+}
+
+// utf8SequenceLength returns the length of the utf-8 sequence started by the byte, 0 if it can't start one.
+func utf8SequenceLength(b byte) int {
+	switch {
+	case b&0xE0 == 0xC0:
+		return 2
+	case b&0xF0 == 0xE0:
+		return 3
+	case b&0xF8 == 0xF0:
+		return 4
+	}
+	return 0
+}
+
+// utf8Bounds returns the smallest and largest characters encoded with the prefix.
+func utf8Bounds(prefix []byte, size int) (rune, rune) {
+	mask := []byte{0, 0, 0x1F, 0x0F, 0x07}[size]
+	lo := rune(prefix[0] & mask)
+	for _, b := range prefix[1:] {
+		lo = lo<<6 | rune(b&0x3F)
+	}
+	hi := lo
+	for i := len(prefix); i < size; i++ {
+		lo, hi = lo<<6, hi<<6|0x3F
+	}
+	return lo, hi
+}
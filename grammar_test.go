@@ -0,0 +1,84 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseGrammar(t *testing.T) {
+	g, err := ParseGrammar(`
+# a list of answers
+root   ::= answer ("," " "? answer)* "."
+answer ::= "yes" | "no"
+         | [1-9] [0-9]{0,2}
+         | "\"" [^"\n]+ "\""
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := []string{`yes.`, `no, yes.`, `7,42, 100.`, `"oui", no.`}
+	for _, text := range valid {
+		assert(t, matchString(g, text), text)
+	}
+	invalid := []string{`yes`, `maybe.`, `1000.`, `07.`, `"".`, `yes,, no.`, `yes. `}
+	for _, text := range invalid {
+		assert(t, !matchString(g, text), text)
+	}
+
+	for _, src := range []string{
+		`answer ::= "yes"`,
+		`root ::= answer`,
+		`root ::= "a`,
+		`root ::= [a-z`,
+		`root ::= ("a"`,
+		`root ::= * "a"`,
+		`root ::= "a"{3,1}`,
+		`root ::= "\q"`,
+		`root ::= root "a" | "a"`,
+		"root ::= x \"a\"\nx ::= \"b\"?\nroot ::= \"c\"",
+	} {
+		_, err := ParseGrammar(src)
+		assert(t, err != nil, src)
+	}
+}
+
+func TestGrammarUnicode(t *testing.T) {
+	g := MustParseGrammar(`root ::= [一-龥]+ "。" .`)
+	assert(t, matchString(g, "天气很好。!"))
+	assert(t, matchString(g, "天气。é"))
+	assert(t, !matchString(g, "weather。!"))
+	assert(t, !matchString(g, "天气"))
+
+	// the first byte of a character outside the class is rejected at once
+	state := g.start()
+	assert(t, state.next("é"[0]) == nil)
+	assert(t, state.next("天"[0]) != nil)
+}
+
+func TestGrammarDecoder(t *testing.T) {
+	vocab := []string{"", "yes", "no", "y", "es", "n", "o", "!", "nope"}
+	d := newTestDecoder(MustParseGrammar(`root ::= ("yes" | "no") "!"?`), vocab)
+	negInf := float32(math.Inf(-1))
+
+	logits := make([]float32, len(vocab))
+	assert(t, d.mask(logits))
+	for i, token := range vocab {
+		allowed := token == "yes" || token == "no" || token == "y" || token == "n"
+		assert(t, (logits[i] != negInf) == allowed, token)
+	}
+
+	assert(t, d.accept(5))
+	assert(t, !d.accept(8))
+	assert(t, d.accept(6))
+	logits = make([]float32, len(vocab))
+	assert(t, d.mask(logits))
+	assert(t, logits[endOfTextToken] != negInf && logits[7] != negInf, "may end or continue")
+
+	assert(t, d.accept(7))
+	logits = make([]float32, len(vocab))
+	assert(t, !d.mask(logits), "the grammar is complete")
+}
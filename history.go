@@ -0,0 +1,138 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"errors"
+)
+
+// TokenRole tells where a run of tokens in the state history comes from.
+type TokenRole string
+
+const (
+	// RolePrompt tokens come from InitState or CleanState.
+	RolePrompt TokenRole = "prompt"
+	// RoleInput tokens come from Predict or PredictStream input.
+	RoleInput TokenRole = "input"
+	// RoleOutput tokens have been generated by the model.
+	RoleOutput TokenRole = "output"
+)
+
+// TokenSegment is a run of tokens with the same role.
+type TokenSegment struct {
+	Role   TokenRole
+	Tokens []int
+}
+
+// Tokens returns all tokens that produced the state, in order.
+// It is empty unless RwkvOptions.TrackTokens is set.
+func (s *RwkvState) Tokens() []int {
+	var tokens []int
+	for _, segment := range s.history {
+		tokens = append(tokens, segment.Tokens...)
+	}
+	return tokens
+}
+
+// Segments returns a copy of the token history grouped by role.
+func (s *RwkvState) Segments() []TokenSegment {
+	if s.history == nil {
+		return nil
+	}
+	segments := make([]TokenSegment, len(s.history))
+	for i, segment := range s.history {
+		segments[i] = TokenSegment{
+			Role:   segment.Role,
+			Tokens: append([]int(nil), segment.Tokens...),
+		}
+	}
+	return segments
+}
+
+// TokenCount returns the number of tokens that produced the state.
+func (s *RwkvState) TokenCount() int {
+	count := 0
+	for _, segment := range s.history {
+		count += len(segment.Tokens)
+	}
+	return count
+}
+
+// Replay rebuilds the state on another context by feeding the recorded tokens again.
+// ctx is a context of m, usually acquired from a ContextPool of m, nil for the context of m.
+// Replaying on the same model file gives an identical state.
+// If the model uses another tokenizer, every segment is decoded and encoded again.
+// The new state starts from the initial state of the given model and is bound to ctx.
+func (s *RwkvState) Replay(m *RwkvModel, ctx *RwkvCtx) (*RwkvState, error) {
+	return s.replay(m, ctx, s.history)
+}
+
+// Rewind returns a new state without the last n tokens, which is useful to undo a turn.
+// The new state is bound to the context of the state.
+func (s *RwkvState) Rewind(n int) (*RwkvState, error) {
+	if n < 0 || n > s.TokenCount() {
+		return nil, errors.New("can not rewind more tokens than the state has seen")
+	}
+	history := s.Segments()
+	for n > 0 {
+		last := &history[len(history)-1]
+		if len(last.Tokens) > n {
+			last.Tokens = last.Tokens[:len(last.Tokens)-n]
+			break
+		}
+		n -= len(last.Tokens)
+		history = history[:len(history)-1]
+	}
+	return s.replay(s.rwkvModel, s.ctx, history)
+}
+
+func (s *RwkvState) replay(m *RwkvModel, ctx *RwkvCtx, history []TokenSegment) (*RwkvState, error) {
+	if err := checkState(s); err != nil {
+		return nil, err
+	}
+	if !s.rwkvModel.options.TrackTokens || s.historyLost {
+		return nil, errors.New("the token history of the state is not complete, enable TrackTokens and don't load states manually")
+	}
+	out, err := m.InitState()
+	if err != nil {
+		return nil, err
+	}
+	out.Bind(ctx)
+	retokenize := m.options.TokenizerType != s.rwkvModel.options.TokenizerType
+	for _, segment := range history {
+		tokens := segment.Tokens
+		if retokenize {
+			tokens, err = m.tokenizer.Encode(s.rwkvModel.tokenizer.Decode(tokens))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err = out.evalTokens(nil, segment.Role, tokens); err != nil {
+			return nil, err
+		}
+		if !m.options.TrackTokens {
+			out.appendHistory(segment.Role, tokens...)
+		}
+	}
+	return out, nil
+}
+
+// record appends the tokens to the history if token tracking is enabled.
+func (s *RwkvState) record(role TokenRole, tokens ...int) {
+	if !s.rwkvModel.options.TrackTokens {
+		return
+	}
+	s.appendHistory(role, tokens...)
+}
+
+func (s *RwkvState) appendHistory(role TokenRole, tokens ...int) {
+	if len(tokens) == 0 {
+		return
+	}
+	if n := len(s.history); n > 0 && s.history[n-1].Role == role {
+		s.history[n-1].Tokens = append(s.history[n-1].Tokens, tokens...)
+		return
+	}
+	s.history = append(s.history, TokenSegment{Role: role, Tokens: append([]int(nil), tokens...)})
+}
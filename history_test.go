@@ -0,0 +1,111 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestRwkvState_History(t *testing.T) {
+	t.Run("record by role", func(t *testing.T) {
+		s := &RwkvState{rwkvModel: &RwkvModel{options: &RwkvOptions{TrackTokens: true}}}
+		s.record(RolePrompt, 1, 2)
+		s.record(RolePrompt, 3)
+		s.record(RoleInput, 4)
+		s.record(RoleOutput, 5)
+		s.record(RoleOutput, 6)
+
+		segments := s.Segments()
+		assert(t, len(segments) == 3)
+		assert(t, segments[0].Role == RolePrompt && len(segments[0].Tokens) == 3)
+		assert(t, segments[2].Role == RoleOutput && len(segments[2].Tokens) == 2)
+		assert(t, s.TokenCount() == 6)
+		assert(t, len(s.Tokens()) == 6 && s.Tokens()[3] == 4)
+
+		segments[0].Tokens[0] = 100
+		assert(t, s.Tokens()[0] == 1)
+	})
+
+	t.Run("tracking disabled", func(t *testing.T) {
+		s := &RwkvState{rwkvModel: &RwkvModel{options: &RwkvOptions{}}}
+		s.record(RolePrompt, 1, 2)
+		assert(t, s.TokenCount() == 0)
+		assert(t, s.Segments() == nil)
+	})
+}
+
+func TestRwkvState_Replay(t *testing.T) {
+	m, c := newFakeModel(t, RwkvOptions{TrackTokens: true})
+	c.reply = []int{10, 11, 12}
+	s, err := m.InitState("hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, s.FeedTokens([]int{10, 11}) == nil)
+	// a generated token
+	assert(t, s.eval(12) == nil)
+	s.record(RoleOutput, 12)
+
+	t.Run("identical state", func(t *testing.T) {
+		ctx := &RwkvCtx{ctx: 2}
+		out, err := s.Replay(m, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert(t, out.evalCtx() == ctx)
+		assert(t, slices.Equal(out.Tokens(), s.Tokens()))
+		assert(t, fmt.Sprint(out.Segments()) == fmt.Sprint(s.Segments()))
+		assert(t, slices.Equal(out.state, s.state) && slices.Equal(out.logits, s.logits))
+	})
+
+	t.Run("other tokenizer", func(t *testing.T) {
+		tk, err := NewNormalTokenizer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, _ := newFakeModel(t, RwkvOptions{})
+		other.tokenizer = tk
+		other.options.TokenizerType = Normal
+
+		out, err := s.Replay(other, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []int
+		for _, segment := range s.Segments() {
+			tokens, err := tk.Encode(m.Detokenize(segment.Tokens))
+			assert(t, err == nil)
+			want = append(want, tokens...)
+		}
+		assert(t, slices.Equal(out.Tokens(), want), "the history is encoded again", fmt.Sprint(out.Tokens()))
+		assert(t, len(out.Segments()) == 3 && tk.Decode(out.Tokens()) == m.Detokenize(s.Tokens()))
+		assert(t, int(out.state[0]) == len(want) && int(out.state[1]) == want[len(want)-1])
+	})
+
+	t.Run("rewind", func(t *testing.T) {
+		count := s.TokenCount()
+		prompt := len(s.Segments()[0].Tokens)
+
+		out, err := s.Rewind(0)
+		assert(t, err == nil && slices.Equal(out.Tokens(), s.Tokens()) && slices.Equal(out.state, s.state))
+
+		out, err = s.Rewind(2)
+		assert(t, err == nil && slices.Equal(out.Tokens(), s.Tokens()[:count-2]))
+		assert(t, fmt.Sprint(out.Segments()) == fmt.Sprint([]TokenSegment{s.Segments()[0], {Role: RoleInput, Tokens: []int{10}}}))
+		assert(t, int(out.state[0]) == count-2 && int(out.state[1]) == 10 && out.logits[11] == 100)
+
+		out, err = s.Rewind(count - prompt + 1)
+		assert(t, err == nil && len(out.Segments()) == 1 && out.TokenCount() == prompt-1)
+
+		out, err = s.Rewind(count)
+		assert(t, err == nil && out.TokenCount() == 0 && out.state[0] == 0)
+
+		_, err = s.Rewind(count + 1)
+		assert(t, err != nil)
+		_, err = s.Rewind(-1)
+		assert(t, err != nil)
+	})
+}
@@ -0,0 +1,295 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+// maxJSONSpaces limits consecutive whitespace, so that the model can't loop on it forever.
+const maxJSONSpaces = 2
+
+// jsonConstraint accepts exactly one syntactically valid JSON object.
+type jsonConstraint struct{}
+
+// NewJSONConstraint returns a constraint accepting a single JSON object.
+func NewJSONConstraint() Constraint {
+	return jsonConstraint{}
+}
+
+func (jsonConstraint) start() matchState {
+	return &jsonState{mode: jsonRoot}
+}
+
+type jsonMode uint8
+
+const (
+	jsonRoot jsonMode = iota
+	// jsonValue expects a value, jsonValueOrEnd also accepts the end of an empty array
+	jsonValue
+	jsonValueOrEnd
+	// jsonKey expects a key, jsonKeyOrEnd also accepts the end of an empty object
+	jsonKey
+	jsonKeyOrEnd
+	jsonColon
+	jsonAfterValue
+	jsonString
+	jsonNumber
+	jsonLiteral
+	jsonDone
+)
+
+type jsonNumberMode uint8
+
+const (
+	numberMinus jsonNumberMode = iota
+	numberZero
+	numberInt
+	numberDot
+	numberFrac
+	numberExp
+	numberExpSign
+	numberExpInt
+)
+
+// jsonState is the pushdown automaton state, every transition returns a new value.
+type jsonState struct {
+	// stack of open containers, '{' or '['
+	stack  string
+	mode   jsonMode
+	spaces int8
+	// string state: key string, escape pending, remaining \u hex digits and utf-8 continuation bytes
+	key    bool
+	escape bool
+	hex    int8
+	utf8   int8
+	number jsonNumberMode
+	// literal holds the rest of true, false or null
+	literal string
+}
+
+func (s *jsonState) done() bool {
+	return s.mode == jsonDone
+}
+
+func (s *jsonState) next(b byte) matchState {
+	n := *s
+	switch s.mode {
+	case jsonRoot:
+		if b != '{' {
+			return nil
+		}
+		n.stack, n.mode = "{", jsonKeyOrEnd
+		return &n
+	case jsonString:
+		return n.nextString(b)
+	case jsonNumber:
+		if n.nextNumber(b) {
+			return &n
+		}
+		if n.number == numberMinus || n.number == numberDot || n.number == numberExp || n.number == numberExpSign {
+			return nil
+		}
+		n.mode = jsonAfterValue
+		return n.next(b)
+	case jsonLiteral:
+		if b != n.literal[0] {
+			return nil
+		}
+		n.literal = n.literal[1:]
+		if len(n.literal) == 0 {
+			n.mode = jsonAfterValue
+		}
+		return &n
+	case jsonDone:
+		return nil
+	}
+
+	if b == ' ' || b == '\n' || b == '\t' || b == '\r' {
+		if n.spaces >= maxJSONSpaces {
+			return nil
+		}
+		n.spaces++
+		return &n
+	}
+	n.spaces = 0
+
+	switch s.mode {
+	case jsonValue, jsonValueOrEnd:
+		if b == ']' && s.mode == jsonValueOrEnd {
+			return n.close(b)
+		}
+		return n.startValue(b)
+	case jsonKey, jsonKeyOrEnd:
+		if b == '}' && s.mode == jsonKeyOrEnd {
+			return n.close(b)
+		}
+		if b != '"' {
+			return nil
+		}
+		n.mode, n.key = jsonString, true
+		return &n
+	case jsonColon:
+		if b != ':' {
+			return nil
+		}
+		n.mode = jsonValue
+		return &n
+	case jsonAfterValue:
+		top := n.stack[len(n.stack)-1]
+		switch {
+		case b == ',' && top == '{':
+			n.mode = jsonKey
+		case b == ',' && top == '[':
+			n.mode = jsonValue
+		case b == '}' || b == ']':
+			return n.close(b)
+		default:
+			return nil
+		}
+		return &n
+	}
+	return nil
+}
+
+func (s *jsonState) startValue(b byte) matchState {
+	switch {
+	case b == '{':
+		s.stack += "{"
+		s.mode = jsonKeyOrEnd
+	case b == '[':
+		s.stack += "["
+		s.mode = jsonValueOrEnd
+	case b == '"':
+		s.mode, s.key = jsonString, false
+	case b == '-':
+		s.mode, s.number = jsonNumber, numberMinus
+	case b == '0':
+		s.mode, s.number = jsonNumber, numberZero
+	case b >= '1' && b <= '9':
+		s.mode, s.number = jsonNumber, numberInt
+	case b == 't':
+		s.mode, s.literal = jsonLiteral, "rue"
+	case b == 'f':
+		s.mode, s.literal = jsonLiteral, "alse"
+	case b == 'n':
+		s.mode, s.literal = jsonLiteral, "ull"
+	default:
+		return nil
+	}
+	return s
+}
+
+// close ends the innermost container with the bracket.
+func (s *jsonState) close(b byte) matchState {
+	top := s.stack[len(s.stack)-1]
+	if (top == '{' && b != '}') || (top == '[' && b != ']') {
+		return nil
+	}
+	s.stack = s.stack[:len(s.stack)-1]
+	if len(s.stack) == 0 {
+		s.mode = jsonDone
+	} else {
+		s.mode = jsonAfterValue
+	}
+	return s
+}
+
+func (s *jsonState) nextString(b byte) matchState {
+	switch {
+	case s.hex > 0:
+		if !isHex(b) {
+			return nil
+		}
+		s.hex--
+	case s.escape:
+		s.escape = false
+		switch b {
+		case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+		case 'u':
+			s.hex = 4
+		default:
+			return nil
+		}
+	case s.utf8 > 0:
+		if b&0xC0 != 0x80 {
+			return nil
+		}
+		s.utf8--
+	case b == '"':
+		if s.key {
+			s.mode = jsonColon
+		} else {
+			s.mode = jsonAfterValue
+		}
+	case b == '\\':
+		s.escape = true
+	case b < 0x20:
+		return nil
+	case b >= 0x80:
+		switch {
+		case b&0xE0 == 0xC0:
+			s.utf8 = 1
+		case b&0xF0 == 0xE0:
+			s.utf8 = 2
+		case b&0xF8 == 0xF0:
+			s.utf8 = 3
+		default:
+			return nil
+		}
+	}
+	return s
+}
+
+// nextNumber reports whether the byte continues the number.
+func (s *jsonState) nextNumber(b byte) bool {
+	digit := b >= '0' && b <= '9'
+	switch s.number {
+	case numberMinus:
+		if b == '0' {
+			s.number = numberZero
+			return true
+		}
+		if digit {
+			s.number = numberInt
+			return true
+		}
+	case numberZero, numberInt:
+		if digit && s.number == numberInt {
+			return true
+		}
+		if b == '.' {
+			s.number = numberDot
+			return true
+		}
+		if b == 'e' || b == 'E' {
+			s.number = numberExp
+			return true
+		}
+	case numberDot, numberFrac:
+		if digit {
+			s.number = numberFrac
+			return true
+		}
+		if (b == 'e' || b == 'E') && s.number == numberFrac {
+			s.number = numberExp
+			return true
+		}
+	case numberExp:
+		if b == '+' || b == '-' {
+			s.number = numberExpSign
+			return true
+		}
+		if digit {
+			s.number = numberExpInt
+			return true
+		}
+	case numberExpSign, numberExpInt:
+		if digit {
+			s.number = numberExpInt
+			return true
+		}
+	}
+	return false
+}
+
+func isHex(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
@@ -0,0 +1,39 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"testing"
+)
+
+func TestJSONConstraint(t *testing.T) {
+	c := NewJSONConstraint()
+	valid := []string{
+		`{}`,
+		`{"name": "get_weather", "arguments": {"city": "Paris", "days": 3}}`,
+		`{"a":[1,-2.5e+3,0.1,true,false,null,"x\"yé"],"b":{}}`,
+		`{"中文": "天气"}`,
+		"{\n \"a\": []}",
+	}
+	for _, text := range valid {
+		assert(t, matchString(c, text), text)
+	}
+
+	invalid := []string{
+		`[]`,
+		`{"a"}`,
+		`{"a": 01}`,
+		`{"a": 1.}`,
+		`{"a": tru}`,
+		`{"a": "b"`,
+		`{"a": "b"}}`,
+		`{"a": [1,]}`,
+		`{"a":     1}`,
+		"{\"a\": \"line\nbreak\"}",
+		`{"a": "\x"}`,
+	}
+	for _, text := range invalid {
+		assert(t, !matchString(c, text), text)
+	}
+}
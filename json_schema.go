@@ -0,0 +1,744 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// JSONSchema is the subset of JSON Schema supported by constrained decoding.
+// Objects only contain their declared properties, in declaration order, and the required ones are never left out.
+// Numbers are written without exponent when they have bounds, the bounds of integers are rounded inward
+// and the ones of numbers to 15 digits after the dot.
+type JSONSchema struct {
+	Type        string        `json:"type,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Enum        []any         `json:"enum,omitempty"`
+	AnyOf       []*JSONSchema `json:"anyOf,omitempty"`
+	OneOf       []*JSONSchema `json:"oneOf,omitempty"`
+
+	// object
+	Properties map[string]*JSONSchema `json:"properties,omitempty"`
+	Required   []string               `json:"required,omitempty"`
+	// AdditionalProperties is the schema of the values of an object without properties, like a Go map.
+	AdditionalProperties *JSONSchema `json:"additionalProperties,omitempty"`
+
+	// array
+	Items    *JSONSchema `json:"items,omitempty"`
+	MinItems *int        `json:"minItems,omitempty"`
+	MaxItems *int        `json:"maxItems,omitempty"`
+
+	// string, the supported formats are date, time, date-time and uuid
+	Pattern   string `json:"pattern,omitempty"`
+	Format    string `json:"format,omitempty"`
+	MinLength *int   `json:"minLength,omitempty"`
+	MaxLength *int   `json:"maxLength,omitempty"`
+
+	// number and integer
+	Minimum          *float64 `json:"minimum,omitempty"`
+	Maximum          *float64 `json:"maximum,omitempty"`
+	ExclusiveMinimum *float64 `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum *float64 `json:"exclusiveMaximum,omitempty"`
+
+	// propertyOrder keeps the order of the properties in the source document or struct
+	propertyOrder []string
+}
+
+// UnmarshalJSON decodes a schema and remembers the order of its properties.
+func (s *JSONSchema) UnmarshalJSON(data []byte) error {
+	type plain JSONSchema
+	if err := json.Unmarshal(data, (*plain)(s)); err != nil {
+		return err
+	}
+	var raw struct {
+		Properties json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil || len(raw.Properties) == 0 {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw.Properties))
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		s.propertyOrder = append(s.propertyOrder, fmt.Sprint(key))
+	}
+	return nil
+}
+
+// propertyNames returns the properties in declaration order, or sorted when the order is unknown.
+func (s *JSONSchema) propertyNames() []string {
+	names := make([]string, 0, len(s.Properties))
+	seen := make(map[string]bool, len(s.Properties))
+	for _, name := range s.propertyOrder {
+		if _, ok := s.Properties[name]; ok && !seen[name] {
+			names = append(names, name)
+			seen[name] = true
+		}
+	}
+	var rest []string
+	for name := range s.Properties {
+		if !seen[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	return append(names, rest...)
+}
+
+// formatPatterns are the patterns of the supported string formats, date-time is accepted by time.Time.
+var formatPatterns = map[string]string{
+	"date":      `^\d{4}-(0[1-9]|1[0-2])-(0[1-9]|[12]\d|3[01])$`,
+	"time":      `^([01]\d|2[0-3]):[0-5]\d:[0-5]\d(\.\d{1,9})?(Z|[+-]([01]\d|2[0-3]):[0-5]\d)$`,
+	"date-time": `^\d{4}-(0[1-9]|1[0-2])-(0[1-9]|[12]\d|3[01])T([01]\d|2[0-3]):[0-5]\d:[0-5]\d(\.\d{1,9})?(Z|[+-]([01]\d|2[0-3]):[0-5]\d)$`,
+	"uuid":      `^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`,
+}
+
+// jsonGrammar holds the rules of any JSON value. Numbers have at most 15 digits before the dot, 15 after it
+// and a single digit exponent, so that they stay below 1e25, their precision may exceed a float64.
+// Integers have at most 18 digits, so that they fit an int64.
+const jsonGrammar = `
+ws ::= [ \t\n]{0,2}
+value ::= object | array | string | number | "true" | "false" | "null"
+object ::= "{" ws (string ws ":" ws value ws ("," ws string ws ":" ws value ws)*)? "}"
+array ::= "[" ws (value ws ("," ws value ws)*)? "]"
+string ::= "\"" char* "\""
+char ::= [^"\\\x00-\x1F] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F]{4})
+number ::= "-"? ("0" | [1-9] [0-9]{0,14}) ("." [0-9]{1,15})? ([eE] [-+]? [0-9])?
+integer ::= "-"? ("0" | [1-9] [0-9]{0,17})
+boolean ::= "true" | "false"
+`
+
+const (
+	maxSchemaInteger = 999999999999999999
+	maxSchemaNumber  = 999999999999999
+	// maxFractionDigits is the number of digits after the dot of the numbers
+	maxFractionDigits = 15
+)
+
+// CompileSchema compiles a JSON schema into a grammar accepting the JSON values valid against it.
+func CompileSchema(schema *JSONSchema) (*Grammar, error) {
+	c := &schemaCompiler{patterns: make(map[string]*Regex)}
+	src, err := c.grammar(schema)
+	if err != nil {
+		return nil, err
+	}
+	g, err := ParseGrammar(src)
+	if err != nil {
+		return nil, err
+	}
+	for name, re := range c.patterns {
+		g.rules[g.names[name]].alts = [][]grammarElement{{{pattern: re}}}
+	}
+	return g, nil
+}
+
+// grammar returns the GBNF source of a schema, the rules of the patterns are placeholders.
+func (c *schemaCompiler) grammar(schema *JSONSchema) (string, error) {
+	root, err := c.compile(schema, "root")
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	// the model usually writes a space after the prompt
+	sb.WriteString(`root ::= " "? ` + root + "\n")
+	sb.WriteString(strings.TrimLeft(jsonGrammar, "\n"))
+	for _, rule := range c.rules {
+		sb.WriteString(rule + "\n")
+	}
+	return sb.String(), nil
+}
+
+type schemaCompiler struct {
+	rules []string
+	// patterns maps the rules matching the content of a string with a pattern to their regex,
+	// they are written as empty rules and replaced once the grammar is parsed
+	patterns map[string]*Regex
+}
+
+// rule adds a generated rule and returns its name.
+func (c *schemaCompiler) rule(name, body string) string {
+	name = fmt.Sprintf("%s-%d", name, len(c.rules))
+	c.rules = append(c.rules, name+" ::= "+body)
+	return name
+}
+
+// compile returns a GBNF expression of the schema, name is used for the generated rules.
+func (c *schemaCompiler) compile(s *JSONSchema, name string) (string, error) {
+	if s == nil {
+		return "value", nil
+	}
+	if len(s.Enum) > 0 {
+		alts := make([]string, 0, len(s.Enum))
+		for _, v := range s.Enum {
+			raw, err := json.Marshal(v)
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, gbnfLiteral(string(raw)))
+		}
+		return "(" + strings.Join(alts, " | ") + ")", nil
+	}
+	if anyOf := append(append([]*JSONSchema(nil), s.AnyOf...), s.OneOf...); len(anyOf) > 0 {
+		alts := make([]string, 0, len(anyOf))
+		for _, sub := range anyOf {
+			alt, err := c.compile(sub, name)
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, alt)
+		}
+		return "(" + strings.Join(alts, " | ") + ")", nil
+	}
+
+	typ := s.Type
+	if len(typ) == 0 && (len(s.Properties) > 0 || s.AdditionalProperties != nil) {
+		typ = "object"
+	} else if len(typ) == 0 && s.Items != nil {
+		typ = "array"
+	}
+	switch typ {
+	case "":
+		return "value", nil
+	case "boolean":
+		return "boolean", nil
+	case "null":
+		return `"null"`, nil
+	case "string":
+		return c.compileString(s, name)
+	case "integer", "number":
+		return c.compileNumber(s, typ == "integer")
+	case "array":
+		return c.compileArray(s, name)
+	case "object":
+		return c.compileObject(s, name)
+	}
+	return "", fmt.Errorf("schema type %s is not supported", typ)
+}
+
+func (c *schemaCompiler) compileString(s *JSONSchema, name string) (string, error) {
+	pattern := s.Pattern
+	if len(pattern) == 0 {
+		pattern = formatPatterns[s.Format]
+	}
+	if len(pattern) > 0 {
+		if _, err := syntax.Parse(pattern, syntax.Perl); err != nil {
+			return "", fmt.Errorf("schema pattern %s: %w", pattern, err)
+		}
+		// a pattern matches anywhere in the string unless it is anchored
+		re, err := CompileRegex(`(?s:.*)(?:` + pattern + `)(?s:.*)`)
+		if err != nil {
+			return "", fmt.Errorf("schema pattern %s: %w", pattern, err)
+		}
+		content := c.rule(name+"-pattern", `""`)
+		c.patterns[content] = re
+		return `"\"" ` + content + ` "\""`, nil
+	}
+
+	if s.MinLength == nil && s.MaxLength == nil {
+		return "string", nil
+	}
+	minLength := 0
+	if s.MinLength != nil {
+		minLength = *s.MinLength
+	}
+	if s.MaxLength == nil {
+		return fmt.Sprintf(`("\"" char{%d,} "\"")`, minLength), nil
+	}
+	if *s.MaxLength < minLength {
+		return "", fmt.Errorf("schema maxLength %d is less than minLength %d", *s.MaxLength, minLength)
+	}
+	return fmt.Sprintf(`("\"" char{%d,%d} "\"")`, minLength, *s.MaxLength), nil
+}
+
+func (c *schemaCompiler) compileNumber(s *JSONSchema, integer bool) (string, error) {
+	if s.Minimum == nil && s.Maximum == nil && s.ExclusiveMinimum == nil && s.ExclusiveMaximum == nil {
+		if integer {
+			return "integer", nil
+		}
+		return "number", nil
+	}
+	if !integer {
+		return numberRange(s)
+	}
+	limit := int64(maxSchemaInteger)
+	lo, hi := -limit, limit
+	if s.Minimum != nil {
+		lo = max(lo, clampInt(math.Ceil(*s.Minimum), limit))
+	}
+	if s.ExclusiveMinimum != nil {
+		lo = max(lo, clampInt(math.Floor(*s.ExclusiveMinimum)+1, limit))
+	}
+	if s.Maximum != nil {
+		hi = min(hi, clampInt(math.Floor(*s.Maximum), limit))
+	}
+	if s.ExclusiveMaximum != nil {
+		hi = min(hi, clampInt(math.Ceil(*s.ExclusiveMaximum)-1, limit))
+	}
+	if lo > hi {
+		return "", errors.New("schema has no number between its minimum and maximum")
+	}
+	return intRange(lo, hi), nil
+}
+
+// decimalBound is a bound of a number range, value counts units of the last fraction digit.
+type decimalBound struct {
+	value  *big.Int
+	strict bool
+}
+
+// fractionScale is the value of 1 in a decimalBound.
+var fractionScale = new(big.Int).Exp(big.NewInt(10), big.NewInt(maxFractionDigits), nil)
+
+// newDecimalBound returns the bound v, rounded inward when it has more fraction digits than the numbers,
+// up for a lower bound and down for an upper one.
+func newDecimalBound(v float64, strict, lower bool) decimalBound {
+	// the shortest decimal of v is the bound as written in the schema
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(v, 'g', -1, 64))
+	r.Mul(r, new(big.Rat).SetInt(fractionScale))
+	value, rem := new(big.Int).DivMod(r.Num(), r.Denom(), new(big.Int))
+	if rem.Sign() != 0 {
+		// value is the number below v, the bound is the closest number in the range
+		if lower {
+			value.Add(value, big.NewInt(1))
+		}
+		strict = false
+	}
+	return decimalBound{value: value, strict: strict}
+}
+
+// tighter reports whether b excludes more numbers than o, for lower bounds when lower is set.
+func (b decimalBound) tighter(o decimalBound, lower bool) bool {
+	c := b.value.Cmp(o.value)
+	if c == 0 {
+		return b.strict && !o.strict
+	}
+	return c > 0 == lower
+}
+
+func (b decimalBound) neg() decimalBound {
+	return decimalBound{value: new(big.Int).Neg(b.value), strict: b.strict}
+}
+
+// numberRange returns an expression of the numbers between the bounds of the schema.
+func numberRange(s *JSONSchema) (string, error) {
+	// the largest number of the grammar, 15 nines before and after the dot
+	limit := new(big.Int).Sub(new(big.Int).Mul(big.NewInt(maxSchemaNumber+1), fractionScale), big.NewInt(1))
+	lo := decimalBound{value: new(big.Int).Neg(limit)}
+	hi := decimalBound{value: limit}
+	for _, b := range []struct {
+		v             *float64
+		strict, lower bool
+	}{
+		{s.Minimum, false, true},
+		{s.ExclusiveMinimum, true, true},
+		{s.Maximum, false, false},
+		{s.ExclusiveMaximum, true, false},
+	} {
+		if b.v == nil || math.IsNaN(*b.v) {
+			continue
+		}
+		bound := newDecimalBound(math.Max(math.Min(*b.v, math.MaxFloat64), -math.MaxFloat64), b.strict, b.lower)
+		if b.lower && bound.tighter(lo, true) {
+			lo = bound
+		}
+		if !b.lower && bound.tighter(hi, false) {
+			hi = bound
+		}
+	}
+
+	var alts []string
+	zero := decimalBound{value: new(big.Int)}
+	from := lo
+	if lo.value.Sign() < 0 {
+		from = zero
+	}
+	if r := decimalRange(from, hi); len(r) > 0 {
+		alts = append(alts, r)
+	}
+	// negative numbers are written as "-" and their absolute value, which is never 0
+	if lo.value.Sign() < 0 {
+		from := decimalBound{value: zero.value, strict: true}
+		if hi.value.Sign() < 0 {
+			from = hi.neg()
+		}
+		if r := decimalRange(from, lo.neg()); len(r) > 0 {
+			alts = append(alts, `"-" `+r)
+		}
+	}
+	if len(alts) == 0 {
+		return "", errors.New("schema has no number between its minimum and maximum")
+	}
+	return "(" + strings.Join(alts, " | ") + ")", nil
+}
+
+// decimalRange returns an expression of the numbers in the range of non-negative bounds, "" if it is empty.
+func decimalRange(lo, hi decimalBound) string {
+	if c := lo.value.Cmp(hi.value); c > 0 || c == 0 && (lo.strict || hi.strict) {
+		return ""
+	}
+	loInt, loFrac := splitDecimal(lo.value)
+	hiInt, hiFrac := splitDecimal(hi.value)
+	f := fractionRange{lo: loFrac, hi: hiFrac, loStrict: lo.strict, hiStrict: hi.strict}
+	if loInt == hiInt {
+		return f.number(loInt, true, true)
+	}
+	// only the integer parts of the bounds restrict the fraction
+	alts := []string{f.number(loInt, true, false)}
+	if loInt+1 <= hiInt-1 {
+		alts = append(alts, uintRange(loInt+1, hiInt-1)+fmt.Sprintf(` ("." [0-9]{1,%d})?`, maxFractionDigits))
+	}
+	alts = append(alts, f.number(hiInt, false, true))
+	var nonEmpty []string
+	for _, alt := range alts {
+		if len(alt) > 0 {
+			nonEmpty = append(nonEmpty, alt)
+		}
+	}
+	return "(" + strings.Join(nonEmpty, " | ") + ")"
+}
+
+// splitDecimal returns the integer part of a non-negative bound and all the digits of its fraction.
+func splitDecimal(v *big.Int) (uint64, string) {
+	integer, fraction := new(big.Int).DivMod(v, fractionScale, new(big.Int))
+	digits := fraction.String()
+	return integer.Uint64(), strings.Repeat("0", maxFractionDigits-len(digits)) + digits
+}
+
+// fractionRange holds the fractions of the bounds of a range, with all their digits.
+type fractionRange struct {
+	lo, hi             string
+	loStrict, hiStrict bool
+}
+
+// digits returns the alternatives of the fraction digits from position i, empty reports whether they may
+// stop at i, the missing digits being zeros. loTight and hiTight tell whether the digits before i are the
+// ones of the bounds, only then the bounds restrict the next digits.
+func (f fractionRange) digits(i int, loTight, hiTight bool) (alts []string, empty bool) {
+	rest := maxFractionDigits - i
+	empty = (!loTight || !f.loStrict && strings.Trim(f.lo[i:], "0") == "") &&
+		(!hiTight || !f.hiStrict || strings.Trim(f.hi[i:], "0") != "")
+	if rest == 0 {
+		return nil, empty
+	}
+	from, to := byte('0'), byte('9')
+	if loTight {
+		from = f.lo[i] + 1
+	}
+	if hiTight {
+		to = f.hi[i] - 1
+	}
+	if from <= to {
+		alts = append(alts, digitClass(from, to)+anyDigits(rest-1))
+	}
+	switch {
+	case loTight && hiTight && f.lo[i] == f.hi[i]:
+		alts = f.appendDigit(alts, f.lo[i], i, true, true)
+	default:
+		if loTight {
+			alts = f.appendDigit(alts, f.lo[i], i, true, false)
+		}
+		if hiTight {
+			alts = f.appendDigit(alts, f.hi[i], i, false, true)
+		}
+	}
+	return alts, empty
+}
+
+// appendDigit appends the alternatives starting with the digit d at position i to alts.
+func (f fractionRange) appendDigit(alts []string, d byte, i int, loTight, hiTight bool) []string {
+	next, empty := f.digits(i+1, loTight, hiTight)
+	switch {
+	case len(next) == 0 && empty:
+		return append(alts, gbnfLiteral(string(d)))
+	case len(next) == 0:
+		return alts
+	case empty:
+		return append(alts, gbnfLiteral(string(d))+" ("+strings.Join(next, " | ")+")?")
+	}
+	return append(alts, gbnfLiteral(string(d))+" ("+strings.Join(next, " | ")+")")
+}
+
+// number returns an expression of the integer followed by one of the fractions, "" if there is none.
+func (f fractionRange) number(n uint64, loTight, hiTight bool) string {
+	integer := gbnfLiteral(strconv.FormatUint(n, 10))
+	fractions, empty := f.digits(0, loTight, hiTight)
+	switch {
+	case len(fractions) == 0 && empty:
+		return integer
+	case len(fractions) == 0:
+		return ""
+	case empty:
+		return integer + ` ("." (` + strings.Join(fractions, " | ") + "))?"
+	}
+	return integer + ` "." (` + strings.Join(fractions, " | ") + ")"
+}
+
+func digitClass(from, to byte) string {
+	if from == to {
+		return gbnfLiteral(string(from))
+	}
+	return "[" + string(from) + "-" + string(to) + "]"
+}
+
+// anyDigits returns an expression of up to n digits.
+func anyDigits(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" [0-9]{0,%d}", n)
+}
+
+func clampInt(f float64, limit int64) int64 {
+	return int64(math.Max(math.Min(f, float64(limit)), -float64(limit)))
+}
+
+// intRange returns an expression of the integers in [lo, hi].
+func intRange(lo, hi int64) string {
+	var alts []string
+	if lo < 0 {
+		alts = append(alts, `"-" `+uintRange(uint64(max(-hi, 1)), uint64(-lo)))
+	}
+	if hi >= 0 {
+		alts = append(alts, uintRange(uint64(max(lo, 0)), uint64(hi)))
+	}
+	return "(" + strings.Join(alts, " | ") + ")"
+}
+
+// uintRange returns an expression of the numbers in [lo, hi] written without leading zeros.
+func uintRange(lo, hi uint64) string {
+	var alts []string
+	for digits := len(strconv.FormatUint(lo, 10)); digits <= len(strconv.FormatUint(hi, 10)); digits++ {
+		from, to := lo, hi
+		if smallest := pow10(digits - 1); digits > 1 && from < smallest {
+			from = smallest
+		}
+		if largest := pow10(digits) - 1; to > largest {
+			to = largest
+		}
+		alts = append(alts, digitRange(strconv.FormatUint(from, 10), strconv.FormatUint(to, 10)))
+	}
+	if len(alts) == 1 {
+		return alts[0]
+	}
+	return "(" + strings.Join(alts, " | ") + ")"
+}
+
+func pow10(n int) uint64 {
+	p := uint64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// digitRange returns an expression of the numbers between two digit strings of the same length.
+func digitRange(a, b string) string {
+	n := len(a)
+	if n == 0 {
+		return ""
+	}
+	if a == b {
+		return gbnfLiteral(a)
+	}
+	rest := func(k int) string {
+		switch k {
+		case 0:
+			return ""
+		case 1:
+			return " [0-9]"
+		}
+		return fmt.Sprintf(" [0-9]{%d}", k)
+	}
+	digits := func(lo, hi byte) string {
+		if lo == hi {
+			return gbnfLiteral(string(lo))
+		}
+		return "[" + string(lo) + "-" + string(hi) + "]"
+	}
+	if strings.Trim(a[1:], "0") == "" && strings.Trim(b[1:], "9") == "" {
+		return digits(a[0], b[0]) + rest(n-1)
+	}
+	if a[0] == b[0] {
+		return gbnfLiteral(a[:1]) + " " + digitRange(a[1:], b[1:])
+	}
+	alts := []string{gbnfLiteral(a[:1]) + " " + digitRange(a[1:], strings.Repeat("9", n-1))}
+	if a[0]+1 <= b[0]-1 {
+		alts = append(alts, digits(a[0]+1, b[0]-1)+rest(n-1))
+	}
+	alts = append(alts, gbnfLiteral(b[:1])+" "+digitRange(strings.Repeat("0", n-1), b[1:]))
+	return "(" + strings.Join(alts, " | ") + ")"
+}
+
+func (c *schemaCompiler) compileArray(s *JSONSchema, name string) (string, error) {
+	item, err := c.compile(s.Items, name+"-item")
+	if err != nil {
+		return "", err
+	}
+	item += " ws"
+	minItems, maxItems := 0, -1
+	if s.MinItems != nil {
+		minItems = *s.MinItems
+	}
+	if s.MaxItems != nil {
+		maxItems = *s.MaxItems
+		if maxItems < minItems {
+			return "", fmt.Errorf("schema maxItems %d is less than minItems %d", maxItems, minItems)
+		}
+	}
+	if maxItems == 0 {
+		return `("[" ws "]")`, nil
+	}
+	more := "*"
+	switch {
+	case maxItems < 0 && minItems > 1:
+		more = fmt.Sprintf("{%d,}", minItems-1)
+	case maxItems > 0:
+		more = fmt.Sprintf("{%d,%d}", max(minItems-1, 0), maxItems-1)
+	}
+	items := item + ` ("," ws ` + item + ")" + more
+	if minItems == 0 {
+		items = "(" + items + ")?"
+	}
+	return c.rule(name+"-array", `"[" ws `+items+` "]"`), nil
+}
+
+func (c *schemaCompiler) compileObject(s *JSONSchema, name string) (string, error) {
+	if len(s.Properties) == 0 {
+		if s.AdditionalProperties == nil {
+			return "object", nil
+		}
+		value, err := c.compile(s.AdditionalProperties, name+"-value")
+		if err != nil {
+			return "", err
+		}
+		kv := `string ws ":" ws ` + value + " ws"
+		return c.rule(name+"-object", `"{" ws (`+kv+` ("," ws `+kv+`)*)? "}"`), nil
+	}
+
+	required := make(map[string]bool, len(s.Required))
+	for _, prop := range s.Required {
+		if _, ok := s.Properties[prop]; !ok {
+			return "", fmt.Errorf("schema requires the undefined property %s", prop)
+		}
+		required[prop] = true
+	}
+	// first-i starts with property i or a later one, rest-i writes property i or a later one after a comma,
+	// so optional properties can be left out without producing a dangling comma
+	names := s.propertyNames()
+	first, rest := `""`, `""`
+	for i := len(names) - 1; i >= 0; i-- {
+		key, _ := json.Marshal(names[i])
+		value, err := c.compile(s.Properties[names[i]], name+"-"+ruleName(names[i]))
+		if err != nil {
+			return "", err
+		}
+		kv := c.rule(name+"-"+ruleName(names[i])+"-kv", gbnfLiteral(string(key))+` ws ":" ws `+value+" ws")
+		nextFirst := kv + " " + rest
+		nextRest := `"," ws ` + kv + " " + rest
+		if !required[names[i]] {
+			nextFirst += " | " + first
+			nextRest += " | " + rest
+		}
+		first = c.rule(name+"-first", nextFirst)
+		rest = c.rule(name+"-rest", nextRest)
+	}
+	return c.rule(name+"-object", `"{" ws `+first+` "}"`), nil
+}
+
+// ruleName keeps the characters of a property name which are valid in a rule name.
+func ruleName(s string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < 0x80 && isNameChar(byte(r)) {
+			return r
+		}
+		return -1
+	}, s)
+	if len(name) == 0 {
+		return "prop"
+	}
+	return name
+}
+
+// PredictJSON is like Predict, but the response is a JSON value valid against the schema.
+func (s *RwkvState) PredictJSON(input string, schema *JSONSchema, opts ...PredictOption) (json.RawMessage, error) {
+	g, err := CompileSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(append([]PredictOption(nil), opts...), WithStopStrings(), WithGrammar(g))
+	text, err := s.Predict(input, opts...)
+	if err != nil {
+		return nil, err
+	}
+	raw := json.RawMessage(strings.TrimSpace(text))
+	if !json.Valid(raw) {
+		return nil, errors.New("the JSON response is incomplete, increase max tokens")
+	}
+	return raw, nil
+}
+
+// PredictInto derives the schema from the type of v with SchemaFor, and decodes the response into v.
+func (s *RwkvState) PredictInto(input string, v any, opts ...PredictOption) error {
+	schema, err := SchemaFor(v)
+	if err != nil {
+		return err
+	}
+	raw, err := s.PredictJSON(input, schema, opts...)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// gbnfLiteral quotes a string as a GBNF literal.
+func gbnfLiteral(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		sb.WriteString(gbnfChar(r))
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// gbnfChar escapes a character of a GBNF literal or character class.
+func gbnfChar(r rune) string {
+	switch {
+	case strings.ContainsRune(`"\[]-^`, r):
+		return `\` + string(r)
+	case r == '\n':
+		return `\n`
+	case r == '\r':
+		return `\r`
+	case r == '\t':
+		return `\t`
+	case r < 0x20 || r == 0x7F:
+		return fmt.Sprintf(`\x%02X`, r)
+	case r > unicode.MaxRune || !unicode.IsPrint(r):
+		if r <= 0xFFFF {
+			return fmt.Sprintf(`\u%04X`, r)
+		}
+		return fmt.Sprintf(`\U%08X`, r)
+	}
+	return string(r)
+}
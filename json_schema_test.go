@@ -0,0 +1,167 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCompileSchema(t *testing.T) {
+	var schema JSONSchema
+	err := json.Unmarshal([]byte(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "maxLength": 8},
+			"age": {"type": "integer", "minimum": 0, "maximum": 150},
+			"score": {"type": "number", "minimum": -1, "maximum": 1},
+			"tags": {"type": "array", "items": {"enum": ["a", "b"]}, "maxItems": 2},
+			"zip": {"type": "string", "pattern": "^[0-9]{5}$"},
+			"note": {"type": "string", "pattern": "\"x\""}
+		},
+		"required": ["name", "age"]
+	}`), &schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, fmt.Sprint(schema.propertyNames()) == "[name age score tags zip note]")
+	g, err := CompileSchema(&schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := []string{
+		`{"name": "Bob", "age": 42}`,
+		` {"name":"Bob","age":0,"score":-0.5,"tags":["a","b"],"zip":"12345"}`,
+		`{"name": "Bob", "age": 150, "score": 1, "note": "a \"x\" b"}`,
+		`{"name": "Bob", "age": 7, "tags": []}`,
+		`{"name": "Bob", "age": 7, "zip": "\u0031234\u0035", "note": "\u0022x\""}`,
+	}
+	for _, text := range valid {
+		assert(t, matchString(g, text), text)
+	}
+	invalid := []string{
+		`{"age": 42}`,
+		`{"age": 42, "name": "Bob"}`,
+		`{"name": "", "age": 42}`,
+		`{"name": "Bob", "age": 151}`,
+		`{"name": "Bob", "age": -1}`,
+		`{"name": "Bob", "age": 4.2}`,
+		`{"name": "Bob", "age": 42, "score": 1.5}`,
+		`{"name": "Bob", "age": 42, "tags": ["c"]}`,
+		`{"name": "Bob", "age": 42, "tags": ["a", "a", "a"]}`,
+		`{"name": "Bob", "age": 42, "zip": "1234"}`,
+		`{"name": "Bob", "age": 42, "note": "x"}`,
+		`{"name": "Bob", "age": 42, "zip": "12a45"}`,
+		`{"name": "Bob", "age": 42, "zip": "\ud800"}`,
+		`{"name": "Bob", "age": 42,}`,
+		`{"name": "Bob", "age": 42, "other": 1}`,
+	}
+	for _, text := range invalid {
+		assert(t, !matchString(g, text), text)
+	}
+
+	for _, tc := range []struct {
+		schema         string
+		valid, invalid []string
+	}{
+		{`{"exclusiveMinimum": 0, "exclusiveMaximum": 1}`,
+			[]string{"0.5", "0.000000000000001", "0.999999999999999", "0.50"},
+			[]string{"0", "0.0", "1", "1.0", "-0.5", "-0.0", "0.9999999999999999"}},
+		{`{"minimum": 0.1, "maximum": 0.9}`,
+			[]string{"0.1", "0.10", "0.5", "0.9", "0.900"},
+			[]string{"0", "0.09", "0.099999999999999", "0.91", "0.95", "1"}},
+		{`{"minimum": 0, "maximum": 1}`,
+			[]string{"0", "0.000", "0.95", "1", "1.0", "1.000000000000000"},
+			[]string{"1.01", "1.000000000000001", "-0.5", "2"}},
+		{`{"minimum": -1.5, "maximum": 2.5}`,
+			[]string{"-1.5", "-1.2", "-1", "-0.5", "0", "2", "2.4", "2.5", "2.50"},
+			[]string{"-1.51", "-2", "2.51", "3", "-1.500000000000001"}},
+		{`{"exclusiveMinimum": -10.25, "exclusiveMaximum": 0}`,
+			[]string{"-10.2", "-10.249", "-3", "-0.5", "-0.000000000000001"},
+			[]string{"-10.25", "-10.250", "-11", "0", "-0", "-0.0", "0.5"}},
+		{`{"minimum": 1e-20, "maximum": 123.456}`,
+			[]string{"0.000000000000001", "99.9", "123", "123.4", "123.456"},
+			[]string{"0", "0.0000000000000001", "123.4561", "123.46", "124"}},
+	} {
+		var schema JSONSchema
+		if err := json.Unmarshal([]byte(`{"type": "number", `+tc.schema[1:]), &schema); err != nil {
+			t.Fatal(err)
+		}
+		g, err := CompileSchema(&schema)
+		assert(t, err == nil, tc.schema)
+		if err != nil {
+			continue
+		}
+		for _, text := range tc.valid {
+			assert(t, matchString(g, text), tc.schema, text)
+		}
+		for _, text := range tc.invalid {
+			assert(t, !matchString(g, text), tc.schema, text)
+		}
+	}
+	for _, empty := range []string{`{"type": "number", "minimum": 1, "exclusiveMaximum": 1}`, `{"type": "number", "minimum": 0.5, "maximum": 0.4}`} {
+		var schema JSONSchema
+		assert(t, json.Unmarshal([]byte(empty), &schema) == nil)
+		_, err := CompileSchema(&schema)
+		assert(t, err != nil, empty)
+	}
+}
+
+func TestIntRange(t *testing.T) {
+	for _, r := range [][2]int64{{0, 0}, {-5, 5}, {7, 123}, {-300, -12}, {10, 99}, {-1, 1000}} {
+		g := MustParseGrammar("root ::= " + intRange(r[0], r[1]))
+		for n := r[0] - 20; n <= r[1]+20; n++ {
+			text := fmt.Sprint(n)
+			assert(t, matchString(g, text) == (n >= r[0] && n <= r[1]), fmt.Sprint(r), text)
+		}
+		assert(t, !matchString(g, "-0") && !matchString(g, "01"), fmt.Sprint(r))
+	}
+}
+
+func TestSchemaFor(t *testing.T) {
+	type Base struct {
+		ID int `json:"id"`
+	}
+	type Item struct {
+		Base
+		Name     string            `json:"name" jsonschema:"minLength=1,description=the name\\, not the id"`
+		Level    int8              `json:"level"`
+		Unit     string            `json:"unit,omitempty" jsonschema:"enum=kg|lb"`
+		Created  time.Time         `json:"created"`
+		Labels   map[string]string `json:"labels,omitempty"`
+		Children []*Base           `json:"children,omitempty"`
+		Data     []byte            `json:"data,omitempty"`
+		Ignored  string            `json:"-"`
+		internal string
+	}
+	schema, err := SchemaFor(&Item{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, fmt.Sprint(schema.propertyNames()) == "[id name level unit created labels children data]")
+	assert(t, fmt.Sprint(schema.Required) == "[id name level created]")
+	assert(t, schema.Properties["name"].Description == "the name, not the id")
+	assert(t, *schema.Properties["level"].Maximum == 127)
+
+	g, err := CompileSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := `{"id": 1, "name": "box", "level": -128, "unit": "kg", "created": "2024-01-02T15:04:05.5+08:00",` +
+		` "labels": {"a": "b"}, "children": [{"id": 2}], "data": "aGk="}`
+	assert(t, matchString(g, text))
+	var item Item
+	assert(t, json.Unmarshal([]byte(text), &item) == nil)
+	assert(t, !matchString(g, `{"id": 1, "name": "box", "level": 128, "created": "2024-01-02T15:04:05Z"}`))
+	assert(t, !matchString(g, `{"id": 1, "name": "box", "level": 1, "created": "2024-13-02T15:04:05Z"}`))
+
+	type Node struct {
+		Next *Node `json:"next"`
+	}
+	_, err = SchemaFor(Node{})
+	assert(t, err != nil, "recursive types are rejected")
+}
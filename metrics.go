@@ -0,0 +1,39 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"errors"
+	"time"
+)
+
+// Metrics receives the measurements of a model, see RwkvOptions.Metrics.
+// The methods are called by the goroutines evaluating the states, they must be safe for concurrent use
+// and return quickly.
+type Metrics interface {
+	// PromptTokens is called once tokens of an input have been fed into a state, with the evaluation time.
+	PromptTokens(tokens int, d time.Duration)
+	// Generation is called at the end of every generation with the number of generated tokens,
+	// the time to the first token since the call, prompt included, and the total duration.
+	Generation(tokens int, firstToken, d time.Duration)
+	// QueueWait is called when a job or an Acquire has waited for a context of a ContextPool.
+	QueueWait(d time.Duration)
+	// Error is called with every error reported by rwkv.cpp.
+	Error(err RwkvErrors)
+}
+
+// observePrompt reports fed tokens to the metrics of the model.
+func (m *RwkvModel) observePrompt(tokens int, start time.Time) {
+	if m.options.Metrics != nil && tokens > 0 {
+		m.options.Metrics.PromptTokens(tokens, time.Since(start))
+	}
+}
+
+// observeError reports an error of rwkv.cpp to the metrics of the model, other errors are ignored.
+func (m *RwkvModel) observeError(err error) {
+	var rwkvErr RwkvErrors
+	if m.options.Metrics != nil && errors.As(err, &rwkvErr) {
+		m.options.Metrics.Error(rwkvErr)
+	}
+}
@@ -0,0 +1,54 @@
+# Converts an RWKV state tuning checkpoint in PyTorch format to a raw FP32 state file for rwkv.go.
+# Usage: python convert_state_to_bin.py C:\rwkv-x060-chn_single_round_qa-1B6.pth C:\rwkv-state-1B6.bin
+# The output contains the wkv state of every head of every layer, in rwkv.cpp layout.
+# Load it with RwkvModel.LoadInitStateFile.
+
+import argparse
+import torch
+from typing import Dict
+
+def parse_args():
+    parser = argparse.ArgumentParser(description='Convert an RWKV state tuning checkpoint in PyTorch format to a raw FP32 state file')
+    parser.add_argument('src_path', help='Path to PyTorch state checkpoint file')
+    parser.add_argument('dest_path', help='Path to raw state file, will be overwritten')
+    parser.add_argument('--no-transpose', help='Keep the (head, value, key) layout of the training kernel', action='store_true')
+    return parser.parse_args()
+
+def get_layer_count(state_dict: Dict[str, torch.Tensor]) -> int:
+    n_layer: int = 0
+
+    while f'blocks.{n_layer}.att.time_state' in state_dict:
+        n_layer += 1
+
+    assert n_layer > 0, 'no blocks.N.att.time_state tensor found, is this a state tuning checkpoint?'
+
+    return n_layer
+
+def write_state_dict(state_dict: Dict[str, torch.Tensor], dest_path: str, transpose: bool) -> None:
+    n_layer: int = get_layer_count(state_dict)
+
+    with open(dest_path, 'wb') as out_file:
+        for i in range(n_layer):
+            tensor: torch.Tensor = state_dict[f'blocks.{i}.att.time_state'].float()
+
+            # Training kernels keep the state as (head, value, key), rwkv.cpp uses (head, key, value)
+            if transpose:
+                tensor = tensor.transpose(1, 2)
+
+            print(f'Writing layer {i}, shape {tensor.shape}')
+
+            tensor.contiguous().numpy().tofile(out_file)
+
+def main() -> None:
+    args = parse_args()
+
+    print(f'Reading {args.src_path}')
+
+    state_dict: Dict[str, torch.Tensor] = torch.load(args.src_path, map_location='cpu')
+
+    write_state_dict(state_dict, args.dest_path, not args.no_transpose)
+
+    print('Done')
+
+if __name__ == "__main__":
+    main()
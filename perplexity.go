@@ -0,0 +1,379 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"unicode/utf8"
+)
+
+const (
+	// perplexityReadSize is the number of bytes of the corpus read at once.
+	perplexityReadSize = 64 << 10
+	// perplexityCarry is the number of bytes at the end of a read whose tokens may change with the next bytes,
+	// they are encoded again with them.
+	perplexityCarry = 1 << 10
+)
+
+// PerplexityOptions configures EvalPerplexity.
+type PerplexityOptions struct {
+	// Window is the number of tokens seen by the model at once, the state is reset between windows.
+	// 0 evaluates the whole text with a single state.
+	Window int
+	// Stride is the number of tokens scored per window, the tokens of the window before them are
+	// only context. 0 means Window, windows without overlap.
+	Stride int
+	// ChunkSize is passed to rwkv_eval_sequence_in_chunks for the context of the windows, defaults to 16.
+	ChunkSize uint64
+	// Progress is called after every scored token, total is 0 when the corpus is read from a reader.
+	Progress func(done, total int)
+}
+
+// PerplexityResult is the quality of a model on a text, lower is better.
+type PerplexityResult struct {
+	// Tokens is the number of scored tokens, Bytes their length in bytes.
+	Tokens int
+	Bytes  int
+	// NLL is the total negative log likelihood in nats.
+	NLL        float64
+	Perplexity float64
+	// BitsPerByte doesn't depend on the tokenizer, so models with different vocabularies can be compared.
+	BitsPerByte float64
+}
+
+// PerplexityComparison compares two models on the same tokens, like a F16 model and its quantized version.
+type PerplexityComparison struct {
+	Base  *PerplexityResult
+	Other *PerplexityResult
+}
+
+// Ratio returns how much the perplexity of the other model grows, 1.02 means 2% worse.
+func (c *PerplexityComparison) Ratio() float64 {
+	return c.Other.Perplexity / c.Base.Perplexity
+}
+
+// perplexityWindow scores the tokens [start, end) after the context tokens [context, start).
+type perplexityWindow struct {
+	context, start, end int
+}
+
+func perplexityWindows(n int, opts PerplexityOptions) []perplexityWindow {
+	window, stride := opts.Window, opts.Stride
+	if window <= 0 || window > n {
+		window = n
+	}
+	stride = windowStride(window, stride)
+	var windows []perplexityWindow
+	for start := 0; start < n; start += stride {
+		windows = append(windows, nextWindow(start, n, window, stride))
+	}
+	return windows
+}
+
+// windowStride returns the number of tokens scored per window.
+func windowStride(window, stride int) int {
+	if stride <= 0 || stride > window {
+		return window
+	}
+	return stride
+}
+
+// nextWindow returns the window scoring the tokens from start, n is the number of tokens known so far.
+func nextWindow(start, n, window, stride int) perplexityWindow {
+	end := min(start+stride, n)
+	return perplexityWindow{context: max(end-window, 0), start: start, end: end}
+}
+
+// Perplexity reads a text corpus, tokenizes it and evaluates the perplexity of the model on it.
+// The corpus is streamed, only the tokens of the current window are kept in memory.
+func (m *RwkvModel) Perplexity(ctx context.Context, r io.Reader, opts PerplexityOptions) (*PerplexityResult, error) {
+	e, err := m.newPerplexityEval(ctx, opts, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.encodeReader(r, perplexityReadSize, e.add); err != nil {
+		return nil, err
+	}
+	return e.finish()
+}
+
+// ComparePerplexity evaluates two models on the same tokenized text, both must use the same tokenizer.
+// The corpus is streamed through both models at once.
+func ComparePerplexity(ctx context.Context, r io.Reader, base, other *RwkvModel, opts PerplexityOptions) (*PerplexityComparison, error) {
+	if base.options.TokenizerType != other.options.TokenizerType {
+		return nil, errors.New("models must use the same tokenizer to be compared")
+	}
+	baseEval, err := base.newPerplexityEval(ctx, opts, 0)
+	if err != nil {
+		return nil, err
+	}
+	otherEval, err := other.newPerplexityEval(ctx, opts, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = base.encodeReader(r, perplexityReadSize, func(tokens []int) error {
+		if err := baseEval.add(tokens); err != nil {
+			return err
+		}
+		return otherEval.add(tokens)
+	})
+	if err != nil {
+		return nil, err
+	}
+	baseResult, err := baseEval.finish()
+	if err != nil {
+		return nil, err
+	}
+	otherResult, err := otherEval.finish()
+	if err != nil {
+		return nil, err
+	}
+	return &PerplexityComparison{Base: baseResult, Other: otherResult}, nil
+}
+
+// EvalPerplexity streams the tokens through the model with a sliding window.
+// Every window starts from the initial state and <|endoftext|>, so that the first token is scored too.
+func (m *RwkvModel) EvalPerplexity(ctx context.Context, tokens []int, opts PerplexityOptions) (*PerplexityResult, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("no tokens to evaluate")
+	}
+	e, err := m.newPerplexityEval(ctx, opts, len(tokens))
+	if err != nil {
+		return nil, err
+	}
+	if err := e.add(tokens); err != nil {
+		return nil, err
+	}
+	return e.finish()
+}
+
+// encodeReader tokenizes the text of r by reads of size bytes and passes the tokens to fn.
+func (m *RwkvModel) encodeReader(r io.Reader, size int, fn func(tokens []int) error) error {
+	tokenLen := m.tokenLen()
+	buf := make([]byte, size)
+	var text []byte
+	for {
+		n, err := io.ReadFull(r, buf)
+		eof := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !eof {
+			return err
+		}
+		text = append(text, buf[:n]...)
+		end := len(text)
+		if !eof {
+			// the last character may be incomplete
+			if start := lastRuneStart(text); !utf8.FullRune(text[start:]) {
+				end = start
+			}
+		}
+		tokens, err := m.tokenizer.Encode(string(text[:end]))
+		if err != nil {
+			return err
+		}
+		keep, used := len(tokens), end
+		if !eof {
+			keep, used = stableTokens(tokens, tokenLen, end)
+		}
+		if keep > 0 {
+			if err := fn(tokens[:keep]); err != nil {
+				return err
+			}
+		}
+		if eof {
+			return nil
+		}
+		text = append(text[:0], text[used:]...)
+	}
+}
+
+// stableTokens returns the number of tokens which end before the carry at the end of the n bytes of text,
+// and their length in bytes. All tokens are stable when their bytes are not the ones of the text.
+func stableTokens(tokens []int, tokenLen func(token int) int, n int) (int, int) {
+	total := 0
+	for _, token := range tokens {
+		total += tokenLen(token)
+	}
+	if total != n {
+		return len(tokens), n
+	}
+	keep, used := 0, 0
+	for _, token := range tokens {
+		l := tokenLen(token)
+		if used+l > n-perplexityCarry {
+			break
+		}
+		keep, used = keep+1, used+l
+	}
+	return keep, used
+}
+
+func lastRuneStart(text []byte) int {
+	i := len(text) - 1
+	for i > 0 && len(text)-i < utf8.UTFMax && !utf8.RuneStart(text[i]) {
+		i--
+	}
+	return max(i, 0)
+}
+
+// perplexityEval scores tokens as they are added, window by window.
+// Only the tokens of the last window are kept, as context of the next one.
+type perplexityEval struct {
+	m        *RwkvModel
+	ctx      context.Context
+	opts     PerplexityOptions
+	tokenLen func(token int) int
+	// total is the number of tokens for the progress, 0 when it is not known
+	total         int
+	state, logits []float32
+	// window and stride are 0 when the whole text is scored with a single state
+	window, stride int
+	// tokens holds the added tokens from offset, start is the first token of the next window
+	tokens        []int
+	offset, start int
+	// last is the last scored token of the single state, it is evaluated when the next one comes
+	last   int
+	result PerplexityResult
+}
+
+func (m *RwkvModel) newPerplexityEval(ctx context.Context, opts PerplexityOptions, total int) (*perplexityEval, error) {
+	if err := hasCtx(m.ctx); err != nil {
+		return nil, err
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = 16
+	}
+	e := &perplexityEval{
+		m:        m,
+		ctx:      ctx,
+		opts:     opts,
+		tokenLen: m.tokenLen(),
+		total:    total,
+		state:    make([]float32, m.cRwkv.RwkvGetStateLength(m.ctx)),
+		logits:   make([]float32, m.cRwkv.RwkvGetLogitsLength(m.ctx)),
+	}
+	if opts.Window > 0 {
+		e.window, e.stride = opts.Window, windowStride(opts.Window, opts.Stride)
+	}
+	return e, nil
+}
+
+// add scores the windows completed by the tokens.
+func (e *perplexityEval) add(tokens []int) error {
+	if e.window == 0 {
+		return e.addSingle(tokens)
+	}
+	e.tokens = append(e.tokens, tokens...)
+	for e.start+e.stride <= e.offset+len(e.tokens) {
+		if err := e.scoreWindow(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addSingle scores the tokens with the single state of the whole text.
+func (e *perplexityEval) addSingle(tokens []int) error {
+	for _, token := range tokens {
+		if e.result.Tokens == 0 {
+			if err := e.reset(nil); err != nil {
+				return err
+			}
+		} else if err := e.m.cRwkv.RwkvEval(e.m.ctx, uint32(e.last), e.state, e.state, e.logits); err != nil {
+			return err
+		}
+		if err := e.score(token); err != nil {
+			return err
+		}
+		e.last = token
+	}
+	return nil
+}
+
+// scoreWindow scores the next window, the last one may be shorter than the stride.
+func (e *perplexityEval) scoreWindow() error {
+	w := nextWindow(e.start, e.offset+len(e.tokens), e.window, e.stride)
+	if err := e.reset(e.tokens[w.context-e.offset : w.start-e.offset]); err != nil {
+		return err
+	}
+	for i := w.start; i < w.end; i++ {
+		token := e.tokens[i-e.offset]
+		if err := e.score(token); err != nil {
+			return err
+		}
+		if i+1 < w.end {
+			err := e.m.cRwkv.RwkvEval(e.m.ctx, uint32(token), e.state, e.state, e.logits)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	e.start = w.end
+	// the next windows only look back a window from their end
+	if drop := max(e.start-e.window, 0) - e.offset; drop > 0 {
+		e.tokens = append(e.tokens[:0], e.tokens[drop:]...)
+		e.offset += drop
+	}
+	return nil
+}
+
+// reset starts a window from the initial state, <|endoftext|> and the context tokens.
+func (e *perplexityEval) reset(context []int) error {
+	e.m.resetState(e.m.ctx, e.state)
+	prefix := make([]uint32, 0, len(context)+1)
+	prefix = append(prefix, endOfTextToken)
+	for _, token := range context {
+		prefix = append(prefix, uint32(token))
+	}
+	return e.m.cRwkv.RwkvEvalSequenceInChunks(e.m.ctx, prefix, e.opts.ChunkSize, e.state, e.state, e.logits)
+}
+
+// score adds the negative log likelihood of the token to the result.
+func (e *perplexityEval) score(token int) error {
+	if err := e.ctx.Err(); err != nil {
+		return err
+	}
+	e.result.NLL -= logSoftmax(e.logits, token)
+	e.result.Tokens++
+	e.result.Bytes += e.tokenLen(token)
+	if e.opts.Progress != nil {
+		e.opts.Progress(e.result.Tokens, e.total)
+	}
+	return nil
+}
+
+// finish scores the last window and returns the result.
+func (e *perplexityEval) finish() (*PerplexityResult, error) {
+	if e.window > 0 && e.start < e.offset+len(e.tokens) {
+		if err := e.scoreWindow(); err != nil {
+			return nil, err
+		}
+	}
+	if e.result.Tokens == 0 {
+		return nil, errors.New("no tokens to evaluate")
+	}
+	result := e.result
+	result.Perplexity = math.Exp(result.NLL / float64(result.Tokens))
+	if result.Bytes > 0 {
+		result.BitsPerByte = result.NLL / math.Ln2 / float64(result.Bytes)
+	}
+	return &result, nil
+}
+
+// tokenLen returns a function giving the length in bytes of a token.
+func (m *RwkvModel) tokenLen() func(token int) int {
+	if tokenBytes, _, err := m.vocabulary(); err == nil {
+		return func(token int) int {
+			if token < len(tokenBytes) {
+				return len(tokenBytes[token])
+			}
+			return 0
+		}
+	}
+	return func(token int) int {
+		return len(m.tokenizer.Decode([]int{token}))
+	}
+}
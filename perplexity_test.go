@@ -0,0 +1,139 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestPerplexityWindows(t *testing.T) {
+	tests := []struct {
+		n    int
+		opts PerplexityOptions
+		want string
+	}{
+		{10, PerplexityOptions{}, "[{0 0 10}]"},
+		{10, PerplexityOptions{Window: 4}, "[{0 0 4} {4 4 8} {6 8 10}]"},
+		{10, PerplexityOptions{Window: 4, Stride: 2}, "[{0 0 2} {0 2 4} {2 4 6} {4 6 8} {6 8 10}]"},
+		{3, PerplexityOptions{Window: 8, Stride: 16}, "[{0 0 3}]"},
+	}
+	for _, tt := range tests {
+		windows := perplexityWindows(tt.n, tt.opts)
+		assert(t, fmt.Sprint(windows) == tt.want, fmt.Sprint(windows))
+
+		// every token is scored exactly once
+		scored := 0
+		for _, w := range windows {
+			scored += w.end - w.start
+		}
+		assert(t, scored == tt.n)
+	}
+}
+
+// perplexityRwkv evaluates a model whose logits are uniform over a vocabulary of 4 tokens.
+type perplexityRwkv struct {
+	CRwkv
+	chunkSizes []uint64
+	evals      int
+}
+
+func (r *perplexityRwkv) RwkvGetStateLength(*RwkvCtx) uint64  { return 2 }
+func (r *perplexityRwkv) RwkvGetLogitsLength(*RwkvCtx) uint64 { return 4 }
+func (r *perplexityRwkv) RwkvInitState(_ *RwkvCtx, state []float32) {
+	clear(state)
+}
+
+func (r *perplexityRwkv) RwkvEvalSequenceInChunks(_ *RwkvCtx, tokens []uint32, chunkSize uint64, _, _, logits []float32) error {
+	if chunkSize == 0 {
+		return errors.New("chunk size must be positive")
+	}
+	r.chunkSizes = append(r.chunkSizes, chunkSize)
+	clear(logits)
+	return nil
+}
+
+func (r *perplexityRwkv) RwkvEval(_ *RwkvCtx, _ uint32, _, _, logits []float32) error {
+	r.evals++
+	clear(logits)
+	return nil
+}
+
+func TestEvalPerplexity(t *testing.T) {
+	tk, err := NewWorldTokenizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &perplexityRwkv{}
+	m := &RwkvModel{cRwkv: c, tokenizer: tk, ctx: &RwkvCtx{ctx: 1}, options: &RwkvOptions{}}
+
+	result, err := m.EvalPerplexity(context.Background(), []int{1, 2, 3, 1, 2, 3}, PerplexityOptions{Window: 4})
+	assert(t, err == nil)
+	assert(t, fmt.Sprint(c.chunkSizes) == "[16 16]", "the chunk size defaults to 16", fmt.Sprint(c.chunkSizes))
+	assert(t, result.Tokens == 6 && c.evals == 4)
+	assert(t, math.Abs(result.Perplexity-4) < 1e-6, "uniform logits over 4 tokens")
+
+	c.chunkSizes = nil
+	_, err = m.EvalPerplexity(context.Background(), []int{1, 2}, PerplexityOptions{ChunkSize: 8})
+	assert(t, err == nil && fmt.Sprint(c.chunkSizes) == "[8]")
+
+	_, err = m.EvalPerplexity(context.Background(), nil, PerplexityOptions{})
+	assert(t, err != nil)
+}
+
+func TestPerplexity(t *testing.T) {
+	m, c := newFakeModel(t, RwkvOptions{})
+	c.reply = []int{33, 44, 55}
+	text := strings.Repeat("The quick brown fox jumps over the lazy dog. Ünïcödé 你好世界\n", 25)
+	tokens, err := m.tokenizer.Encode(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	t.Run("encode reader", func(t *testing.T) {
+		var got []int
+		reads := 0
+		err := m.encodeReader(strings.NewReader(text), 300, func(part []int) error {
+			reads++
+			got = append(got, part...)
+			return nil
+		})
+		assert(t, err == nil && reads > 1)
+		assert(t, fmt.Sprint(got) == fmt.Sprint(tokens), "the text is encoded like at once")
+	})
+
+	for _, opts := range []PerplexityOptions{{}, {Window: 64, Stride: 16}} {
+		want, err := m.EvalPerplexity(ctx, tokens, opts)
+		assert(t, err == nil)
+		got, err := m.Perplexity(ctx, strings.NewReader(text), opts)
+		assert(t, err == nil)
+		assert(t, got.Tokens == len(tokens) && got.Bytes == len(text))
+		assert(t, math.Abs(got.NLL-want.NLL) < 1e-6*want.NLL)
+	}
+
+	t.Run("windows are scored while reading", func(t *testing.T) {
+		e, err := m.newPerplexityEval(ctx, PerplexityOptions{Window: 8, Stride: 4}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, token := range tokens[:100] {
+			assert(t, e.add([]int{token}) == nil)
+			assert(t, len(e.tokens) <= 8+4, "only the last window is kept")
+		}
+		assert(t, e.result.Tokens == 100)
+	})
+
+	other, _ := newFakeModel(t, RwkvOptions{})
+	result, err := ComparePerplexity(ctx, strings.NewReader(text), m, other, PerplexityOptions{Window: 64})
+	assert(t, err == nil && result.Base.Tokens == len(tokens) && result.Other.Tokens == len(tokens))
+	assert(t, math.Abs(result.Other.Perplexity-65536) < 1, "the other model is uniform")
+
+	_, err = m.Perplexity(ctx, strings.NewReader(""), PerplexityOptions{})
+	assert(t, err != nil)
+}
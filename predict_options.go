@@ -0,0 +1,88 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"context"
+	"time"
+)
+
+// PredictOption overrides the RwkvOptions of a single Predict or PredictStream call.
+type PredictOption func(o *predictOptions)
+
+type predictOptions struct {
+	maxTokens   int
+	stopStrings []string
+	temperature float32
+	topP        float32
+	logitBias   map[int]float32
+	constraint  Constraint
+	logprobs    bool
+	topLogprobs int
+	// start of the call, the time to the first token is measured from it
+	start time.Time
+	// ctx is the parent of the spans of the call, nil for the context of the job of the state
+	ctx context.Context
+}
+
+// WithMaxTokens limits the number of generated tokens.
+func WithMaxTokens(maxTokens int) PredictOption {
+	return func(o *predictOptions) {
+		o.maxTokens = maxTokens
+	}
+}
+
+// WithStopStrings stops the generation once the response contains one of the strings.
+// It replaces RwkvOptions.StopString.
+func WithStopStrings(stop ...string) PredictOption {
+	return func(o *predictOptions) {
+		o.stopStrings = stop
+	}
+}
+
+// WithTemperature sets the sampling temperature, 0 means greedy sampling.
+func WithTemperature(temperature float32) PredictOption {
+	return func(o *predictOptions) {
+		o.temperature = temperature
+	}
+}
+
+// WithTopP sets the nucleus sampling probability.
+func WithTopP(topP float32) PredictOption {
+	return func(o *predictOptions) {
+		o.topP = topP
+	}
+}
+
+// WithLogitBias adds a bias to the log probability of the given tokens before sampling.
+// The generation fails when a token is out of the vocabulary, see RwkvModel.VocabSize.
+func WithLogitBias(logitBias map[int]float32) PredictOption {
+	return func(o *predictOptions) {
+		o.logitBias = logitBias
+	}
+}
+
+// WithContext makes the span of ctx the parent of the spans of the call, see RwkvOptions.Tracer.
+// It defaults to the context the state is attached to a ContextPool with. ctx doesn't cancel the call.
+func WithContext(ctx context.Context) PredictOption {
+	return func(o *predictOptions) {
+		o.ctx = ctx
+	}
+}
+
+// newPredictOptions applies the options on top of the model defaults.
+func newPredictOptions(options *RwkvOptions, opts []PredictOption) *predictOptions {
+	o := &predictOptions{
+		maxTokens:   options.MaxTokens,
+		stopStrings: []string{options.StopString},
+		temperature: options.Temperature,
+		topP:        options.TopP,
+		logitBias:   map[int]float32{},
+		start:       time.Now(),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
@@ -0,0 +1,107 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the jobs sharing it, for example the requests of one client of a server:
+// the number of jobs attached at the same time and the tokens they evaluate per minute.
+// A job over the limits waits in Attach, or before its next token without holding a context.
+type RateLimit struct {
+	tokensPerMinute int
+	// slots holds a value per attached job, nil when the jobs are not limited
+	slots chan struct{}
+
+	mu sync.Mutex
+	// tokens which can be evaluated now, negative once tokens have been reserved ahead
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimit returns a limit of tokensPerMinute tokens and maxJobs jobs, 0 means no limit.
+// The tokens come back continuously, up to a minute of tokens can be used at once.
+func NewRateLimit(tokensPerMinute, maxJobs int) *RateLimit {
+	l := &RateLimit{tokensPerMinute: tokensPerMinute, tokens: float64(tokensPerMinute), last: time.Now()}
+	if maxJobs > 0 {
+		l.slots = make(chan struct{}, maxJobs)
+	}
+	return l
+}
+
+// Wait takes tokens from the limit, waiting until they are available or ctx is done.
+// Use it for the work which is not evaluated by a job, like ContextPool.Embed.
+func (l *RateLimit) Wait(ctx context.Context, tokens int) error {
+	if err := sleep(ctx, l.reserve(time.Now(), tokens)); err != nil {
+		l.cancel(tokens)
+		return err
+	}
+	return nil
+}
+
+// reserve takes tokens and returns how long to wait before evaluating them.
+func (l *RateLimit) reserve(now time.Time, tokens int) time.Duration {
+	if l.tokensPerMinute <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	perSecond := float64(l.tokensPerMinute) / 60
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = min(float64(l.tokensPerMinute), l.tokens+elapsed.Seconds()*perSecond)
+		l.last = now
+	}
+	l.tokens -= float64(tokens)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / perSecond * float64(time.Second))
+}
+
+// cancel gives back reserved tokens which have not been evaluated.
+func (l *RateLimit) cancel(tokens int) {
+	if l.tokensPerMinute <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens += float64(tokens)
+}
+
+// acquire takes a job slot, waiting until one is free or ctx is done.
+func (l *RateLimit) acquire(ctx context.Context) error {
+	if l.slots == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *RateLimit) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
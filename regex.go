@@ -0,0 +1,315 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"errors"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Regex is a regular expression in Go syntax compiled into a DFA over bytes.
+// The whole generated text must match, as if the expression was written between ^ and $.
+// The DFA is built lazily, a state is only created when a byte leads to it, and it is
+// cached for the next steps and the next generations.
+// A Regex is a Constraint and can be used with WithRegex or WithConstraint.
+type Regex struct {
+	expr  string
+	nodes []nfaNode
+
+	mu      sync.Mutex
+	states  map[string]*dfaState
+	initial *dfaState
+}
+
+// nfaNode is a node of a byte level NFA, it either follows epsilon edges, consumes a byte range,
+// needs an empty width assertion or matches.
+type nfaNode struct {
+	outs   []int
+	lo, hi byte
+	byteTo int
+	empty  syntax.EmptyOp
+	kind   nfaKind
+}
+
+type nfaKind uint8
+
+const (
+	nfaSplit nfaKind = iota
+	nfaByte
+	nfaEmpty
+	nfaMatch
+)
+
+// dfaState is a set of NFA nodes, its transitions are computed on first use.
+type dfaState struct {
+	re    *Regex
+	nodes []int
+	match bool
+	trans [256]*dfaState
+}
+
+// deadState marks a cached transition to no state.
+var deadState = &dfaState{}
+
+// WithRegex restricts the generated text to the regular expression.
+func WithRegex(re *Regex) PredictOption {
+	return WithConstraint(re)
+}
+
+// CompileRegex compiles a regular expression in Go syntax.
+func CompileRegex(expr string) (*Regex, error) {
+	parsed, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, err
+	}
+	re := &Regex{expr: expr, states: make(map[string]*dfaState)}
+	if err := re.build(prog); err != nil {
+		return nil, err
+	}
+	re.initial = re.state(re.closure([]int{prog.Start}, syntax.EmptyBeginText|syntax.EmptyBeginLine))
+	return re, nil
+}
+
+// MustCompileRegex is like CompileRegex but panics on error.
+func MustCompileRegex(expr string) *Regex {
+	re, err := CompileRegex(expr)
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
+
+// String returns the source of the regular expression.
+func (re *Regex) String() string {
+	return re.expr
+}
+
+// build turns the rune instructions of the program into chains of byte nodes.
+// The first len(prog.Inst) nodes correspond to the instructions.
+func (re *Regex) build(prog *syntax.Prog) error {
+	re.nodes = make([]nfaNode, len(prog.Inst))
+	for i, inst := range prog.Inst {
+		node := &re.nodes[i]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			node.outs = []int{int(inst.Out), int(inst.Arg)}
+		case syntax.InstCapture, syntax.InstNop:
+			node.outs = []int{int(inst.Out)}
+		case syntax.InstEmptyWidth:
+			empty := syntax.EmptyOp(inst.Arg)
+			if empty&(syntax.EmptyWordBoundary|syntax.EmptyNoWordBoundary) != 0 {
+				return errors.New("word boundaries are not supported in a regex constraint")
+			}
+			node.kind, node.empty, node.outs = nfaEmpty, empty, []int{int(inst.Out)}
+		case syntax.InstMatch:
+			node.kind = nfaMatch
+		case syntax.InstFail:
+		case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			var outs []int
+			for _, seq := range utf8Sequences(instRanges(inst)) {
+				outs = append(outs, re.chain(seq, int(inst.Out)))
+			}
+			// node may have moved when the chain grew the slice
+			re.nodes[i].outs = outs
+		}
+	}
+	return nil
+}
+
+// chain appends the nodes consuming a sequence of byte ranges and returns the first one.
+func (re *Regex) chain(seq [][2]byte, out int) int {
+	for i := len(seq) - 1; i >= 0; i-- {
+		re.nodes = append(re.nodes, nfaNode{kind: nfaByte, lo: seq[i][0], hi: seq[i][1], byteTo: out})
+		out = len(re.nodes) - 1
+	}
+	return out
+}
+
+// instRanges returns the rune ranges matched by a rune instruction, as pairs of bounds.
+func instRanges(inst syntax.Inst) []rune {
+	switch inst.Op {
+	case syntax.InstRuneAny:
+		return []rune{0, unicode.MaxRune}
+	case syntax.InstRuneAnyNotNL:
+		return []rune{0, '\n' - 1, '\n' + 1, unicode.MaxRune}
+	}
+	ranges := inst.Rune
+	if len(ranges) == 1 {
+		ranges = []rune{ranges[0], ranges[0]}
+	}
+	if syntax.Flags(inst.Arg)&syntax.FoldCase == 0 {
+		return ranges
+	}
+	folded := append([]rune(nil), ranges...)
+	for i := 0; i+1 < len(ranges); i += 2 {
+		for r := ranges[i]; r <= ranges[i+1]; r++ {
+			for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+				folded = append(folded, f, f)
+			}
+		}
+	}
+	return folded
+}
+
+// utf8Sequences splits rune ranges into sequences of byte ranges which encode exactly those runes.
+func utf8Sequences(ranges []rune) [][][2]byte {
+	var seqs [][][2]byte
+	var stack [][2]rune
+	for i := len(ranges) - 2; i >= 0; i -= 2 {
+		stack = append(stack, [2]rune{ranges[i], ranges[i+1]})
+	}
+next:
+	for len(stack) > 0 {
+		lo, hi := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+		// surrogates can't be encoded
+		if lo < 0xD800 && hi > 0xDFFF {
+			stack = append(stack, [2]rune{0xE000, hi}, [2]rune{lo, 0xD7FF})
+			continue
+		}
+		if lo >= 0xD800 && hi <= 0xDFFF {
+			continue
+		}
+		if lo >= 0xD800 && lo <= 0xDFFF {
+			lo = 0xE000
+		}
+		if hi >= 0xD800 && hi <= 0xDFFF {
+			hi = 0xD7FF
+		}
+		if lo > hi {
+			continue
+		}
+		// split at the boundaries of the encoding lengths
+		for _, limit := range []rune{0x7F, 0x7FF, 0xFFFF} {
+			if lo <= limit && hi > limit {
+				stack = append(stack, [2]rune{limit + 1, hi}, [2]rune{lo, limit})
+				continue next
+			}
+		}
+		if hi <= 0x7F {
+			seqs = append(seqs, [][2]byte{{byte(lo), byte(hi)}})
+			continue
+		}
+		// split until every continuation byte covers a full range
+		for i := 1; i < utf8.UTFMax; i++ {
+			mask := rune(1)<<(6*i) - 1
+			if lo&^mask != hi&^mask {
+				if lo&mask != 0 {
+					stack = append(stack, [2]rune{(lo | mask) + 1, hi}, [2]rune{lo, lo | mask})
+					continue next
+				}
+				if hi&mask != mask {
+					stack = append(stack, [2]rune{hi &^ mask, hi}, [2]rune{lo, hi&^mask - 1})
+					continue next
+				}
+			}
+		}
+		loBytes, hiBytes := utf8.AppendRune(nil, lo), utf8.AppendRune(nil, hi)
+		seq := make([][2]byte, len(loBytes))
+		for i := range seq {
+			seq[i] = [2]byte{loBytes[i], hiBytes[i]}
+		}
+		seqs = append(seqs, seq)
+	}
+	return seqs
+}
+
+// closure follows epsilon edges and the empty width assertions satisfied by flags.
+// It returns the sorted nodes which consume a byte, match, or wait for an assertion.
+func (re *Regex) closure(nodes []int, flags syntax.EmptyOp) []int {
+	seen := make(map[int]bool)
+	var set []int
+	var visit func(n int)
+	visit = func(n int) {
+		if seen[n] {
+			return
+		}
+		seen[n] = true
+		node := &re.nodes[n]
+		switch node.kind {
+		case nfaSplit:
+			for _, out := range node.outs {
+				visit(out)
+			}
+		case nfaEmpty:
+			if node.empty&^flags == 0 {
+				visit(node.outs[0])
+			} else {
+				set = append(set, n)
+			}
+		default:
+			set = append(set, n)
+		}
+	}
+	for _, n := range nodes {
+		visit(n)
+	}
+	sort.Ints(set)
+	return set
+}
+
+// state returns the cached DFA state of a node set, the caller holds the lock or owns the regex.
+func (re *Regex) state(nodes []int) *dfaState {
+	if len(nodes) == 0 {
+		return deadState
+	}
+	var sb strings.Builder
+	for _, n := range nodes {
+		sb.WriteString(strconv.Itoa(n))
+		sb.WriteByte(',')
+	}
+	key := sb.String()
+	if s, ok := re.states[key]; ok {
+		return s
+	}
+	s := &dfaState{re: re, nodes: nodes}
+	for _, n := range re.closure(nodes, syntax.EmptyEndText|syntax.EmptyEndLine) {
+		if re.nodes[n].kind == nfaMatch {
+			s.match = true
+			break
+		}
+	}
+	re.states[key] = s
+	return s
+}
+
+func (re *Regex) start() matchState {
+	return re.initial
+}
+
+func (s *dfaState) done() bool {
+	return s.match
+}
+
+func (s *dfaState) next(b byte) matchState {
+	re := s.re
+	re.mu.Lock()
+	next := s.trans[b]
+	if next == nil {
+		var outs []int
+		for _, n := range s.nodes {
+			node := &re.nodes[n]
+			if node.kind == nfaByte && b >= node.lo && b <= node.hi {
+				outs = append(outs, node.byteTo)
+			}
+		}
+		next = re.state(re.closure(outs, 0))
+		s.trans[b] = next
+	}
+	re.mu.Unlock()
+	if next == deadState {
+		return nil
+	}
+	return next
+}
@@ -0,0 +1,81 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"math"
+	"regexp"
+	"testing"
+)
+
+func TestRegexConstraint(t *testing.T) {
+	tests := []struct {
+		expr string
+		text []string
+	}{
+		{`yes|no`, []string{"yes", "no", "", "ye", "yesno", "Yes"}},
+		{`\d{4}-\d{2}-\d{2}`, []string{"2024-01-31", "2024-1-31", "2024-01-311", "abcd-01-31"}},
+		{`\+?[0-9 ]{7,12}`, []string{"+86 1234 5678", "12345", "1234567", "+1234567890123"}},
+		{`(?i)ok+`, []string{"OK", "okkk", "oK", "o"}},
+		{`^[^a-z]+$`, []string{"中文 123", "é", "ABC", "aB", "\n"}},
+		{`.*!`, []string{"天气很好!", "!", "a\n!", "a"}},
+		{`[α-ω]{2}`, []string{"αβ", "αA", "ωω", "α"}},
+	}
+	for _, tt := range tests {
+		re := MustCompileRegex(tt.expr)
+		std := regexp.MustCompile(`^(?:` + tt.expr + `)$`)
+		for _, text := range tt.text {
+			assert(t, matchString(re, text) == std.MatchString(text), tt.expr, text)
+		}
+	}
+
+	_, err := CompileRegex(`\bword\b`)
+	assert(t, err != nil, "word boundaries are not supported")
+	_, err = CompileRegex(`(`)
+	assert(t, err != nil)
+}
+
+func TestUtf8Sequences(t *testing.T) {
+	ranges := []rune{0, 0x10FFFF}
+	seqs := utf8Sequences(ranges)
+	matches := func(s string) bool {
+		for _, seq := range seqs {
+			if len(seq) != len(s) {
+				continue
+			}
+			ok := true
+			for i := range seq {
+				ok = ok && s[i] >= seq[i][0] && s[i] <= seq[i][1]
+			}
+			if ok {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range []string{"a", "\x7f", "é", "߿", "ࠀ", "中", "￿", "\U00010000", "\U0010ffff"} {
+		assert(t, matches(s), s)
+	}
+	// surrogates and overlong encodings are not valid utf-8
+	for _, s := range []string{"\xed\xa0\x80", "\xc0\x80", "\xe0\x80\x80", "\xf4\x90\x80\x80"} {
+		assert(t, !matches(s), s)
+	}
+}
+
+func TestRegexDecoder(t *testing.T) {
+	vocab := []string{"", "2024", "-", "01", "1", "a", "2024-01"}
+	d := newTestDecoder(MustCompileRegex(`\d{4}-\d{2}`), vocab)
+	negInf := float32(math.Inf(-1))
+
+	logits := make([]float32, len(vocab))
+	assert(t, d.mask(logits))
+	for i, token := range vocab {
+		allowed := token == "2024" || token == "01" || token == "1" || token == "2024-01"
+		assert(t, (logits[i] != negInf) == allowed, token)
+	}
+	assert(t, d.accept(6))
+	logits = make([]float32, len(vocab))
+	assert(t, !d.mask(logits), "the pattern is complete")
+	assert(t, logits[endOfTextToken] != negInf)
+}
@@ -0,0 +1,460 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rwkvFileMagic is the magic number of the rwkv.cpp model files, "ggmf".
+const rwkvFileMagic = 0x67676d66
+
+// contextFloats is the working memory of a context in floats per layer and embedding value,
+// a rough upper bound of the graph of one token.
+const contextFloats = 64
+
+// maxStateFloats is the largest state in floats per layer and embedding value, RWKV v5 with heads of 64.
+const maxStateFloats = 66
+
+// ModelSpec describes how a model of a Registry is loaded.
+type ModelSpec struct {
+	Path string
+	// Library is the path of the rwkv.cpp library, the embedded one is used when empty.
+	Library string
+	Options RwkvOptions
+	// Contexts is the size of the ContextPool created with the model, 0 means no pool.
+	Contexts int
+	// Threads of every pooled context, 0 means Options.CpuThreads.
+	Threads uint32
+}
+
+// RegistryOptions configures a Registry.
+type RegistryOptions struct {
+	// MemoryBudget is the number of bytes the loaded models may use, 0 means no limit.
+	// The least recently used models are unloaded to make room for a new one.
+	MemoryBudget int64
+	// IdleTimeout unloads the models which have not been used for that long, 0 keeps them.
+	IdleTimeout time.Duration
+}
+
+// LoadedModelInfo describes a loaded model of a Registry.
+type LoadedModelInfo struct {
+	Name string
+	// Memory is the estimated memory of the model and its contexts in bytes.
+	Memory   int64
+	LastUsed time.Time
+	// InUse is the number of leases which have not been released.
+	InUse int
+	// Scheduler describes the contexts of the model, it is empty when the spec has no contexts.
+	Scheduler SchedulerStats
+}
+
+// Registry maps model names to model files and loads them on first use.
+// It tracks the memory of every loaded model and unloads the least recently used ones
+// when the memory budget is exceeded, or when they are idle.
+type Registry struct {
+	options RegistryOptions
+	// load loads a model and returns its memory, replaced in tests
+	load func(spec ModelSpec) (*RwkvModel, *ContextPool, int64, error)
+
+	mu      sync.Mutex
+	specs   map[string]ModelSpec
+	entries map[string]*registryEntry
+	used    int64
+	stop    chan struct{}
+	closed  bool
+}
+
+type registryEntry struct {
+	name     string
+	model    *RwkvModel
+	pool     *ContextPool
+	memory   int64
+	refs     int
+	lastUsed time.Time
+	// ready is closed once the model is loaded or failed with err
+	ready chan struct{}
+	err   error
+}
+
+// ModelLease is a loaded model of a Registry, it is not unloaded until it is released.
+type ModelLease struct {
+	Name  string
+	Model *RwkvModel
+	// Pool is nil when the spec has no contexts.
+	Pool *ContextPool
+
+	registry *Registry
+	entry    *registryEntry
+	once     sync.Once
+}
+
+// Release lets the registry unload the model again.
+func (l *ModelLease) Release() {
+	l.once.Do(func() {
+		l.registry.mu.Lock()
+		defer l.registry.mu.Unlock()
+		l.entry.refs--
+		l.entry.lastUsed = time.Now()
+	})
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry(options RegistryOptions) *Registry {
+	r := &Registry{
+		options: options,
+		load:    loadModelSpec,
+		specs:   make(map[string]ModelSpec),
+		entries: make(map[string]*registryEntry),
+		stop:    make(chan struct{}),
+	}
+	if options.IdleTimeout > 0 {
+		go r.evictIdleLoop()
+	}
+	return r
+}
+
+// Register adds a model, it is loaded on first use.
+func (r *Registry) Register(name string, spec ModelSpec) error {
+	if len(name) == 0 {
+		return errors.New("model name can not be empty")
+	}
+	if len(spec.Path) == 0 {
+		return errors.New("model path can not be empty")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.specs[name]; ok {
+		return fmt.Errorf("model %q is already registered", name)
+	}
+	r.specs[name] = spec
+	return nil
+}
+
+// RegisterDir registers every .bin file of the directory under its file name without extension.
+// Files with "world" in their name use the World tokenizer, the others the Normal tokenizer.
+func (r *Registry) RegisterDir(dir string, spec ModelSpec) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.bin"))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		s := spec
+		s.Path = path
+		s.Options.TokenizerType = Normal
+		if strings.Contains(strings.ToLower(name), "world") {
+			s.Options.TokenizerType = World
+		}
+		if err := r.Register(name, s); err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Unregister unloads and removes a model, it fails while the model is in use.
+func (r *Registry) Unregister(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.specs[name]; !ok {
+		return fmt.Errorf("model %q is not registered", name)
+	}
+	if e, ok := r.entries[name]; ok {
+		if e.refs > 0 {
+			return fmt.Errorf("model %q is in use", name)
+		}
+		if err := r.unload(e); err != nil {
+			return err
+		}
+	}
+	delete(r.specs, name)
+	return nil
+}
+
+// Names returns the sorted names of the registered models.
+func (r *Registry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.specs))
+	for name := range r.specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Spec returns the spec of a registered model.
+func (r *Registry) Spec(name string) (ModelSpec, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	spec, ok := r.specs[name]
+	return spec, ok
+}
+
+// Loaded returns the loaded models, the most recently used first.
+func (r *Registry) Loaded() []LoadedModelInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var loaded []LoadedModelInfo
+	for _, e := range r.entries {
+		if e.model == nil {
+			continue
+		}
+		info := LoadedModelInfo{Name: e.name, Memory: e.memory, LastUsed: e.lastUsed, InUse: e.refs}
+		if e.pool != nil {
+			info.Scheduler = e.pool.Stats()
+		}
+		loaded = append(loaded, info)
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].LastUsed.After(loaded[j].LastUsed) })
+	return loaded
+}
+
+// Memory returns the estimated memory of the loaded models in bytes.
+func (r *Registry) Memory() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.used
+}
+
+// Acquire returns the model, loading it first if needed. Release the lease once the model is not used anymore.
+func (r *Registry) Acquire(name string) (*ModelLease, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, errors.New("registry is closed")
+	}
+	spec, ok := r.specs[name]
+	if !ok {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("model %q is not registered", name)
+	}
+	e, ok := r.entries[name]
+	if !ok {
+		memory, err := EstimateMemory(spec.Path, spec.Contexts)
+		if err == nil {
+			err = r.makeRoom(memory)
+		}
+		if err != nil {
+			r.mu.Unlock()
+			return nil, err
+		}
+		e = &registryEntry{name: name, memory: memory, ready: make(chan struct{})}
+		r.entries[name] = e
+		r.used += memory
+		go r.loadEntry(e, spec)
+	}
+	e.refs++
+	e.lastUsed = time.Now()
+	r.mu.Unlock()
+
+	<-e.ready
+	if e.err != nil {
+		r.mu.Lock()
+		e.refs--
+		r.mu.Unlock()
+		return nil, e.err
+	}
+	return &ModelLease{Name: name, Model: e.model, Pool: e.pool, registry: r, entry: e}, nil
+}
+
+func (r *Registry) loadEntry(e *registryEntry, spec ModelSpec) {
+	model, pool, memory, err := r.load(spec)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil && r.closed {
+		// Close has skipped the entry while it was loading
+		if pool != nil {
+			_ = pool.Close()
+		}
+		_ = model.Close()
+		err = errors.New("registry is closed")
+	}
+	if err != nil {
+		e.err = err
+		delete(r.entries, e.name)
+		r.used -= e.memory
+	} else {
+		e.model, e.pool = model, pool
+		r.used += memory - e.memory
+		e.memory = memory
+	}
+	close(e.ready)
+}
+
+// makeRoom unloads the least recently used models until memory fits in the budget, the caller holds the lock.
+func (r *Registry) makeRoom(memory int64) error {
+	budget := r.options.MemoryBudget
+	if budget <= 0 {
+		return nil
+	}
+	if memory > budget {
+		return fmt.Errorf("model needs %d bytes, more than the memory budget of %d bytes", memory, budget)
+	}
+	for r.used+memory > budget {
+		var oldest *registryEntry
+		for _, e := range r.entries {
+			if e.refs > 0 || e.model == nil {
+				continue
+			}
+			if oldest == nil || e.lastUsed.Before(oldest.lastUsed) {
+				oldest = e
+			}
+		}
+		if oldest == nil {
+			return errors.New("memory budget exceeded, the loaded models are in use")
+		}
+		if err := r.unload(oldest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unload closes a loaded model, the caller holds the lock.
+func (r *Registry) unload(e *registryEntry) error {
+	delete(r.entries, e.name)
+	r.used -= e.memory
+	if e.pool != nil {
+		if err := e.pool.Close(); err != nil {
+			return err
+		}
+	}
+	return e.model.Close()
+}
+
+// EvictIdle unloads the models which have not been used for longer than maxIdle and returns their names.
+func (r *Registry) EvictIdle(maxIdle time.Duration) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	for _, e := range r.entries {
+		if e.refs > 0 || e.model == nil || time.Since(e.lastUsed) < maxIdle {
+			continue
+		}
+		if err := r.unload(e); err != nil {
+			return names, err
+		}
+		names = append(names, e.name)
+	}
+	return names, nil
+}
+
+func (r *Registry) evictIdleLoop() {
+	ticker := time.NewTicker(max(r.options.IdleTimeout/4, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_, _ = r.EvictIdle(r.options.IdleTimeout)
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Close unloads every model, even the ones in use.
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.stop)
+	for _, e := range r.entries {
+		if e.model == nil {
+			continue
+		}
+		if err := r.unload(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadModelSpec(spec ModelSpec) (*RwkvModel, *ContextPool, int64, error) {
+	var model *RwkvModel
+	var err error
+	if len(spec.Library) > 0 {
+		model, err = NewRwkvModel(spec.Library, spec.Options)
+	} else {
+		model, err = NewRwkvAutoModel(spec.Options)
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if err = model.LoadFromFile(spec.Path); err != nil {
+		_ = model.Close()
+		return nil, nil, 0, err
+	}
+	var pool *ContextPool
+	if spec.Contexts > 0 {
+		if pool, err = model.NewContextPool(spec.Contexts, spec.Threads); err != nil {
+			_ = model.Close()
+			return nil, nil, 0, err
+		}
+	}
+	memory, err := model.memory(spec.Path, spec.Contexts)
+	if err != nil {
+		if pool != nil {
+			_ = pool.Close()
+		}
+		_ = model.Close()
+		return nil, nil, 0, err
+	}
+	return model, pool, memory, nil
+}
+
+// memory computes the memory of the loaded model and of its pooled contexts from its file size and shape.
+func (m *RwkvModel) memory(path string, contexts int) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	c := m.cRwkv
+	shape := int64(c.RwkvGetNLayer(m.ctx)) * int64(c.RwkvGetNEmbedding(m.ctx))
+	perContext := 4 * (int64(c.RwkvGetStateLength(m.ctx)) + int64(c.RwkvGetLogitsLength(m.ctx)) + contextFloats*shape)
+	return info.Size() + int64(1+contexts)*perContext, nil
+}
+
+// EstimateMemory estimates the memory of a model file loaded with the given number of pooled contexts,
+// from the file size and the number of layers and embedding size of its header.
+func EstimateMemory(path string, contexts int) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	// magic, version, n_vocab, n_embed, n_layer, data_type
+	var header [6]uint32
+	if err = binary.Read(f, binary.LittleEndian, &header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return 0, errors.New("model file is too short")
+		}
+		return 0, err
+	}
+	if header[0] != rwkvFileMagic {
+		return 0, errors.New("not a rwkv.cpp model file")
+	}
+	nVocab, nEmbed, nLayer := int64(header[2]), int64(header[3]), int64(header[4])
+	perContext := 4 * (nVocab + (contextFloats+maxStateFloats)*nLayer*nEmbed)
+	return info.Size() + int64(1+contexts)*perContext, nil
+}
@@ -0,0 +1,165 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeModelHeader writes a model file with only a header and padding.
+func writeModelHeader(t *testing.T, path string, nVocab, nEmbed, nLayer uint32, size int) {
+	data := make([]byte, size)
+	for i, v := range []uint32{rwkvFileMagic, 101, nVocab, nEmbed, nLayer, 1} {
+		binary.LittleEndian.PutUint32(data[4*i:], v)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEstimateMemory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "model.bin")
+	writeModelHeader(t, path, 10, 4, 2, 1000)
+	memory, err := EstimateMemory(path, 1)
+	assert(t, err == nil)
+	assert(t, memory == 1000+2*4*(10+(contextFloats+maxStateFloats)*8))
+
+	if err = os.WriteFile(path, []byte("not a model file......."), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = EstimateMemory(path, 0)
+	assert(t, err != nil)
+}
+
+func TestRegistry(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		writeModelHeader(t, filepath.Join(dir, name+".bin"), 10, 4, 2, 1000)
+	}
+	memory, err := EstimateMemory(filepath.Join(dir, "a.bin"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRegistry := func(options RegistryOptions) *Registry {
+		r := NewRegistry(options)
+		r.load = func(spec ModelSpec) (*RwkvModel, *ContextPool, int64, error) {
+			if filepath.Base(spec.Path) == "broken.bin" {
+				return nil, nil, 0, errors.New("broken model")
+			}
+			return &RwkvModel{options: &spec.Options}, nil, memory, nil
+		}
+		names, err := r.RegisterDir(dir, ModelSpec{})
+		assert(t, err == nil)
+		assert(t, len(names) == 3)
+		return r
+	}
+
+	t.Run("evict least recently used", func(t *testing.T) {
+		r := newRegistry(RegistryOptions{MemoryBudget: 2 * memory})
+		defer r.Close()
+		for _, name := range []string{"a", "b", "a", "c"} {
+			lease, err := r.Acquire(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lease.Release()
+			time.Sleep(time.Millisecond)
+		}
+		loaded := r.Loaded()
+		assert(t, len(loaded) == 2)
+		assert(t, loaded[0].Name == "c" && loaded[1].Name == "a")
+		assert(t, r.Memory() == 2*memory)
+	})
+
+	t.Run("models in use are kept", func(t *testing.T) {
+		r := newRegistry(RegistryOptions{MemoryBudget: memory})
+		defer r.Close()
+		lease, err := r.Acquire("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.Acquire("b")
+		assert(t, err != nil)
+		assert(t, r.Unregister("a") != nil)
+		lease.Release()
+		lease.Release()
+		lease, err = r.Acquire("b")
+		assert(t, err == nil)
+		lease.Release()
+		assert(t, len(r.Loaded()) == 1)
+	})
+
+	t.Run("evict idle", func(t *testing.T) {
+		r := newRegistry(RegistryOptions{})
+		defer r.Close()
+		lease, err := r.Acquire("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		busy, err := r.Acquire("b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lease.Release()
+		names, err := r.EvictIdle(0)
+		assert(t, err == nil)
+		assert(t, len(names) == 1 && names[0] == "a")
+		busy.Release()
+		assert(t, len(r.Loaded()) == 1)
+	})
+
+	t.Run("load error", func(t *testing.T) {
+		r := newRegistry(RegistryOptions{})
+		defer r.Close()
+		broken := filepath.Join(t.TempDir(), "broken.bin")
+		writeModelHeader(t, broken, 10, 4, 2, 1000)
+		assert(t, r.Register("broken", ModelSpec{Path: broken}) == nil)
+		assert(t, r.Register("missing", ModelSpec{Path: filepath.Join(dir, "missing.bin")}) == nil)
+		_, err := r.Acquire("broken")
+		assert(t, err != nil)
+		_, err = r.Acquire("missing")
+		assert(t, err != nil)
+		_, err = r.Acquire("unknown")
+		assert(t, err != nil)
+		assert(t, r.Memory() == 0)
+	})
+
+	t.Run("close while loading", func(t *testing.T) {
+		r := newRegistry(RegistryOptions{})
+		loading, done := make(chan struct{}), make(chan struct{})
+		c := &freeRwkv{}
+		r.load = func(spec ModelSpec) (*RwkvModel, *ContextPool, int64, error) {
+			close(loading)
+			<-done
+			return &RwkvModel{cRwkv: c, ctx: &RwkvCtx{ctx: 1}, options: &spec.Options}, nil, memory, nil
+		}
+		acquired := make(chan error)
+		go func() {
+			_, err := r.Acquire("a")
+			acquired <- err
+		}()
+		<-loading
+		assert(t, r.Close() == nil)
+		close(done)
+		assert(t, <-acquired != nil, "no lease on a closed registry")
+		assert(t, c.freed == 1, "the loaded model is closed")
+		assert(t, r.Memory() == 0 && len(r.Loaded()) == 0)
+	})
+}
+
+// freeRwkv counts the freed contexts.
+type freeRwkv struct {
+	CRwkv
+	freed int
+}
+
+func (r *freeRwkv) RwkvFree(*RwkvCtx) error {
+	r.freed++
+	return nil
+}
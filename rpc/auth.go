@@ -0,0 +1,115 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rpc
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/seasonjs/rwkv"
+)
+
+// Auth authenticates the calls with API keys, server.Server implements it with the keys of server.Server.UseAPIKeys.
+type Auth interface {
+	// Authenticate returns ctx with the client of the key, done is called once the call returns.
+	// ok is false when the key is not valid.
+	Authenticate(ctx context.Context, key string) (_ context.Context, done func(), ok bool)
+	// JobOptions returns the scheduling options of the client of ctx.
+	JobOptions(ctx context.Context) rwkv.JobOptions
+	// Throttle waits until the client of ctx can use the tokens, for the work done without a job.
+	Throttle(ctx context.Context, tokens int) error
+	// Account adds the tokens of a call to the usage of the client of ctx.
+	Account(ctx context.Context, prompt, completion int)
+}
+
+// callKey holds the job options of an authenticated call.
+type callKey struct{}
+
+// UseAuth makes the calls authenticate with a key, as a bearer token of the authorization metadata.
+// The keys are checked by UnaryInterceptor and StreamInterceptor, the calls fail without them:
+//
+//	grpc.NewServer(grpc.UnaryInterceptor(srv.UnaryInterceptor), grpc.StreamInterceptor(srv.StreamInterceptor))
+func (s *Server) UseAuth(auth Auth) {
+	s.auth = auth
+}
+
+// authenticate returns the context of the call with the client of its key.
+func (s *Server) authenticate(ctx context.Context) (context.Context, func(), error) {
+	if s.auth == nil {
+		return ctx, func() {}, nil
+	}
+	var key string
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		key, _ = strings.CutPrefix(values[0], "Bearer ")
+	}
+	ctx, done, ok := s.auth.Authenticate(ctx, key)
+	if !ok {
+		return nil, nil, status.Error(codes.Unauthenticated, "invalid api key")
+	}
+	return context.WithValue(ctx, callKey{}, s.auth.JobOptions(ctx)), done, nil
+}
+
+// UnaryInterceptor authenticates the unary calls, see UseAuth.
+func (s *Server) UnaryInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, done, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return handler(ctx, req)
+}
+
+// StreamInterceptor authenticates the streaming calls, see UseAuth.
+func (s *Server) StreamInterceptor(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, done, err := s.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	defer done()
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authorize returns the job options of the call, an error when the call has not been authenticated.
+func (s *Server) authorize(ctx context.Context) (rwkv.JobOptions, error) {
+	opts, ok := ctx.Value(callKey{}).(rwkv.JobOptions)
+	if !ok && s.auth != nil {
+		return opts, status.Error(codes.Unauthenticated, "the call has not been authenticated, see UseAuth")
+	}
+	return opts, nil
+}
+
+// account adds the tokens of the call to the usage of its client.
+func (s *Server) account(ctx context.Context, prompt, completion int) {
+	if s.auth != nil {
+		s.auth.Account(ctx, prompt, completion)
+	}
+}
+
+// throttle waits until the client of the call can use the tokens, for the work done without a job.
+func (s *Server) throttle(ctx context.Context, tokens int) error {
+	if s.auth == nil {
+		return nil
+	}
+	if err := s.auth.Throttle(ctx, tokens); err != nil {
+		if ctx.Err() != nil {
+			return statusError(err)
+		}
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rpc
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/seasonjs/rwkv"
+)
+
+type testAuth struct {
+	calls, done int
+}
+
+type testClientKey struct{}
+
+func (a *testAuth) Authenticate(ctx context.Context, key string) (context.Context, func(), bool) {
+	if key != "sk-a" {
+		return ctx, nil, false
+	}
+	a.calls++
+	return context.WithValue(ctx, testClientKey{}, key), func() { a.done++ }, true
+}
+
+func (a *testAuth) JobOptions(ctx context.Context) rwkv.JobOptions {
+	if ctx.Value(testClientKey{}) == nil {
+		return rwkv.JobOptions{}
+	}
+	return rwkv.JobOptions{Priority: 7}
+}
+
+func (a *testAuth) Throttle(context.Context, int) error { return nil }
+
+func (a *testAuth) Account(context.Context, int, int) {}
+
+func TestServer_Auth(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &testAuth{}
+	s.UseAuth(auth)
+	client := serve(t, s, grpc.UnaryInterceptor(s.UnaryInterceptor), grpc.StreamInterceptor(s.StreamInterceptor))
+	withKey := func(key string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+key)
+	}
+
+	for _, ctx := range []context.Context{context.Background(), withKey("sk-unknown")} {
+		_, err = client.Tokenize(ctx, &TokenizeRequest{Model: "rwkv"})
+		assert(t, status.Code(err) == codes.Unauthenticated, err)
+		stream, err := client.Generate(ctx, &GenerateRequest{Model: "rwkv"})
+		assert(t, err == nil)
+		_, err = stream.Recv()
+		assert(t, status.Code(err) == codes.Unauthenticated, err)
+	}
+
+	_, err = client.Tokenize(withKey("sk-a"), &TokenizeRequest{Model: "rwkv"})
+	assert(t, status.Code(err) == codes.NotFound, err)
+	stream, err := client.Generate(withKey("sk-a"), &GenerateRequest{Model: "rwkv"})
+	assert(t, err == nil)
+	_, err = stream.Recv()
+	assert(t, status.Code(err) == codes.NotFound, err)
+	assert(t, auth.calls == 2 && auth.done == 2, auth.calls, auth.done)
+
+	ctx, done, err := s.authenticate(metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer sk-a")))
+	assert(t, err == nil)
+	opts, err := s.authorize(ctx)
+	assert(t, err == nil && opts.Priority == 7)
+	done()
+
+	// the calls fail without the interceptors
+	client = serve(t, s)
+	_, err = client.Tokenize(withKey("sk-a"), &TokenizeRequest{Model: "rwkv"})
+	assert(t, status.Code(err) == codes.Unauthenticated, err)
+}
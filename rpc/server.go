@@ -0,0 +1,415 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+// Package rpc serves RWKV models over gRPC with the Inference service of rwkv.proto.
+//
+//	srv, err := rpc.NewServer(&rpc.Model{Name: "rwkv", Pool: pool})
+//	grpcServer := grpc.NewServer()
+//	rpc.RegisterInferenceServer(grpcServer, srv)
+//
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative rwkv.proto
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/seasonjs/rwkv"
+)
+
+// Model is a model served under a name.
+type Model struct {
+	// Name is the model of the requests.
+	Name string
+	// Pool holds the contexts the calls are evaluated on, see rwkv.ContextPool.Attach.
+	Pool *rwkv.ContextPool
+	// Template renders the messages of Chat, rwkv.WorldChatTemplate by default.
+	Template rwkv.ChatTemplate
+	// Embed configures the embeddings.
+	Embed rwkv.EmbedOptions
+}
+
+// Server implements the Inference service on top of the models.
+type Server struct {
+	UnimplementedInferenceServer
+	models map[string]*Model
+	// auth authenticates the calls, nil when they are not authenticated
+	auth Auth
+}
+
+// NewServer returns a server for the models, the names must be unique.
+func NewServer(models ...*Model) (*Server, error) {
+	s := &Server{models: make(map[string]*Model)}
+	for _, m := range models {
+		if len(m.Name) == 0 {
+			return nil, errors.New("model name can not be empty")
+		}
+		if _, ok := s.models[m.Name]; ok {
+			return nil, fmt.Errorf("model %q is served twice", m.Name)
+		}
+		if m.Pool == nil {
+			return nil, fmt.Errorf("model %q has no contexts", m.Name)
+		}
+		if m.Template == nil {
+			m.Template = rwkv.WorldChatTemplate()
+		}
+		s.models[m.Name] = m
+	}
+	return s, nil
+}
+
+// model returns the model of the call, an error when the call has not been authenticated.
+func (s *Server) model(ctx context.Context, name string) (*Model, error) {
+	if _, err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	m, ok := s.models[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "the model %q does not exist", name)
+	}
+	return m, nil
+}
+
+// state returns the imported export, or a new state when it is empty, evaluated on the contexts of the pool
+// with the job options of the call. done must be called once the state is not evaluated anymore.
+func (m *Model) state(ctx context.Context, export []byte) (*rwkv.RwkvState, func(), error) {
+	var state *rwkv.RwkvState
+	var err error
+	if len(export) > 0 {
+		if state, err = m.Pool.Model().ReadState(bytes.NewReader(export)); err != nil {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "invalid state: %v", err)
+		}
+	} else if state, err = m.Pool.Model().InitState(); err != nil {
+		return nil, nil, statusError(err)
+	}
+	opts, _ := ctx.Value(callKey{}).(rwkv.JobOptions)
+	job, err := m.Pool.Attach(ctx, state, opts)
+	if err != nil {
+		return nil, nil, statusError(err)
+	}
+	return state, job.Detach, nil
+}
+
+func (m *Model) tokenize(text string) ([]int, error) {
+	tokens, err := m.Pool.Model().Tokenize(text)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return tokens, nil
+}
+
+// export returns the state in the format of rwkv.RwkvState.WriteTo.
+func export(state *rwkv.RwkvState) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := state.WriteTo(&buf); err != nil {
+		return nil, statusError(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// options converts the sampling options, stops replace the stop string of the model when not empty.
+func options(ctx context.Context, o *SamplingOptions, stops []string) []rwkv.PredictOption {
+	opts := []rwkv.PredictOption{rwkv.WithContext(ctx)}
+	if o.GetMaxTokens() > 0 {
+		opts = append(opts, rwkv.WithMaxTokens(int(o.GetMaxTokens())))
+	}
+	if o != nil && o.Temperature != nil {
+		opts = append(opts, rwkv.WithTemperature(o.GetTemperature()))
+	}
+	if o != nil && o.TopP != nil {
+		opts = append(opts, rwkv.WithTopP(o.GetTopP()))
+	}
+	if len(stops) > 0 {
+		opts = append(opts, rwkv.WithStopStrings(stops...))
+	}
+	return opts
+}
+
+// statusError returns the status of an error of the model.
+func statusError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (s *Server) Generate(req *GenerateRequest, stream Inference_GenerateServer) error {
+	ctx := stream.Context()
+	m, err := s.model(ctx, req.Model)
+	if err != nil {
+		return err
+	}
+	promptTokens, err := m.tokenize(req.Prompt)
+	if err != nil {
+		return err
+	}
+	state, done, err := m.state(ctx, req.State)
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err = state.FeedTokens(promptTokens); err != nil {
+		return statusError(err)
+	}
+
+	stops := req.Options.GetStop()
+	if len(stops) == 0 {
+		stops = []string{m.Pool.Model().Options().StopString}
+	}
+	var text string
+	var sent int
+	var sendErr error
+	gen, err := state.GenerateStream("", func(chunk string) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		text += chunk
+		if end := streamable(text, stops); end > sent {
+			sendErr = stream.Send(&GenerateResponse{Text: text[sent:end]})
+			sent = end
+		}
+		return sendErr == nil
+	}, options(ctx, req.Options, req.Options.GetStop())...)
+	if sendErr != nil {
+		return sendErr
+	}
+	if err != nil {
+		return statusError(err)
+	}
+	if err = ctx.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	s.account(ctx, len(promptTokens), len(gen.Tokens))
+	last := &GenerateResponse{
+		FinishReason: string(gen.FinishReason),
+		Usage:        &Usage{PromptTokens: int32(len(promptTokens)), CompletionTokens: int32(len(gen.Tokens))},
+	}
+	if len(gen.Text) > sent {
+		last.Text = gen.Text[sent:]
+	}
+	if req.ReturnState {
+		if last.State, err = export(state); err != nil {
+			return err
+		}
+	}
+	return stream.Send(last)
+}
+
+// streamable returns the length of the text which can be streamed: the text before a stop string,
+// without the end which may be the start of one.
+func streamable(text string, stops []string) int {
+	end := len(text)
+	for _, stop := range stops {
+		if len(stop) == 0 {
+			continue
+		}
+		if i := strings.Index(text, stop); i >= 0 {
+			end = min(end, i)
+			continue
+		}
+		for n := min(len(stop)-1, len(text)); n > 0; n-- {
+			if strings.HasSuffix(text, stop[:n]) {
+				end = min(end, len(text)-n)
+				break
+			}
+		}
+	}
+	return end
+}
+
+var chatRoles = map[string]rwkv.ChatRole{
+	"system":    rwkv.ChatRoleSystem,
+	"user":      rwkv.ChatRoleUser,
+	"assistant": rwkv.ChatRoleAssistant,
+	"tool":      rwkv.ChatRoleTool,
+}
+
+func (s *Server) Chat(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
+	m, err := s.model(ctx, req.Model)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Messages) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "messages can not be empty")
+	}
+	var sb strings.Builder
+	for _, msg := range req.Messages {
+		role, ok := chatRoles[msg.Role]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "message role %q is not supported", msg.Role)
+		}
+		sb.WriteString(m.Template.Format(rwkv.ChatMessage{Role: role, Content: msg.Content}))
+	}
+	sb.WriteString(m.Template.Prefix(rwkv.ChatRoleAssistant))
+	prompt := sb.String()
+	promptTokens, err := m.tokenize(prompt)
+	if err != nil {
+		return nil, err
+	}
+	state, done, err := m.state(ctx, req.State)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	separator := m.Template.Separator()
+	gen, err := state.Generate(prompt, options(ctx, req.Options, append([]string{separator}, req.Options.GetStop()...))...)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	s.account(ctx, len(promptTokens), len(gen.Tokens))
+	resp := &ChatResponse{
+		Message:      &ChatMessage{Role: "assistant", Content: strings.TrimSpace(gen.Text)},
+		FinishReason: string(gen.FinishReason),
+		Usage:        &Usage{PromptTokens: int32(len(promptTokens)), CompletionTokens: int32(len(gen.Tokens))},
+	}
+	if req.ReturnState {
+		// keep the state in the template format when the reply has been cut
+		if gen.Stop != separator {
+			tokens, err := m.tokenize(separator)
+			if err != nil {
+				return nil, err
+			}
+			if err = state.FeedTokens(tokens); err != nil {
+				return nil, statusError(err)
+			}
+		}
+		if resp.State, err = export(state); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func (s *Server) Embed(ctx context.Context, req *EmbedRequest) (*EmbedResponse, error) {
+	m, err := s.model(ctx, req.Model)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Input) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "input is required")
+	}
+	resp := &EmbedResponse{Usage: &Usage{}}
+	for _, input := range req.Input {
+		tokens, err := m.tokenize(input)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.throttle(ctx, len(tokens)); err != nil {
+			return nil, err
+		}
+		values, err := m.Pool.Embed(ctx, input, m.Embed)
+		if err != nil {
+			return nil, statusError(err)
+		}
+		resp.Embeddings = append(resp.Embeddings, &Embedding{Values: values})
+		resp.Usage.PromptTokens += int32(len(tokens))
+	}
+	s.account(ctx, int(resp.Usage.PromptTokens), 0)
+	return resp, nil
+}
+
+func (s *Server) Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeResponse, error) {
+	m, err := s.model(ctx, req.Model)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := m.tokenize(req.Text)
+	if err != nil {
+		return nil, err
+	}
+	resp := &TokenizeResponse{Tokens: make([]int32, len(tokens))}
+	for i, token := range tokens {
+		resp.Tokens[i] = int32(token)
+	}
+	return resp, nil
+}
+
+func (s *Server) Score(ctx context.Context, req *ScoreRequest) (*ScoreResponse, error) {
+	m, err := s.model(ctx, req.Model)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Continuations) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "continuations are required")
+	}
+	contextTokens, err := m.tokenize(req.Context)
+	if err != nil {
+		return nil, err
+	}
+	state, done, err := m.state(ctx, req.State)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	scores, err := state.Score(req.Context, req.Continuations)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	resp := &ScoreResponse{}
+	evaluated := len(contextTokens)
+	for _, score := range scores {
+		evaluated += len(score.Tokens)
+		cs := &ContinuationScore{Continuation: score.Continuation, Logprob: score.Logprob, Greedy: score.Greedy}
+		for _, token := range score.Tokens {
+			cs.Tokens = append(cs.Tokens, &TokenScore{
+				Token:   int32(token.Token),
+				Text:    token.Text,
+				Logprob: token.Logprob,
+				Greedy:  token.Greedy,
+			})
+		}
+		resp.Scores = append(resp.Scores, cs)
+	}
+	s.account(ctx, evaluated, 0)
+	return resp, nil
+}
+
+func (s *Server) SaveState(ctx context.Context, req *SaveStateRequest) (*SaveStateResponse, error) {
+	m, err := s.model(ctx, req.Model)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := m.tokenize(req.Prompt)
+	if err != nil {
+		return nil, err
+	}
+	state, done, err := m.state(ctx, req.State)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if err = state.FeedTokens(tokens); err != nil {
+		return nil, statusError(err)
+	}
+	s.account(ctx, len(tokens), 0)
+	data, err := export(state)
+	if err != nil {
+		return nil, err
+	}
+	return &SaveStateResponse{State: data, Tokens: int32(state.TokenCount())}, nil
+}
+
+func (s *Server) LoadState(ctx context.Context, req *LoadStateRequest) (*LoadStateResponse, error) {
+	m, err := s.model(ctx, req.Model)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.State) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "state is required")
+	}
+	state, err := m.Pool.Model().ReadState(bytes.NewReader(req.State))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid state: %v", err)
+	}
+	return &LoadStateResponse{
+		Tokens: int32(state.TokenCount()),
+		Text:   m.Pool.Model().Detokenize(state.Tokens()),
+	}, nil
+}
@@ -0,0 +1,180 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/seasonjs/rwkv"
+)
+
+func assert(t *testing.T, con bool, message ...any) {
+	if !con {
+		if len(message) == 0 {
+			t.Error("fail with here, result is false")
+		} else {
+			t.Error(message...)
+		}
+	}
+}
+
+// dial serves the models in process and returns a client of the service.
+func dial(t *testing.T, models ...*Model) InferenceClient {
+	s, err := NewServer(models...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serve(t, s, grpc.UnaryInterceptor(s.UnaryInterceptor), grpc.StreamInterceptor(s.StreamInterceptor))
+}
+
+// serve serves s in process and returns a client of the service.
+func serve(t *testing.T, s *Server, opts ...grpc.ServerOption) InferenceClient {
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(opts...)
+	RegisterInferenceServer(srv, s)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return NewInferenceClient(conn)
+}
+
+func TestStreamable(t *testing.T) {
+	stops := []string{"\n\n", "User:"}
+	assert(t, streamable("Hello", stops) == 5)
+	assert(t, streamable("Hello Us", stops) == 6)
+	assert(t, streamable("Hello\n", stops) == 5)
+	assert(t, streamable("Hello\n\nUser: hi", stops) == 5)
+	assert(t, streamable("Hello", nil) == 5)
+}
+
+func TestServer_UnknownModel(t *testing.T) {
+	client := dial(t)
+	_, err := client.Tokenize(context.Background(), &TokenizeRequest{Model: "rwkv", Text: "hello"})
+	assert(t, status.Code(err) == codes.NotFound, err)
+	stream, err := client.Generate(context.Background(), &GenerateRequest{Model: "rwkv", Prompt: "hello"})
+	assert(t, err == nil)
+	_, err = stream.Recv()
+	assert(t, status.Code(err) == codes.NotFound, err)
+}
+
+func TestServer(t *testing.T) {
+	model, err := rwkv.NewRwkvAutoModel(rwkv.RwkvOptions{
+		MaxTokens:     20,
+		StopString:    "\n\n",
+		Temperature:   0.8,
+		TopP:          0.5,
+		TokenizerType: rwkv.Normal,
+		PrintError:    true,
+		CpuThreads:    2,
+		TrackTokens:   true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer model.Close()
+
+	err = model.LoadFromFile("../models/RWKV-4b-Pile-171M-20230202-7922-f16.bin")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	pool, err := model.NewContextPool(2, 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer pool.Close()
+	client := dial(t, &Model{Name: "rwkv", Pool: pool, Template: rwkv.RavenChatTemplate()})
+	ctx := context.Background()
+
+	t.Run("generate", func(t *testing.T) {
+		stream, err := client.Generate(ctx, &GenerateRequest{
+			Model:       "rwkv",
+			Prompt:      "hello",
+			Options:     &SamplingOptions{MaxTokens: 5},
+			ReturnState: true,
+		})
+		assert(t, err == nil)
+		var last *GenerateResponse
+		for {
+			resp, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			assert(t, err == nil, err)
+			if err != nil {
+				return
+			}
+			last = resp
+		}
+		assert(t, last != nil && len(last.FinishReason) > 0 && len(last.State) > 0)
+		assert(t, last.Usage.PromptTokens > 0 && last.Usage.CompletionTokens <= 5)
+
+		loaded, err := client.LoadState(ctx, &LoadStateRequest{Model: "rwkv", State: last.State})
+		assert(t, err == nil, err)
+		assert(t, loaded.Tokens == last.Usage.PromptTokens+last.Usage.CompletionTokens)
+	})
+
+	t.Run("chat", func(t *testing.T) {
+		resp, err := client.Chat(ctx, &ChatRequest{
+			Model:    "rwkv",
+			Messages: []*ChatMessage{{Role: "user", Content: "hi"}},
+			Options:  &SamplingOptions{MaxTokens: 5},
+		})
+		assert(t, err == nil, err)
+		assert(t, resp.Message.Role == "assistant" && len(resp.State) == 0)
+
+		_, err = client.Chat(ctx, &ChatRequest{Model: "rwkv", Messages: []*ChatMessage{{Role: "robot"}}})
+		assert(t, status.Code(err) == codes.InvalidArgument, err)
+	})
+
+	t.Run("embed", func(t *testing.T) {
+		resp, err := client.Embed(ctx, &EmbedRequest{Model: "rwkv", Input: []string{"hello", "world"}})
+		assert(t, err == nil, err)
+		assert(t, len(resp.Embeddings) == 2 && len(resp.Embeddings[0].Values) > 0)
+	})
+
+	t.Run("tokenize", func(t *testing.T) {
+		resp, err := client.Tokenize(ctx, &TokenizeRequest{Model: "rwkv", Text: "hello world"})
+		assert(t, err == nil, err)
+		assert(t, len(resp.Tokens) > 0)
+	})
+
+	t.Run("score", func(t *testing.T) {
+		resp, err := client.Score(ctx, &ScoreRequest{Model: "rwkv", Context: "The sky is", Continuations: []string{" blue", " green"}})
+		assert(t, err == nil, err)
+		assert(t, len(resp.Scores) == 2 && len(resp.Scores[0].Tokens) > 0)
+	})
+
+	t.Run("state", func(t *testing.T) {
+		saved, err := client.SaveState(ctx, &SaveStateRequest{Model: "rwkv", Prompt: "hello"})
+		assert(t, err == nil, err)
+		saved, err = client.SaveState(ctx, &SaveStateRequest{Model: "rwkv", Prompt: " world", State: saved.State})
+		assert(t, err == nil, err)
+		loaded, err := client.LoadState(ctx, &LoadStateRequest{Model: "rwkv", State: saved.State})
+		assert(t, err == nil, err)
+		assert(t, loaded.Tokens == saved.Tokens && loaded.Text == "hello world", loaded.Text)
+
+		_, err = client.LoadState(ctx, &LoadStateRequest{Model: "rwkv", State: []byte("nope")})
+		assert(t, status.Code(err) == codes.InvalidArgument, err)
+	})
+}
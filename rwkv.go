@@ -4,10 +4,12 @@
 package rwkv
 
 import (
+	"context"
 	"errors"
-	"log"
+	"log/slog"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,6 +20,13 @@ type RwkvModel struct {
 	ctx        *RwkvCtx
 	options    *RwkvOptions
 	isAutoLoad bool
+	// initState replaces rwkv_init_state when a pretrained state is loaded
+	initState []float32
+	// token bytes and trie for constrained decoding, built on first use
+	vocabOnce  sync.Once
+	tokenBytes [][]byte
+	trie       *tokenTrie
+	vocabErr   error
 }
 
 type RwkvOptions struct {
@@ -30,11 +39,21 @@ type RwkvOptions struct {
 	CpuThreads       uint32
 	GpuEnable        bool
 	GpuOffLoadLayers uint32
+	// TrackTokens makes every RwkvState record the tokens it has seen, see RwkvState.Segments
+	TrackTokens bool
+	// Metrics receives the token rates, latencies and errors of the model, nothing is measured when nil.
+	Metrics Metrics
+	// Logger receives the structured logs of the model: the chosen library, the loading and the
+	// evaluation timings. Nothing is logged when nil.
+	Logger *slog.Logger
+	// Tracer starts spans for the loading, tokenization, prompts, generations and state exports,
+	// nothing is traced when nil. See WithContext for the parent of the spans.
+	Tracer Tracer
 }
 
 func NewRwkvAutoModel(options RwkvOptions) (*RwkvModel, error) {
 
-	file, err := dumpRwkvLibrary(options.GpuEnable)
+	file, err := dumpRwkvLibrary(options.GpuEnable, options.logger())
 	if err != nil {
 		return nil, err
 	}
@@ -62,7 +81,7 @@ func NewRwkvModel(dylibPath string, options RwkvOptions) (*RwkvModel, error) {
 	}
 
 	if options.TokenizerType == World {
-		tk, err = NewWorldTokenizer()
+		tk, err = newWorldTokenizer(options.logger())
 	}
 
 	if err != nil {
@@ -70,9 +89,9 @@ func NewRwkvModel(dylibPath string, options RwkvOptions) (*RwkvModel, error) {
 	}
 
 	if options.GpuEnable {
-		log.Printf("If you want to try offload your model to the GPU. " +
-			"Please confirm the size of your GPU memory to prevent memory overflow." +
-			"If the model is larger than GPU memory, please specify the layers to offload.")
+		options.logger().Info("the model will be offloaded to the gpu, make sure it fits in the gpu memory "+
+			"or set the number of layers to offload",
+			"library", dylibPath, "gpu_layers", options.GpuOffLoadLayers)
 	}
 
 	return &RwkvModel{
@@ -83,11 +102,14 @@ func NewRwkvModel(dylibPath string, options RwkvOptions) (*RwkvModel, error) {
 	}, nil
 }
 
-func (m *RwkvModel) LoadFromFile(path string) error {
-	_, err := os.Stat(path)
+func (m *RwkvModel) LoadFromFile(path string) (err error) {
+	spanCtx, span := m.startSpan(context.Background(), SpanLoad, slog.String(AttrModelPath, path))
+	defer func() { span.End(err) }()
+	_, err = os.Stat(path)
 	if err != nil {
 		return errors.New("the system cannot find the model file specified")
 	}
+	start := time.Now()
 	ctx := m.cRwkv.RwkvInitFromFile(path, m.options.CpuThreads)
 	m.ctx = ctx
 	// offload all layers to GPU
@@ -98,11 +120,21 @@ func (m *RwkvModel) LoadFromFile(path string) error {
 	}
 
 	if m.options.GpuEnable {
+		_, offload := m.startSpan(spanCtx, SpanGpuOffload, slog.Int(AttrGpuLayers, int(gpuNLayers)))
 		err = m.cRwkv.RwkvGpuOffloadLayers(ctx, gpuNLayers)
+		offload.End(err)
 		if err != nil {
+			m.observeError(err)
+			m.options.logger().Error("gpu offload failed", "path", path, "gpu_layers", gpuNLayers, "error", err)
 			return err
 		}
 	}
+	if !m.options.GpuEnable {
+		gpuNLayers = 0
+	}
+	span.SetAttributes(slog.Int(AttrGpuLayers, int(gpuNLayers)))
+	m.options.logger().Info("model loaded", "path", path, "threads", m.options.CpuThreads,
+		"gpu_layers", gpuNLayers, "duration", time.Since(start))
 
 	// by default disable error printing and handle errors by go error
 	m.cRwkv.RwkvSetPrintErrors(ctx, m.options.PrintError)
@@ -113,6 +145,38 @@ func (m *RwkvModel) QuantizeModelFile(in, out string, format QuantizedFormat) er
 	return m.cRwkv.RwkvQuantizeModelFile(m.ctx, in, out, format)
 }
 
+// Options returns the options the model has been created with.
+func (m *RwkvModel) Options() RwkvOptions {
+	return *m.options
+}
+
+// VocabSize returns the number of tokens of the vocabulary of the loaded model, 0 before LoadFromFile.
+func (m *RwkvModel) VocabSize() int {
+	if m.ctx == nil {
+		return 0
+	}
+	return int(m.cRwkv.RwkvGetNVocab(m.ctx))
+}
+
+// Tokenize encodes the text with the tokenizer of the model.
+func (m *RwkvModel) Tokenize(text string) ([]int, error) {
+	return m.tokenize(context.Background(), text)
+}
+
+// tokenize encodes the text in a span.
+func (m *RwkvModel) tokenize(ctx context.Context, text string) ([]int, error) {
+	_, span := m.startSpan(ctx, SpanTokenize)
+	tokens, err := m.tokenizer.Encode(text)
+	span.SetAttributes(slog.Int(AttrTokens, len(tokens)))
+	span.End(err)
+	return tokens, err
+}
+
+// Detokenize decodes the tokens with the tokenizer of the model.
+func (m *RwkvModel) Detokenize(tokens []int) string {
+	return m.tokenizer.Decode(tokens)
+}
+
 func (m *RwkvModel) Close() error {
 	if m.ctx != nil {
 		if err := m.cRwkv.RwkvFree(m.ctx); err != nil {
@@ -132,6 +196,14 @@ type RwkvState struct {
 	state     []float32
 	logits    []float32
 	rwkvModel *RwkvModel
+	// history of fed and generated tokens, only recorded when RwkvOptions.TrackTokens is set
+	history []TokenSegment
+	// historyLost is set once the state has been changed by something that is not a token
+	historyLost bool
+	// ctx is the context the state is evaluated on, the model context when nil, see Bind
+	ctx *RwkvCtx
+	// job schedules the evaluation on the contexts of a pool, see ContextPool.Attach
+	job *Job
 }
 
 // InitState give a new state for new chat context state
@@ -140,29 +212,38 @@ func (m *RwkvModel) InitState(prompt ...string) (*RwkvState, error) {
 		return nil, err
 	}
 	state := make([]float32, m.cRwkv.RwkvGetStateLength(m.ctx))
-	m.cRwkv.RwkvInitState(m.ctx, state)
+	m.resetState(m.ctx, state)
 	logits := make([]float32, m.cRwkv.RwkvGetLogitsLength(m.ctx))
+	rwkvState := &RwkvState{
+		state:     state,
+		rwkvModel: m,
+		logits:    logits,
+	}
 	p := ""
 	if len(prompt) > 0 {
 		p = prompt[0]
 	}
 	if len(p) > 0 {
+		ctx := context.Background()
+		encode, err := m.tokenize(ctx, p)
+		if err != nil {
+			return nil, err
+		}
 		startT := time.Now()
-		encode, err := m.tokenizer.Encode(p)
+		_, span := m.startSpan(ctx, SpanPrompt, slog.Int(AttrTokens, len(encode)))
 		for _, token := range encode {
 			err = m.cRwkv.RwkvEval(m.ctx, uint32(token), state, state, logits)
 			if err != nil {
+				span.End(err)
 				return nil, err
 			}
 		}
-		tc := time.Since(startT)
-		log.Print("init state time cost: ", tc, " total tokens: ", len(encode))
+		span.End(nil)
+		rwkvState.record(RolePrompt, encode...)
+		m.observePrompt(len(encode), startT)
+		m.options.logger().Debug("init state", "tokens", len(encode), "duration", time.Since(startT))
 	}
-	return &RwkvState{
-		state:     state,
-		rwkvModel: m,
-		logits:    logits,
-	}, nil
+	return rwkvState, nil
 }
 
 // CleanState will clean old state and set new state for new chat context state
@@ -177,41 +258,54 @@ func (s *RwkvState) CleanState(prompt ...string) (*RwkvState, error) {
 		s.logits = nil
 	}
 	state := make([]float32, s.rwkvModel.cRwkv.RwkvGetStateLength(s.rwkvModel.ctx))
-	s.rwkvModel.cRwkv.RwkvInitState(s.rwkvModel.ctx, state)
+	s.rwkvModel.resetState(s.rwkvModel.ctx, state)
 	logits := make([]float32, s.rwkvModel.cRwkv.RwkvGetLogitsLength(s.rwkvModel.ctx))
+	s.history = nil
+	rwkvState := &RwkvState{
+		state:     state,
+		rwkvModel: s.rwkvModel,
+		logits:    logits,
+		ctx:       s.ctx,
+		job:       s.job,
+	}
 	p := ""
 	if len(prompt) > 0 {
 		p = prompt[0]
 	}
 	if len(p) > 0 {
+		ctx := rwkvState.spanContext(nil)
+		encode, err := s.rwkvModel.tokenize(ctx, p)
+		if err != nil {
+			return nil, err
+		}
 		startT := time.Now()
-		encode, err := s.rwkvModel.tokenizer.Encode(p)
+		_, span := s.rwkvModel.startSpan(ctx, SpanPrompt, slog.Int(AttrTokens, len(encode)))
 		for _, token := range encode {
-			err = s.rwkvModel.cRwkv.RwkvEval(s.rwkvModel.ctx, uint32(token), state, state, logits)
+			err = rwkvState.eval(token)
 			if err != nil {
+				span.End(err)
 				return nil, err
 			}
 		}
-		tc := time.Since(startT)
-		log.Print("init state time cost: ", tc, "total tokens: ", len(encode))
+		span.End(nil)
+		rwkvState.record(RolePrompt, encode...)
+		s.rwkvModel.observePrompt(len(encode), startT)
+		s.rwkvModel.options.logger().Debug("clean state", "tokens", len(encode), "duration", time.Since(startT))
 	}
-	return &RwkvState{
-		state:     state,
-		rwkvModel: s.rwkvModel,
-		logits:    logits,
-	}, nil
+	return rwkvState, nil
 }
 
 // Predict give current chat a response
-func (s *RwkvState) Predict(input string) (string, error) {
+func (s *RwkvState) Predict(input string, opts ...PredictOption) (string, error) {
 	if err := checkState(s); err != nil {
 		return "", err
 	}
-	err := s.handelInput(input)
+	o := newPredictOptions(s.rwkvModel.options, opts)
+	err := s.handelInput(o.ctx, input)
 	if err != nil {
 		return "", err
 	}
-	return s.generateResponse(nil)
+	return s.generateResponse(nil, o)
 }
 
 // GetEmbedding give the model embedding.
@@ -225,7 +319,7 @@ func (s *RwkvState) GetEmbedding(input string, distill bool) ([]float32, error)
 	encode, err := s.rwkvModel.tokenizer.Encode(input)
 
 	for _, token := range encode {
-		err = s.rwkvModel.cRwkv.RwkvEval(s.rwkvModel.ctx, uint32(token), s.state, s.state, s.logits)
+		err = s.eval(token)
 		if err != nil {
 			return nil, err
 		}
@@ -239,13 +333,16 @@ func (s *RwkvState) GetEmbedding(input string, distill bool) ([]float32, error)
 	emb := make([]float32, nState)
 	copy(emb, s.state)
 	s.state = make([]float32, nState)
+	s.history = nil
+	s.historyLost = true
 	return emb, nil
 }
 
-func (s *RwkvState) PredictStream(input string, output chan string) {
+func (s *RwkvState) PredictStream(input string, output chan string, opts ...PredictOption) {
 
 	go func() {
-		err := s.handelInput(input)
+		o := newPredictOptions(s.rwkvModel.options, opts)
+		err := s.handelInput(o.ctx, input)
 		if err != nil {
 			output <- err.Error()
 			close(output)
@@ -254,7 +351,7 @@ func (s *RwkvState) PredictStream(input string, output chan string) {
 		_, err = s.generateResponse(func(s string) bool {
 			output <- s
 			return true
-		})
+		}, o)
 		close(output)
 	}()
 }
@@ -263,6 +360,8 @@ func (s *RwkvState) SaveState() ([]float32, error) {
 	if err := checkState(s); err != nil {
 		return nil, err
 	}
+	_, span := s.rwkvModel.startSpan(s.spanContext(nil), SpanStateSave, slog.Int(AttrStateBytes, len(s.state)*4))
+	span.End(nil)
 	return s.state, nil
 }
 
@@ -270,55 +369,191 @@ func (s *RwkvState) LoadState(state []float32) error {
 	if err := checkState(s); err != nil {
 		return err
 	}
+	_, span := s.rwkvModel.startSpan(s.spanContext(nil), SpanStateLoad, slog.Int(AttrStateBytes, len(state)*4))
 
 	if len(state) != len(s.state) {
-		return errors.New("state length is not match")
+		err := errors.New("state length is not match")
+		span.End(err)
+		return err
 	}
+	span.End(nil)
 
 	s.state = state
+	// the loaded state has an unknown origin
+	s.history = nil
+	s.historyLost = true
 	return nil
 }
 
-func (s *RwkvState) handelInput(input string) error {
-	encode, err := s.rwkvModel.tokenizer.Encode(input)
+// FeedTokens evaluates the tokens without generating, like an input given as token ids.
+func (s *RwkvState) FeedTokens(tokens []int) error {
+	if err := checkState(s); err != nil {
+		return err
+	}
+	return s.evalTokens(nil, RoleInput, tokens)
+}
+
+func (s *RwkvState) handelInput(ctx context.Context, input string) error {
+	return s.evalText(ctx, RoleInput, input)
+}
+
+// evalText encodes the text and feeds it into the state, ctx is the parent of the spans,
+// nil for the context of the job.
+func (s *RwkvState) evalText(ctx context.Context, role TokenRole, text string) error {
+	if len(text) == 0 {
+		return nil
+	}
+	ctx = s.spanContext(ctx)
+	encode, err := s.rwkvModel.tokenize(ctx, text)
 	if err != nil {
 		return err
 	}
-	for _, token := range encode {
-		err = s.rwkvModel.cRwkv.RwkvEval(s.rwkvModel.ctx, uint32(token), s.state, s.state, s.logits)
-		if err != nil {
+	return s.evalTokens(ctx, role, encode)
+}
+
+// evalTokens feeds the tokens into the state and records them with the given role.
+func (s *RwkvState) evalTokens(ctx context.Context, role TokenRole, tokens []int) error {
+	_, span := s.rwkvModel.startSpan(s.spanContext(ctx), SpanPrompt, slog.Int(AttrTokens, len(tokens)))
+	start := time.Now()
+	for _, token := range tokens {
+		if err := s.eval(token); err != nil {
+			span.End(err)
 			return err
 		}
 	}
+	span.End(nil)
+	s.record(role, tokens...)
+	s.rwkvModel.observePrompt(len(tokens), start)
 	return nil
 }
 
-func (s *RwkvState) generateResponse(callback func(s string) bool) (string, error) {
-	responseText := ""
-	for i := 0; i < s.rwkvModel.options.MaxTokens; i++ {
+func (s *RwkvState) generateResponse(callback func(s string) bool, opts *predictOptions) (string, error) {
+	gen, err := s.generate(callback, opts)
+	if err != nil {
+		return "", err
+	}
+	return gen.Text, nil
+}
 
-		token, err := SampleLogits(s.logits, s.rwkvModel.options.Temperature, s.rwkvModel.options.TopP, map[int]float32{})
+// generate samples tokens until a stop string, the token limit, the constraint or the callback ends it.
+func (s *RwkvState) generate(callback func(s string) bool, opts *predictOptions) (gen *Generation, err error) {
+	var firstToken time.Duration
+	_, span := s.rwkvModel.startSpan(s.spanContext(opts.ctx), SpanGenerate, slog.Int(AttrMaxTokens, opts.maxTokens))
+	defer func() {
+		if gen != nil {
+			span.SetAttributes(slog.Int(AttrCompletionTokens, len(gen.Tokens)),
+				slog.String(AttrFinishReason, string(gen.FinishReason)))
+		}
+		span.End(err)
+		if metrics := s.rwkvModel.options.Metrics; metrics != nil && gen != nil {
+			metrics.Generation(len(gen.Tokens), firstToken, time.Since(opts.start))
+		}
+	}()
+	var decoder *constrainedDecoder
+	if opts.constraint != nil {
+		decoder, err = newConstrainedDecoder(s.rwkvModel, opts.constraint)
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+	}
+	gen = &Generation{FinishReason: FinishLength}
+	// the constraint and the sampling work on a copy, the logits of the state stay usable after the generation
+	probs := make([]float32, len(s.logits))
+	for i := 0; i < opts.maxTokens; i++ {
+		copy(probs, s.logits)
+		if decoder != nil && !decoder.mask(probs) {
+			if !decoder.state.done() {
+				return nil, errors.New("no token of the vocabulary can continue the constraint")
+			}
+			gen.FinishReason = FinishStop
+			break
 		}
 
-		err = s.rwkvModel.cRwkv.RwkvEval(s.rwkvModel.ctx, uint32(token), s.state, s.state, s.logits)
-		if err != nil {
-			return "", err
+		softmax(probs)
+		if err := adjustProbs(probs, opts.temperature, opts.topP, opts.logitBias); err != nil {
+			return nil, err
+		}
+		token := chooseToken(probs, opts.temperature)
+		if decoder != nil {
+			if token == endOfTextToken {
+				gen.FinishReason = FinishStop
+				break
+			}
+			if !decoder.accept(token) {
+				return nil, errors.New("sampled token is not allowed by the constraint")
+			}
+		}
+		if opts.logprobs {
+			gen.Logprobs = append(gen.Logprobs, s.rwkvModel.tokenLogprob(token, s.logits, probs, opts.topLogprobs))
+		}
+
+		if err := s.eval(token); err != nil {
+			if errors.Is(err, ErrTokenBudget) {
+				// the token is not part of the state, leave it out
+				gen.Logprobs = gen.Logprobs[:len(gen.Tokens)]
+				return gen, nil
+			}
+			return nil, err
+		}
+		s.record(RoleOutput, token)
+		gen.Tokens = append(gen.Tokens, token)
+		if len(gen.Tokens) == 1 {
+			firstToken = time.Since(opts.start)
 		}
 
 		chars := s.rwkvModel.tokenizer.Decode([]int{token})
-		responseText += chars
+		if decoder != nil {
+			// constrained output must keep the exact bytes, even when a token ends inside a utf-8 character
+			chars = string(decoder.tokens[token])
+		}
+		gen.Text += chars
 		if callback != nil && !callback(chars) {
+			gen.FinishReason = FinishStop
 			break
 		}
-		if strings.Contains(responseText, s.rwkvModel.options.StopString) {
-			responseText = strings.Split(responseText, s.rwkvModel.options.StopString)[0]
-			break
+		if stop := firstStop(gen.Text, opts.stopStrings); len(stop) > 0 {
+			gen.Text = strings.Split(gen.Text, stop)[0]
+			gen.Stop, gen.FinishReason = stop, FinishStop
+			return gen, nil
+		}
+	}
+	return gen, nil
+}
+
+// Bind makes the state evaluate on the given context, usually one acquired from a ContextPool,
+// so that states on different contexts can be used from different goroutines.
+// nil binds the state back to the model context.
+func (s *RwkvState) Bind(ctx *RwkvCtx) {
+	s.ctx = ctx
+}
+
+// eval feeds one token into the state, on a context of the scheduler when the state is attached to a job.
+func (s *RwkvState) eval(token int) error {
+	ctx := s.evalCtx()
+	if job := s.attachedJob(); job != nil {
+		c, err := job.step()
+		if err != nil {
+			return err
+		}
+		if c != nil {
+			ctx = c
 		}
 	}
-	return responseText, nil
+	err := s.rwkvModel.cRwkv.RwkvEval(ctx, uint32(token), s.state, s.state, s.logits)
+	if err != nil {
+		s.rwkvModel.observeError(err)
+	}
+	return err
 }
+
+// evalCtx returns the context the state is evaluated on.
+func (s *RwkvState) evalCtx() *RwkvCtx {
+	if s.ctx != nil {
+		return s.ctx
+	}
+	return s.rwkvModel.ctx
+}
+
 func hasCtx(ctx *RwkvCtx) error {
 	if ctx.ctx == 0 {
 		return errors.New("you must call LoadFromFile first")
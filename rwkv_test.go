@@ -1,7 +1,10 @@
 package rwkv
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"runtime"
 	"testing"
 )
@@ -327,3 +330,185 @@ func TestRwkvState_GetEmbedding(t *testing.T) {
 	})
 
 }
+
+func TestRwkvModel_EmbedBatch(t *testing.T) {
+	rwkv, err := NewRwkvAutoModel(RwkvOptions{
+		MaxTokens:     500,
+		TokenizerType: Normal, //or World
+		PrintError:    true,
+		CpuThreads:    2,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer rwkv.Close()
+
+	err = rwkv.LoadFromFile("./models/RWKV-4b-Pile-171M-20230202-7922-f16.bin")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	texts := []string{"hello world", "", "the quick brown fox jumps over the lazy dog"}
+	nb := rwkv.cRwkv.RwkvGetNEmbedding(rwkv.ctx)
+
+	t.Run("embed batch in order", func(t *testing.T) {
+		progress := 0
+		embeddings, err := rwkv.EmbedBatch(context.Background(), texts, EmbedOptions{
+			Workers:  2,
+			Distill:  true,
+			Progress: func(done, total int) { progress = done },
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		assert(t, len(embeddings) == len(texts))
+		assert(t, progress == len(texts))
+		for _, embedding := range embeddings {
+			assert(t, len(embedding) == int(nb))
+		}
+
+		ctx, err := rwkv.InitState()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		embedding, err := ctx.GetEmbedding(texts[2], true)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for i := range embedding {
+			assert(t, math.Abs(float64(embedding[i]-embeddings[2][i])) < 1e-3)
+		}
+	})
+
+	t.Run("embed batch canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := rwkv.EmbedBatch(ctx, texts, EmbedOptions{})
+		assert(t, errors.Is(err, context.Canceled))
+	})
+}
+
+func TestRwkvState_Score(t *testing.T) {
+	rwkv, err := NewRwkvAutoModel(RwkvOptions{
+		MaxTokens:     500,
+		TokenizerType: Normal, //or World
+		PrintError:    true,
+		CpuThreads:    2,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer rwkv.Close()
+
+	err = rwkv.LoadFromFile("./models/RWKV-4b-Pile-171M-20230202-7922-f16.bin")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ctx, err := rwkv.InitState()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	before, _ := ctx.SaveState()
+	before = append([]float32(nil), before...)
+
+	scores, err := ctx.Score("The capital of France is", []string{" Paris", " a banana split", ""})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert(t, len(scores) == 3)
+	assert(t, scores[0].Logprob > scores[1].Logprob, "the right answer is more likely")
+	for _, score := range scores {
+		sum := 0.0
+		for _, token := range score.Tokens {
+			assert(t, token.Logprob <= 0)
+			sum += token.Logprob
+		}
+		assert(t, math.Abs(sum-score.Logprob) < 1e-9)
+	}
+	assert(t, len(scores[2].Tokens) == 0 && scores[2].Logprob == 0)
+
+	after, _ := ctx.SaveState()
+	for i := range after {
+		assert(t, after[i] == before[i], "scoring doesn't change the state")
+	}
+}
+
+func TestRwkvState_BeamSearch(t *testing.T) {
+	rwkv, err := NewRwkvAutoModel(RwkvOptions{
+		MaxTokens:     20,
+		StopString:    "\n",
+		TokenizerType: Normal, //or World
+		PrintError:    true,
+		CpuThreads:    2,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer rwkv.Close()
+
+	err = rwkv.LoadFromFile("./models/RWKV-4b-Pile-171M-20230202-7922-f16.bin")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	t.Run("width one is greedy", func(t *testing.T) {
+		ctx, err := rwkv.InitState()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		greedy, err := ctx.Fork()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		hyps, err := ctx.BeamSearch("The capital of France is", BeamOptions{Width: 1})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		out, err := greedy.Predict("The capital of France is", WithTemperature(0))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		assert(t, len(hyps) == 1 && hyps[0].Text == out, hyps[0].Text, out)
+	})
+
+	t.Run("n best", func(t *testing.T) {
+		ctx, err := rwkv.InitState()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		hyps, err := ctx.BeamSearch("The capital of France is", BeamOptions{Width: 4, Results: 3, LengthPenalty: 1})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		assert(t, len(hyps) == 3)
+		for i := 1; i < len(hyps); i++ {
+			assert(t, hyps[i-1].Score >= hyps[i].Score)
+		}
+
+		gens, err := ctx.PredictN(" Paris is", 3, WithMaxTokens(5))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		assert(t, len(gens) == 3)
+		for _, gen := range gens {
+			assert(t, len(gen.Tokens) <= 5)
+		}
+	})
+}
@@ -5,6 +5,7 @@ package rwkv
 
 import (
 	"errors"
+	"fmt"
 	"math"
 	"math/rand"
 	"sort"
@@ -38,11 +39,20 @@ func SampleLogits(tensor []float32, temperature float32, topP float32, logitBias
 }
 
 func sampleProbs(probs []float32, temperature float32, topP float32, logitBias map[int]float32) (int, error) {
+	if err := adjustProbs(probs, temperature, topP, logitBias); err != nil {
+		return 0, err
+	}
+	return chooseToken(probs, temperature), nil
+}
+
+// adjustProbs applies the logit bias, top-p and temperature to the probabilities.
+// With temperature 0 all the probability goes to the most likely token.
+func adjustProbs(probs []float32, temperature float32, topP float32, logitBias map[int]float32) error {
 	if temperature < 0 {
-		return 0, errors.New("temperature must be non-negative")
+		return errors.New("temperature must be non-negative")
 	}
 	if topP < 0 || topP > 1 {
-		return 0, errors.New("top_p must be in the range [0, 1]")
+		return errors.New("top_p must be in the range [0, 1]")
 	}
 
 	if topP == 0 {
@@ -57,6 +67,9 @@ func sampleProbs(probs []float32, temperature float32, topP float32, logitBias m
 		}
 
 		for token, bias := range logitBias {
+			if token < 0 || token >= len(logits) {
+				return fmt.Errorf("logit bias token %d is out of the vocabulary of %d tokens", token, len(logits))
+			}
 			logits[token] += bias
 		}
 
@@ -72,7 +85,12 @@ func sampleProbs(probs []float32, temperature float32, topP float32, logitBias m
 	}
 
 	if temperature == 0 {
-		return argMax(probs), nil
+		best := argMax(probs)
+		for i := range probs {
+			probs[i] = 0
+		}
+		probs[best] = 1
+		return nil
 	}
 
 	if topP < 1 {
@@ -113,8 +131,15 @@ func sampleProbs(probs []float32, temperature float32, topP float32, logitBias m
 	for i := range probs {
 		probs[i] /= probsSum
 	}
+	return nil
+}
 
-	return randomChoice(len(probs), probs), nil
+// chooseToken samples a token from probabilities adjusted by adjustProbs.
+func chooseToken(probs []float32, temperature float32) int {
+	if temperature == 0 {
+		return argMax(probs)
+	}
+	return randomChoice(len(probs), probs)
 }
 
 func argMax(slice []float32) int {
@@ -0,0 +1,277 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrTokenBudget is returned when a job has evaluated JobOptions.MaxTokens tokens.
+// A generation reaching the budget ends with FinishLength instead.
+var ErrTokenBudget = errors.New("token budget of the job exceeded")
+
+// throughputWindow is the number of seconds the tokens per second are measured over.
+const throughputWindow = 10
+
+// JobOptions configures a job of a ContextPool.
+type JobOptions struct {
+	// Priority of the job, the contexts go to the waiting jobs of the highest priority first.
+	// A job of a higher priority preempts the running jobs at their next token.
+	Priority int
+	// MaxTokens is the number of tokens the job can evaluate, prompt and output included, 0 means no limit.
+	MaxTokens int
+	// Limit is shared with other jobs to bound their number and their tokens per minute, nil means no limit.
+	Limit *RateLimit
+}
+
+// Job schedules the evaluation of a state on the contexts of a pool.
+// rwkv.cpp evaluates one token per call, so instead of holding a context for a whole request
+// the job takes a context for a quantum of tokens and then lets the other jobs of the same priority
+// use it, so that many requests progress at the same time on a few contexts.
+// A job is used by the goroutine evaluating its state.
+type Job struct {
+	pool  *ContextPool
+	ctx   context.Context
+	state *RwkvState
+	opts  JobOptions
+
+	c        *RwkvCtx
+	steps    int
+	tokens   int
+	detached bool
+}
+
+// Attach makes the state evaluate on the contexts of the pool until the job is detached,
+// ctx cancels the wait for a context or for the limit. The forks of the state belong to the job too,
+// until it is detached, then they can be attached to other jobs.
+func (p *ContextPool) Attach(ctx context.Context, s *RwkvState, opts JobOptions) (*Job, error) {
+	if s == nil || len(s.state) == 0 {
+		return nil, errors.New("you must call InitState first")
+	}
+	if s.attachedJob() != nil {
+		return nil, errors.New("state is already attached to a job")
+	}
+	if opts.Limit != nil {
+		if err := opts.Limit.acquire(ctx); err != nil {
+			return nil, err
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		if opts.Limit != nil {
+			opts.Limit.release()
+		}
+		return nil, errors.New("context pool is closed")
+	}
+	p.jobs++
+	job := &Job{pool: p, ctx: ctx, state: s, opts: opts}
+	s.job = job
+	return job, nil
+}
+
+// SetQuantum sets the number of tokens a job evaluates before another job of the same priority
+// can take its context, 16 by default. A larger quantum switches less, a smaller one is fairer.
+func (p *ContextPool) SetQuantum(tokens int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.quantum = max(tokens, 1)
+}
+
+// Tokens returns the number of tokens the job has evaluated.
+func (j *Job) Tokens() int {
+	return j.tokens
+}
+
+// Detach gives the context back to the pool, the state evaluates on its bound context again.
+func (j *Job) Detach() {
+	if j.detached {
+		return
+	}
+	j.detached = true
+	if j.state.job == j {
+		j.state.job = nil
+	}
+	if j.opts.Limit != nil {
+		j.opts.Limit.release()
+	}
+	p := j.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.jobs--
+	if j.c != nil {
+		p.release(j.c)
+		j.c = nil
+	}
+}
+
+// attachedJob returns the job of the state, nil once it is detached.
+// The forks of a state share its job, Detach only clears the job of the attached state.
+func (s *RwkvState) attachedJob() *Job {
+	if s.job != nil && s.job.detached {
+		s.job = nil
+	}
+	return s.job
+}
+
+// step returns the context of the next token, nil once the job is detached.
+func (j *Job) step() (*RwkvCtx, error) {
+	if j.detached {
+		return nil, nil
+	}
+	if j.opts.MaxTokens > 0 && j.tokens >= j.opts.MaxTokens {
+		return nil, ErrTokenBudget
+	}
+	p := j.pool
+	if j.opts.Limit != nil {
+		if err := j.throttle(); err != nil {
+			return nil, err
+		}
+	}
+	if j.c != nil {
+		p.mu.Lock()
+		j.yield()
+		p.mu.Unlock()
+	}
+	if j.c == nil {
+		c, err := p.acquire(j.ctx, j.opts.Priority)
+		if err != nil {
+			return nil, err
+		}
+		j.c, j.steps = c, 0
+	}
+	j.steps++
+	j.tokens++
+	p.mu.Lock()
+	p.stats.add(time.Now(), 1)
+	p.mu.Unlock()
+	return j.c, nil
+}
+
+// throttle waits until the limit of the job allows its next token, the context is given back meanwhile.
+func (j *Job) throttle() error {
+	wait := j.opts.Limit.reserve(time.Now(), 1)
+	if wait <= 0 {
+		return nil
+	}
+	p := j.pool
+	p.mu.Lock()
+	p.stats.throttled++
+	if j.c != nil {
+		p.release(j.c)
+		j.c = nil
+	}
+	p.mu.Unlock()
+	if err := sleep(j.ctx, wait); err != nil {
+		j.opts.Limit.cancel(1)
+		return err
+	}
+	return nil
+}
+
+// yield hands the context of the job to a waiting request of a higher priority,
+// or of the same priority once the quantum is used up. p.mu must be held.
+func (j *Job) yield() {
+	p := j.pool
+	if len(p.waiting) == 0 {
+		return
+	}
+	next := p.waiting[0].priority
+	switch {
+	case next > j.opts.Priority:
+		p.stats.preemptions++
+	case next == j.opts.Priority && j.steps >= p.quantum:
+		p.stats.switches++
+	default:
+		return
+	}
+	p.release(j.c)
+	j.c = nil
+}
+
+// SchedulerStats is a snapshot of the scheduling of a ContextPool.
+type SchedulerStats struct {
+	Contexts int
+	// InUse is the number of contexts held by jobs or acquired.
+	InUse int
+	// Waiting is the number of jobs and Acquire calls waiting for a context.
+	Waiting int
+	// Jobs is the number of attached jobs.
+	Jobs int
+	// Tokens is the number of tokens evaluated by the jobs.
+	Tokens uint64
+	// TokensPerSecond is measured over the last 10 seconds.
+	TokensPerSecond float64
+	// Preemptions counts the contexts taken by a job of a higher priority,
+	// Switches the ones handed to another job at the end of a quantum.
+	Preemptions uint64
+	Switches    uint64
+	// Throttled counts the pauses of jobs over their RateLimit.
+	Throttled uint64
+	// WaitTime is the total time spent waiting for a context.
+	WaitTime time.Duration
+}
+
+// Stats returns the scheduling counters of the pool.
+func (p *ContextPool) Stats() SchedulerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return SchedulerStats{
+		Contexts:        p.size,
+		InUse:           p.size - len(p.free),
+		Waiting:         len(p.waiting),
+		Jobs:            p.jobs,
+		Tokens:          p.stats.tokens,
+		TokensPerSecond: p.stats.rate(time.Now()),
+		Preemptions:     p.stats.preemptions,
+		Switches:        p.stats.switches,
+		Throttled:       p.stats.throttled,
+		WaitTime:        p.stats.wait,
+	}
+}
+
+type schedulerCounters struct {
+	tokens      uint64
+	preemptions uint64
+	switches    uint64
+	throttled   uint64
+	wait        time.Duration
+	// tokens of the last seconds, by unix second modulo the window
+	buckets [throughputWindow]uint64
+	seconds [throughputWindow]int64
+	start   time.Time
+}
+
+func newSchedulerCounters() schedulerCounters {
+	return schedulerCounters{start: time.Now()}
+}
+
+func (c *schedulerCounters) add(now time.Time, tokens uint64) {
+	c.tokens += tokens
+	sec := now.Unix()
+	i := sec % throughputWindow
+	if c.seconds[i] != sec {
+		c.seconds[i], c.buckets[i] = sec, 0
+	}
+	c.buckets[i] += tokens
+}
+
+// rate returns the tokens per second of the last complete seconds of the window.
+func (c *schedulerCounters) rate(now time.Time) float64 {
+	sec := now.Unix()
+	var tokens uint64
+	for i, s := range c.seconds {
+		if s < sec && s >= sec-throughputWindow {
+			tokens += c.buckets[i]
+		}
+	}
+	// a young pool has not been running for the whole window
+	window := min(float64(throughputWindow), now.Sub(c.start).Seconds())
+	if window < 1 {
+		return 0
+	}
+	return float64(tokens) / window
+}
@@ -0,0 +1,179 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testPool returns a pool of fake contexts, jobs can step on it without a model.
+func testPool(size int) *ContextPool {
+	p := &ContextPool{model: &RwkvModel{ctx: &RwkvCtx{ctx: 1}, options: &RwkvOptions{}}, size: size, quantum: 2, stats: newSchedulerCounters()}
+	for i := 0; i < size; i++ {
+		p.free = append(p.free, &RwkvCtx{ctx: uintptr(i + 1)})
+	}
+	return p
+}
+
+func testJob(t *testing.T, p *ContextPool, opts JobOptions) *Job {
+	job, err := p.Attach(context.Background(), &RwkvState{state: []float32{0}, rwkvModel: p.model}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// goStep steps the job in a goroutine.
+func goStep(job *Job) chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := job.step()
+		done <- err
+	}()
+	return done
+}
+
+// waitFor waits until the pool has the number of waiting requests.
+func waitFor(t *testing.T, p *ContextPool, waiting int) {
+	for i := 0; p.Stats().Waiting != waiting; i++ {
+		if i == 1000 {
+			t.Fatal("timeout waiting for", waiting, "requests")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestContextPool_Jobs(t *testing.T) {
+	p := testPool(1)
+	a := testJob(t, p, JobOptions{})
+	b := testJob(t, p, JobOptions{})
+	_, err := a.step()
+	assert(t, err == nil)
+
+	// b waits until a has used its quantum
+	bDone := goStep(b)
+	waitFor(t, p, 1)
+	_, err = a.step()
+	assert(t, err == nil)
+	aDone := goStep(a)
+	assert(t, <-bDone == nil)
+	waitFor(t, p, 1)
+	assert(t, p.Stats().Switches == 1)
+
+	// a higher priority goes first
+	h := testJob(t, p, JobOptions{Priority: 1})
+	hDone := goStep(h)
+	waitFor(t, p, 2)
+	b.Detach()
+	assert(t, <-hDone == nil)
+	h.Detach()
+	assert(t, <-aDone == nil)
+
+	// a running job is preempted by a higher priority
+	top := testJob(t, p, JobOptions{Priority: 2})
+	topDone := goStep(top)
+	waitFor(t, p, 1)
+	aDone = goStep(a)
+	assert(t, <-topDone == nil)
+	waitFor(t, p, 1)
+	assert(t, p.Stats().Preemptions == 1)
+	top.Detach()
+	assert(t, <-aDone == nil)
+
+	stats := p.Stats()
+	assert(t, stats.Tokens == 7 && stats.Jobs == 1 && stats.InUse == 1 && stats.Waiting == 0)
+	a.Detach()
+	assert(t, p.Stats().InUse == 0)
+
+	t.Run("budget", func(t *testing.T) {
+		job := testJob(t, p, JobOptions{MaxTokens: 1})
+		defer job.Detach()
+		_, err := job.step()
+		assert(t, err == nil)
+		_, err = job.step()
+		assert(t, errors.Is(err, ErrTokenBudget))
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		c, err := p.Acquire(context.Background())
+		assert(t, err == nil)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = p.Acquire(ctx)
+		assert(t, errors.Is(err, context.DeadlineExceeded))
+		assert(t, p.Stats().Waiting == 0)
+		p.Release(c)
+		assert(t, p.Stats().InUse == 0)
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	now := time.Now()
+	l := NewRateLimit(60, 0)
+	l.last = now
+	assert(t, l.reserve(now, 60) == 0)
+	assert(t, l.reserve(now, 1) == time.Second)
+	l.cancel(1)
+	// a token comes back every second
+	assert(t, l.reserve(now.Add(2*time.Second), 2) == 0)
+	assert(t, NewRateLimit(0, 0).reserve(now, 1000) == 0)
+
+	t.Run("jobs", func(t *testing.T) {
+		p := testPool(1)
+		limit := NewRateLimit(0, 1)
+		a := testJob(t, p, JobOptions{Limit: limit})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := p.Attach(ctx, &RwkvState{state: []float32{0}, rwkvModel: p.model}, JobOptions{Limit: limit})
+		assert(t, errors.Is(err, context.DeadlineExceeded))
+		a.Detach()
+		b := testJob(t, p, JobOptions{Limit: limit})
+		b.Detach()
+	})
+
+	t.Run("throttle", func(t *testing.T) {
+		p := testPool(1)
+		// 100 tokens per second, all used already
+		limit := NewRateLimit(6000, 0)
+		limit.tokens = 0
+		job := testJob(t, p, JobOptions{Limit: limit})
+		defer job.Detach()
+		start := time.Now()
+		_, err := job.step()
+		assert(t, err == nil)
+		assert(t, time.Since(start) >= 5*time.Millisecond)
+		assert(t, p.Stats().Throttled == 1)
+	})
+}
+
+func TestContextPool_AttachFork(t *testing.T) {
+	m, _ := newFakeModel(t, RwkvOptions{})
+	p := testPool(1)
+	p.model = m
+	s, err := m.InitState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := p.Attach(context.Background(), s, JobOptions{})
+	assert(t, err == nil)
+	fork, err := s.Fork()
+	assert(t, err == nil)
+	assert(t, fork.eval(1) == nil && job.Tokens() == 1, "the fork evaluates on the job of its state")
+	job.Detach()
+
+	// the fork of a detached job can be attached to a new one
+	forkJob, err := p.Attach(context.Background(), fork, JobOptions{})
+	assert(t, err == nil)
+	if err != nil {
+		return
+	}
+	defer forkJob.Detach()
+	assert(t, fork.eval(2) == nil && forkJob.Tokens() == 1 && job.Tokens() == 1)
+	assert(t, p.Stats().InUse == 1)
+	_, err = p.Attach(context.Background(), fork, JobOptions{})
+	assert(t, err != nil, "a state is attached to one job at a time")
+}
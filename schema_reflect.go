@@ -0,0 +1,241 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	timeType            = reflect.TypeOf(time.Time{})
+	rawMessageType      = reflect.TypeOf(json.RawMessage{})
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// base64Pattern matches the standard base64 encoding used by encoding/json for []byte.
+const base64Pattern = `^([A-Za-z0-9+/]{4})*([A-Za-z0-9+/]{2}==|[A-Za-z0-9+/]{3}=)?$`
+
+// SchemaFor derives a JSON schema from the Go type of v, following the encoding/json rules,
+// so that every value generated with the schema can be unmarshalled into v.
+// Fields without omitempty are required. Integers are limited to the range of their type.
+// The jsonschema tag adds constraints to a field, separated by commas:
+//
+//	Age  int    `json:"age" jsonschema:"minimum=0,maximum=150"`
+//	Unit string `json:"unit" jsonschema:"enum=celsius|fahrenheit,description=temperature unit"`
+//
+// The supported keys are description, enum, pattern, format, minLength, maxLength,
+// minimum, maximum, minItems and maxItems. A comma inside a value is escaped as \,.
+func SchemaFor(v any) (*JSONSchema, error) {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return nil, fmt.Errorf("can not derive a schema from nil")
+	}
+	return schemaForType(t, map[reflect.Type]bool{})
+}
+
+func schemaForType(t reflect.Type, visiting map[reflect.Type]bool) (*JSONSchema, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return &JSONSchema{Type: "string", Format: "date-time"}, nil
+	case t == rawMessageType:
+		return &JSONSchema{}, nil
+	case reflect.PointerTo(t).Implements(textUnmarshalerType):
+		return &JSONSchema{Type: "string"}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}, nil
+	case reflect.String:
+		return &JSONSchema{Type: "string"}, nil
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		lo, hi := -math.Pow(2, float64(t.Bits()-1)), math.Pow(2, float64(t.Bits()-1))-1
+		return &JSONSchema{Type: "integer", Minimum: &lo, Maximum: &hi}, nil
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		lo, hi := 0.0, math.Pow(2, float64(t.Bits()))-1
+		return &JSONSchema{Type: "integer", Minimum: &lo, Maximum: &hi}, nil
+	case reflect.Int, reflect.Int64:
+		return &JSONSchema{Type: "integer"}, nil
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		lo := 0.0
+		return &JSONSchema{Type: "integer", Minimum: &lo}, nil
+	case reflect.Float32, reflect.Float64:
+		return &JSONSchema{Type: "number"}, nil
+	case reflect.Interface:
+		return &JSONSchema{}, nil
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return &JSONSchema{Type: "string", Pattern: base64Pattern}, nil
+		}
+		items, err := schemaForType(t.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		schema := &JSONSchema{Type: "array", Items: items}
+		if t.Kind() == reflect.Array {
+			n := t.Len()
+			schema.MinItems, schema.MaxItems = &n, &n
+		}
+		return schema, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("map key type %s is not supported", t.Key())
+		}
+		values, err := schemaForType(t.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		return &JSONSchema{Type: "object", AdditionalProperties: values}, nil
+	case reflect.Struct:
+		if visiting[t] {
+			return nil, fmt.Errorf("recursive type %s is not supported", t)
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		schema := &JSONSchema{Type: "object", Properties: map[string]*JSONSchema{}}
+		if err := addStructFields(schema, t, visiting); err != nil {
+			return nil, err
+		}
+		return schema, nil
+	}
+	return nil, fmt.Errorf("type %s can not be represented in JSON", t)
+}
+
+// addStructFields adds the fields of a struct, the fields of embedded structs are promoted.
+func addStructFields(schema *JSONSchema, t reflect.Type, visiting map[reflect.Type]bool) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if field.Anonymous && len(name) == 0 {
+			ft := field.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if err := addStructFields(schema, ft, visiting); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+		if _, ok := schema.Properties[name]; ok {
+			continue
+		}
+
+		prop, err := schemaForType(field.Type, visiting)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		if err := applySchemaTag(prop, field.Tag.Get("jsonschema")); err != nil {
+			return fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		schema.Properties[name] = prop
+		schema.propertyOrder = append(schema.propertyOrder, name)
+		if !strings.Contains(","+opts+",", ",omitempty,") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	return nil
+}
+
+// applySchemaTag applies the constraints of a jsonschema tag.
+func applySchemaTag(schema *JSONSchema, tag string) error {
+	if len(tag) == 0 {
+		return nil
+	}
+	for _, item := range splitEscaped(tag, ',') {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid jsonschema tag %q", item)
+		}
+		switch key {
+		case "description":
+			schema.Description = value
+		case "pattern":
+			schema.Pattern = value
+		case "format":
+			schema.Format = value
+		case "enum":
+			schema.Enum = nil
+			for _, v := range strings.Split(value, "|") {
+				if schema.Type == "string" {
+					schema.Enum = append(schema.Enum, v)
+					continue
+				}
+				var parsed any
+				if err := json.Unmarshal([]byte(v), &parsed); err != nil {
+					return fmt.Errorf("invalid enum value %q", v)
+				}
+				schema.Enum = append(schema.Enum, parsed)
+			}
+		case "minimum", "maximum":
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", key, value)
+			}
+			if key == "minimum" {
+				schema.Minimum = &f
+			} else {
+				schema.Maximum = &f
+			}
+		case "minLength", "maxLength", "minItems", "maxItems":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", key, value)
+			}
+			switch key {
+			case "minLength":
+				schema.MinLength = &n
+			case "maxLength":
+				schema.MaxLength = &n
+			case "minItems":
+				schema.MinItems = &n
+			default:
+				schema.MaxItems = &n
+			}
+		default:
+			return fmt.Errorf("unknown jsonschema tag key %s", key)
+		}
+	}
+	return nil
+}
+
+// splitEscaped splits s at every sep which is not escaped with a backslash.
+func splitEscaped(s string, sep byte) []string {
+	var parts []string
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == sep:
+			sb.WriteByte(sep)
+			i++
+		case s[i] == sep:
+			parts = append(parts, sb.String())
+			sb.Reset()
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return append(parts, sb.String())
+}
@@ -0,0 +1,105 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"math"
+)
+
+// TokenScore is the log probability of a token given everything before it.
+type TokenScore struct {
+	Token   int
+	Text    string
+	Logprob float64
+	// Greedy reports whether the token is the most likely one.
+	Greedy bool
+}
+
+// ContinuationScore is the log likelihood of a continuation given the context.
+type ContinuationScore struct {
+	Continuation string
+	Tokens       []TokenScore
+	// Logprob is the sum of the token log probabilities, log P(continuation | context).
+	Logprob float64
+	// Greedy reports whether greedy sampling would have generated exactly the continuation.
+	Greedy bool
+}
+
+// Mean returns the average log probability per token, which compares continuations of different lengths.
+func (c *ContinuationScore) Mean() float64 {
+	if len(c.Tokens) == 0 {
+		return 0
+	}
+	return c.Logprob / float64(len(c.Tokens))
+}
+
+// Score computes log P(continuation | context) for every continuation, for classification or multiple choice.
+// The context is evaluated once on a fork of s, and every continuation is evaluated on its own fork
+// of the context state, so s itself is not changed.
+// Continuations are tokenized on their own, so they usually start with a space, like " yes".
+func (s *RwkvState) Score(context string, continuations []string) ([]ContinuationScore, error) {
+	base, err := s.Fork()
+	if err != nil {
+		return nil, err
+	}
+	if err := base.evalText(nil, RoleInput, context); err != nil {
+		return nil, err
+	}
+
+	scores := make([]ContinuationScore, len(continuations))
+	for i, continuation := range continuations {
+		tokens, err := s.rwkvModel.tokenizer.Encode(continuation)
+		if err != nil {
+			return nil, err
+		}
+		score := ContinuationScore{Continuation: continuation, Tokens: make([]TokenScore, len(tokens)), Greedy: true}
+		// the first token only needs the logits of the context
+		var fork *RwkvState
+		logits := base.logits
+		for j, token := range tokens {
+			if j > 0 {
+				if fork == nil {
+					if fork, err = base.Fork(); err != nil {
+						return nil, err
+					}
+				}
+				if err = fork.eval(tokens[j-1]); err != nil {
+					return nil, err
+				}
+				logits = fork.logits
+			}
+			greedy := argMax(logits) == token
+			score.Tokens[j] = TokenScore{
+				Token:   token,
+				Text:    s.rwkvModel.tokenizer.Decode([]int{token}),
+				Logprob: logSoftmax(logits, token),
+				Greedy:  greedy,
+			}
+			score.Logprob += score.Tokens[j].Logprob
+			score.Greedy = score.Greedy && greedy
+		}
+		scores[i] = score
+	}
+	return scores, nil
+}
+
+// logSoftmax returns the log probability of a token under the logits.
+func logSoftmax(logits []float32, token int) float64 {
+	return float64(logits[token]) - logSumExp(logits)
+}
+
+// logSumExp returns log(sum(exp(logits))), the normalizer of the log probabilities.
+func logSumExp(logits []float32) float64 {
+	maxVal := logits[0]
+	for _, val := range logits {
+		if val > maxVal {
+			maxVal = val
+		}
+	}
+	sum := 0.0
+	for _, val := range logits {
+		sum += math.Exp(float64(val - maxVal))
+	}
+	return float64(maxVal) + math.Log(sum)
+}
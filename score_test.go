@@ -0,0 +1,22 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLogSoftmax(t *testing.T) {
+	logits := []float32{1, 2, 3, 1000}
+	probs := softmax(append([]float32(nil), logits...))
+	sum := 0.0
+	for i := range logits {
+		p := math.Exp(logSoftmax(logits, i))
+		assert(t, math.Abs(p-float64(probs[i])) < 1e-6)
+		sum += p
+	}
+	assert(t, math.Abs(sum-1) < 1e-6)
+	assert(t, !math.IsInf(logSoftmax(logits, 0), 0), "large logits don't overflow")
+}
@@ -0,0 +1,248 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/seasonjs/rwkv"
+)
+
+// APIKey is a key accepted by the server, with the limits of its requests.
+type APIKey struct {
+	Key string `json:"key"`
+	// Name identifies the key in /v1/usage, key-1, key-2... in the order of the keys by default.
+	Name string `json:"name"`
+	// TokensPerMinute limits the tokens evaluated for the key, prompts and outputs, 0 means no limit.
+	TokensPerMinute int `json:"tokens_per_minute"`
+	// MaxConcurrent limits the requests of the key evaluated at the same time, 0 means no limit.
+	MaxConcurrent int `json:"max_concurrent"`
+	// Priority of the requests of the key on the contexts, see rwkv.JobOptions.
+	Priority int `json:"priority"`
+	// Admin keys read the usage of every key.
+	Admin bool `json:"admin"`
+}
+
+// LoadAPIKeys reads a JSON array of keys:
+//
+//	[{"key": "sk-team-a", "name": "team-a", "tokens_per_minute": 20000, "max_concurrent": 2}]
+func LoadAPIKeys(path string) ([]APIKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("invalid api keys file %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// ParseAPIKeys parses a comma separated list of keys without limits, like the value of an environment variable.
+func ParseAPIKeys(list string) []APIKey {
+	var keys []APIKey
+	for _, key := range strings.Split(list, ",") {
+		if key = strings.TrimSpace(key); len(key) > 0 {
+			keys = append(keys, APIKey{Key: key})
+		}
+	}
+	return keys
+}
+
+// client is an API key and its usage.
+type client struct {
+	key APIKey
+	// id is the hex sha256 of the key, it identifies the key in the stored sessions
+	id    string
+	limit *rwkv.RateLimit
+
+	mu       sync.Mutex
+	requests int64
+	active   int
+	usage    usage
+}
+
+type clientKey struct{}
+
+// UseAPIKeys makes the requests authenticate with one of the keys, as a bearer token of the Authorization header,
+// and serves the token usage of the keys on /v1/usage. /metrics is not authenticated.
+// The requests of a key are scheduled on the contexts with its priority and limits.
+func (s *Server) UseAPIKeys(keys ...APIKey) error {
+	if len(keys) == 0 {
+		return errors.New("no api key")
+	}
+	clients := make(map[[sha256.Size]byte]*client, len(keys))
+	for i, key := range keys {
+		if len(key.Key) == 0 {
+			return errors.New("api key can not be empty")
+		}
+		hash := sha256.Sum256([]byte(key.Key))
+		if _, ok := clients[hash]; ok {
+			return fmt.Errorf("api key %d is given twice", i+1)
+		}
+		if len(key.Name) == 0 {
+			key.Name = fmt.Sprintf("key-%d", i+1)
+		}
+		clients[hash] = &client{
+			key:   key,
+			id:    hex.EncodeToString(hash[:]),
+			limit: rwkv.NewRateLimit(key.TokensPerMinute, key.MaxConcurrent),
+		}
+	}
+	s.clients = clients
+	s.mux.HandleFunc("/v1/usage", s.handleUsage)
+	return nil
+}
+
+// Authenticate returns ctx with the client of the key, for the requests served next to the server, like over gRPC.
+// done must be called once the request is served. ok is false when the key is not valid.
+func (s *Server) Authenticate(ctx context.Context, key string) (_ context.Context, done func(), ok bool) {
+	// the keys are looked up by hash, so that the lookup time doesn't tell how much of a key is right
+	c := s.clients[sha256.Sum256([]byte(strings.TrimSpace(key)))]
+	if c == nil {
+		return ctx, nil, false
+	}
+	c.mu.Lock()
+	c.requests++
+	c.active++
+	c.mu.Unlock()
+	return context.WithValue(ctx, clientKey{}, c), func() {
+		c.mu.Lock()
+		c.active--
+		c.mu.Unlock()
+	}, true
+}
+
+// serveAuthenticated serves the request of a client, or writes the error when the key is not valid.
+func (s *Server) serveAuthenticated(w http.ResponseWriter, r *http.Request) {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	var ctx context.Context
+	var done func()
+	if ok {
+		ctx, done, ok = s.Authenticate(r.Context(), key)
+	}
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeOllamaError(w, http.StatusUnauthorized, "invalid api key")
+		} else {
+			writeError(w, http.StatusUnauthorized, "invalid_api_key", "invalid api key")
+		}
+		return
+	}
+	defer done()
+	s.mux.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// JobOptions returns the scheduling options of the client of a context returned by Authenticate.
+func (s *Server) JobOptions(ctx context.Context) rwkv.JobOptions {
+	return jobOptions(ctx)
+}
+
+// Throttle waits until the client of a context returned by Authenticate can use the tokens,
+// for the work done without a job.
+func (s *Server) Throttle(ctx context.Context, tokens int) error {
+	return throttle(ctx, tokens)
+}
+
+// Account adds the tokens of a request to the usage of the client of a context returned by Authenticate.
+func (s *Server) Account(ctx context.Context, prompt, completion int) {
+	account(ctx, prompt, completion)
+}
+
+// jobOptions returns the scheduling options of the client of ctx.
+func jobOptions(ctx context.Context) rwkv.JobOptions {
+	c, _ := ctx.Value(clientKey{}).(*client)
+	if c == nil {
+		return rwkv.JobOptions{}
+	}
+	return rwkv.JobOptions{Priority: c.key.Priority, Limit: c.limit}
+}
+
+// throttle waits until the client of ctx can use the tokens, for the work done without a job.
+func throttle(ctx context.Context, tokens int) error {
+	if c, _ := ctx.Value(clientKey{}).(*client); c != nil {
+		return c.limit.Wait(ctx, tokens)
+	}
+	return nil
+}
+
+// sessionOwner returns the owner of the sessions created by the client of ctx, empty without API keys.
+func sessionOwner(ctx context.Context) string {
+	if c, _ := ctx.Value(clientKey{}).(*client); c != nil {
+		return c.id
+	}
+	return ""
+}
+
+// account adds the tokens of a request to the usage of its client.
+func account(ctx context.Context, prompt, completion int) {
+	if c, _ := ctx.Value(clientKey{}).(*client); c != nil {
+		c.mu.Lock()
+		c.usage.add(prompt, completion)
+		c.mu.Unlock()
+	}
+}
+
+type usageList struct {
+	Object string     `json:"object"`
+	Data   []keyUsage `json:"data"`
+}
+
+type keyUsage struct {
+	Object         string `json:"object"`
+	Name           string `json:"name"`
+	Requests       int64  `json:"requests"`
+	ActiveRequests int    `json:"active_requests"`
+	usage
+	TokensPerMinute int `json:"tokens_per_minute"`
+	MaxConcurrent   int `json:"max_concurrent"`
+}
+
+func (c *client) report() keyUsage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return keyUsage{
+		Object:          "usage",
+		Name:            c.key.Name,
+		Requests:        c.requests,
+		ActiveRequests:  c.active,
+		usage:           c.usage,
+		TokensPerMinute: c.key.TokensPerMinute,
+		MaxConcurrent:   c.key.MaxConcurrent,
+	}
+}
+
+// handleUsage reports the usage of the key of the request, or of every key to an admin key.
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "", "only GET is allowed")
+		return
+	}
+	c, _ := r.Context().Value(clientKey{}).(*client)
+	if c == nil {
+		writeError(w, http.StatusUnauthorized, "invalid_api_key", "invalid api key")
+		return
+	}
+	list := usageList{Object: "list", Data: []keyUsage{c.report()}}
+	if c.key.Admin {
+		list.Data = list.Data[:0]
+		for _, other := range s.clients {
+			list.Data = append(list.Data, other.report())
+		}
+		sort.Slice(list.Data, func(i, j int) bool { return list.Data[i].Name < list.Data[j].Name })
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,101 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	data := `[{"key":"sk-a","name":"team-a","tokens_per_minute":600,"max_concurrent":2},{"key":"sk-admin","admin":true}]`
+	assert(t, os.WriteFile(path, []byte(data), 0o600) == nil)
+	keys, err := LoadAPIKeys(path)
+	assert(t, err == nil && len(keys) == 2 && keys[0].TokensPerMinute == 600 && keys[1].Admin)
+	keys = append(keys, ParseAPIKeys(" sk-b, ,sk-c")...)
+	assert(t, len(keys) == 4 && keys[2].Key == "sk-b" && keys[3].Key == "sk-c")
+
+	s, err := New(&Model{Name: "rwkv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, s.UseAPIKeys(APIKey{Key: "sk-a"}, APIKey{Key: "sk-a"}) != nil, "duplicate key")
+	assert(t, s.UseAPIKeys(keys...) == nil)
+	s.UseMetrics(NewMetrics())
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	get := func(path, key string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if len(key) > 0 {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	t.Run("authentication", func(t *testing.T) {
+		for _, tc := range []struct {
+			path, key string
+			status    int
+		}{
+			{"/v1/models", "", http.StatusUnauthorized},
+			{"/v1/models", "sk-unknown", http.StatusUnauthorized},
+			{"/api/tags", "", http.StatusUnauthorized},
+			{"/v1/models", "sk-a", http.StatusOK},
+			{"/v1/models", "sk-b", http.StatusOK},
+			{"/metrics", "", http.StatusOK},
+		} {
+			resp := get(tc.path, tc.key)
+			resp.Body.Close()
+			assert(t, resp.StatusCode == tc.status, tc.path, tc.key, resp.Status)
+		}
+	})
+
+	t.Run("usage", func(t *testing.T) {
+		c := s.clients[sha256.Sum256([]byte("sk-a"))]
+		ctx := context.WithValue(context.Background(), clientKey{}, c)
+		account(ctx, 10, 5)
+		account(context.Background(), 100, 100)
+		opts := jobOptions(ctx)
+		assert(t, opts.Limit == c.limit && opts.Limit != nil)
+
+		var list usageList
+		resp := get("/v1/usage", "sk-a")
+		assert(t, json.NewDecoder(resp.Body).Decode(&list) == nil)
+		resp.Body.Close()
+		assert(t, len(list.Data) == 1)
+		u := list.Data[0]
+		assert(t, u.Name == "team-a" && u.PromptTokens == 10 && u.CompletionTokens == 5 && u.TotalTokens == 15)
+		assert(t, u.TokensPerMinute == 600 && u.MaxConcurrent == 2 && u.ActiveRequests == 1 && u.Requests >= 2)
+
+		resp = get("/v1/usage", "sk-admin")
+		assert(t, json.NewDecoder(resp.Body).Decode(&list) == nil)
+		resp.Body.Close()
+		assert(t, len(list.Data) == 4 && list.Data[0].Name == "key-2" && list.Data[3].Name == "team-a")
+	})
+
+	t.Run("authenticate", func(t *testing.T) {
+		_, _, ok := s.Authenticate(context.Background(), "sk-unknown")
+		assert(t, !ok)
+		ctx, done, ok := s.Authenticate(context.Background(), "sk-a")
+		assert(t, ok && s.JobOptions(ctx).Limit == s.clients[sha256.Sum256([]byte("sk-a"))].limit)
+		u := s.clients[sha256.Sum256([]byte("sk-a"))].report()
+		assert(t, u.ActiveRequests == 1)
+		s.Account(ctx, 1, 2)
+		done()
+		u = s.clients[sha256.Sum256([]byte("sk-a"))].report()
+		assert(t, u.ActiveRequests == 0 && u.TotalTokens == 18)
+	})
+}
@@ -0,0 +1,204 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/seasonjs/rwkv"
+)
+
+var (
+	rateBuckets    = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000}
+	latencyBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+)
+
+// Metrics collects the measurements of the models and serves them in the Prometheus text format.
+// Set it in rwkv.RwkvOptions.Metrics of the models and give it to Server.UseMetrics.
+type Metrics struct {
+	mu                sync.Mutex
+	promptTokens      uint64
+	promptSeconds     float64
+	generatedTokens   uint64
+	generationSeconds float64
+	generations       uint64
+	promptRate        histogram
+	generationRate    histogram
+	firstToken        histogram
+	queueWait         histogram
+	errors            map[string]uint64
+}
+
+// NewMetrics returns empty metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		promptRate:     newHistogram(rateBuckets),
+		generationRate: newHistogram(rateBuckets),
+		firstToken:     newHistogram(latencyBuckets),
+		queueWait:      newHistogram(latencyBuckets),
+		errors:         make(map[string]uint64),
+	}
+}
+
+func (m *Metrics) PromptTokens(tokens int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.promptTokens += uint64(tokens)
+	m.promptSeconds += d.Seconds()
+	if d > 0 {
+		m.promptRate.observe(float64(tokens) / d.Seconds())
+	}
+}
+
+func (m *Metrics) Generation(tokens int, firstToken, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.generations++
+	m.generatedTokens += uint64(tokens)
+	m.generationSeconds += d.Seconds()
+	if tokens > 0 {
+		m.firstToken.observe(firstToken.Seconds())
+		// the rate of the generation itself, the prompt is left out
+		if gen := d - firstToken; tokens > 1 && gen > 0 {
+			m.generationRate.observe(float64(tokens-1) / gen.Seconds())
+		}
+	}
+}
+
+func (m *Metrics) QueueWait(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queueWait.observe(d.Seconds())
+}
+
+func (m *Metrics) Error(err rwkv.RwkvErrors) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, flag := range err.Flags() {
+		m.errors[flag.Error()]++
+	}
+}
+
+// UseMetrics serves the metrics and the state of the contexts and sessions on /metrics.
+func (s *Server) UseMetrics(metrics *Metrics) {
+	s.metrics = metrics
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "", "only GET is allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.write(w)
+
+	s.sessionsMu.Lock()
+	sessions := len(s.sessions)
+	s.sessionsMu.Unlock()
+	writeMetric(w, "rwkv_sessions_active", "gauge", "Sessions held in memory.", float64(sessions))
+
+	pools := make(map[string]rwkv.SchedulerStats)
+	var names []string
+	for _, name := range s.names {
+		if m := s.models[name]; m.Pool != nil {
+			pools[name] = m.Pool.Stats()
+			names = append(names, name)
+		}
+	}
+	if s.registry != nil {
+		for _, info := range s.registry.Loaded() {
+			if _, ok := pools[info.Name]; !ok && info.Scheduler.Contexts > 0 {
+				pools[info.Name] = info.Scheduler
+				names = append(names, info.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	for _, family := range []struct {
+		name, kind, help string
+		value            func(stats rwkv.SchedulerStats) float64
+	}{
+		{"rwkv_pool_contexts", "gauge", "Contexts of the pool.", func(st rwkv.SchedulerStats) float64 { return float64(st.Contexts) }},
+		{"rwkv_pool_contexts_in_use", "gauge", "Contexts used by a request.", func(st rwkv.SchedulerStats) float64 { return float64(st.InUse) }},
+		{"rwkv_pool_waiting", "gauge", "Requests waiting for a context.", func(st rwkv.SchedulerStats) float64 { return float64(st.Waiting) }},
+		{"rwkv_pool_jobs", "gauge", "Requests scheduled on the pool.", func(st rwkv.SchedulerStats) float64 { return float64(st.Jobs) }},
+		{"rwkv_pool_tokens_per_second", "gauge", "Tokens evaluated per second over the last 10 seconds.", func(st rwkv.SchedulerStats) float64 { return st.TokensPerSecond }},
+		{"rwkv_pool_tokens_total", "counter", "Tokens evaluated by the scheduled requests.", func(st rwkv.SchedulerStats) float64 { return float64(st.Tokens) }},
+		{"rwkv_pool_preemptions_total", "counter", "Contexts taken by a request of a higher priority.", func(st rwkv.SchedulerStats) float64 { return float64(st.Preemptions) }},
+		{"rwkv_pool_throttled_total", "counter", "Pauses of requests over the limits of their API key.", func(st rwkv.SchedulerStats) float64 { return float64(st.Throttled) }},
+	} {
+		if len(names) == 0 {
+			break
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s{model=%q} %g\n", family.name, name, family.value(pools[name]))
+		}
+	}
+}
+
+// write writes the collected metrics in the Prometheus text format.
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writeMetric(w, "rwkv_prompt_tokens_total", "counter", "Tokens fed into the states.", float64(m.promptTokens))
+	writeMetric(w, "rwkv_prompt_seconds_total", "counter", "Time spent feeding tokens.", m.promptSeconds)
+	writeMetric(w, "rwkv_generated_tokens_total", "counter", "Generated tokens.", float64(m.generatedTokens))
+	writeMetric(w, "rwkv_generation_seconds_total", "counter", "Time spent in generations, prompt included.", m.generationSeconds)
+	writeMetric(w, "rwkv_generations_total", "counter", "Finished generations.", float64(m.generations))
+	m.promptRate.write(w, "rwkv_prompt_tokens_per_second", "Tokens per second of the prompts.")
+	m.generationRate.write(w, "rwkv_generation_tokens_per_second", "Tokens per second of the generations, after the first token.")
+	m.firstToken.write(w, "rwkv_time_to_first_token_seconds", "Time from the start of a generation to its first token.")
+	m.queueWait.write(w, "rwkv_queue_wait_seconds", "Time waited for a context.")
+
+	flags := make([]string, 0, len(m.errors))
+	for flag := range m.errors {
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	fmt.Fprintf(w, "# HELP rwkv_errors_total Errors of rwkv.cpp by flag.\n# TYPE rwkv_errors_total counter\n")
+	for _, flag := range flags {
+		fmt.Fprintf(w, "rwkv_errors_total{flag=%q} %d\n", flag, m.errors[flag])
+	}
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) histogram {
+	return histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", name, h.count, name, h.sum, name, h.count)
+}
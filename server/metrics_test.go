@@ -0,0 +1,52 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/seasonjs/rwkv"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.PromptTokens(10, 100*time.Millisecond)
+	metrics.Generation(5, 20*time.Millisecond, 120*time.Millisecond)
+	metrics.QueueWait(time.Second)
+	metrics.Error(rwkv.RwkvErrorFile | rwkv.RwkvErrorFileOpen)
+
+	s, err := New(&Model{Name: "rwkv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UseMetrics(metrics)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	body := string(data)
+	for _, line := range []string{
+		"rwkv_prompt_tokens_total 10",
+		"rwkv_generated_tokens_total 5",
+		`rwkv_prompt_tokens_per_second_bucket{le="100"} 1`,
+		`rwkv_prompt_tokens_per_second_bucket{le="50"} 0`,
+		`rwkv_generation_tokens_per_second_bucket{le="50"} 1`,
+		`rwkv_time_to_first_token_seconds_bucket{le="0.05"} 1`,
+		"rwkv_queue_wait_seconds_count 1",
+		`rwkv_errors_total{flag="RWKV_ERROR_FILE_OPEN"} 1`,
+		"rwkv_sessions_active 0",
+	} {
+		assert(t, strings.Contains(body, line+"\n"), line)
+	}
+}
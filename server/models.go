@@ -0,0 +1,119 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/seasonjs/rwkv"
+)
+
+// DirOptions configures LoadDir.
+type DirOptions struct {
+	// Library is the path of the rwkv.cpp library, the embedded one is used when empty.
+	Library string
+	// Options of every model, the tokenizer is chosen from the file name.
+	Options rwkv.RwkvOptions
+	// PoolSize is the number of contexts of every model, 1 by default.
+	PoolSize int
+	// Threads of every context, 0 means Options.CpuThreads.
+	Threads uint32
+}
+
+// LoadDir loads every ggml .bin file of the directory, the model name is the file name without extension.
+// Files with "world" in their name use the World tokenizer and chat template, the others the
+// Normal tokenizer and the Raven chat template.
+func LoadDir(dir string, opts DirOptions) ([]*Model, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.bin"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("no .bin model in " + dir)
+	}
+	var models []*Model
+	for _, path := range paths {
+		m, err := loadFile(path, opts)
+		if err != nil {
+			for _, loaded := range models {
+				_ = loaded.Close()
+			}
+			return nil, err
+		}
+		models = append(models, m)
+	}
+	return models, nil
+}
+
+func loadFile(path string, opts DirOptions) (*Model, error) {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	options := opts.Options
+	options.TokenizerType = rwkv.Normal
+	var template rwkv.ChatTemplate = rwkv.RavenChatTemplate()
+	if strings.Contains(strings.ToLower(name), "world") {
+		options.TokenizerType = rwkv.World
+		template = rwkv.WorldChatTemplate()
+	}
+
+	var model *rwkv.RwkvModel
+	var err error
+	if len(opts.Library) > 0 {
+		model, err = rwkv.NewRwkvModel(opts.Library, options)
+	} else {
+		model, err = rwkv.NewRwkvAutoModel(options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = model.LoadFromFile(path); err != nil {
+		_ = model.Close()
+		return nil, err
+	}
+	size := opts.PoolSize
+	if size <= 0 {
+		size = 1
+	}
+	pool, err := model.NewContextPool(size, opts.Threads)
+	if err != nil {
+		_ = model.Close()
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		_ = pool.Close()
+		_ = model.Close()
+		return nil, err
+	}
+	return &Model{
+		Name:     name,
+		Pool:     pool,
+		Template: template,
+		Created:  info.ModTime(),
+		Path:     path,
+		model:    model,
+		file:     &modelFile{},
+	}, nil
+}
+
+// fileDigest returns the sha256 of the model file, it is computed on first use.
+func (m *Model) fileDigest() string {
+	m.file.once.Do(func() {
+		f, err := os.Open(m.Path)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err = io.Copy(h, f); err == nil {
+			m.file.digest = "sha256:" + hex.EncodeToString(h.Sum(nil))
+		}
+	})
+	return m.file.digest
+}
@@ -0,0 +1,435 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/seasonjs/rwkv"
+)
+
+// ollamaTag is the tag of every model, Ollama clients add it to the model names.
+const ollamaTag = ":latest"
+
+// ollamaLookup returns the model of an Ollama model name and the function releasing it, or writes the error.
+func (s *Server) ollamaLookup(w http.ResponseWriter, name string) (*Model, func()) {
+	m, release, err := s.lookup(strings.TrimSuffix(name, ollamaTag))
+	if err != nil {
+		writeOllamaError(w, http.StatusServiceUnavailable, err.Error())
+		return nil, nil
+	}
+	if m == nil {
+		writeOllamaError(w, http.StatusNotFound, "model \""+name+"\" not found")
+	}
+	return m, release
+}
+
+func writeOllamaError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, ollamaError{Error: message})
+}
+
+type ollamaError struct {
+	Error string `json:"error"`
+}
+
+// ollamaOptions are the model options of a request, the ones rwkv.cpp doesn't have are ignored.
+type ollamaOptions struct {
+	NumPredict  *int     `json:"num_predict"`
+	Temperature *float32 `json:"temperature"`
+	TopP        *float32 `json:"top_p"`
+	Stop        []string `json:"stop"`
+}
+
+// options converts the options into predict options, stop is used before the stop strings of the request.
+func (o *ollamaOptions) options(format json.RawMessage, stop ...string) ([]rwkv.PredictOption, error) {
+	params := samplingParams{Temperature: o.Temperature, TopP: o.TopP}
+	// a negative num_predict means no limit, which is the model default here
+	if o.NumPredict != nil && *o.NumPredict > 0 {
+		params.MaxTokens = o.NumPredict
+	}
+	// the options have no logit bias, so the vocabulary is not needed
+	opts, err := params.options(append(stop, o.Stop...), 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(format) > 0 && string(format) != "null" && string(format) != `""` {
+		if string(format) == `"json"` {
+			opts = append(opts, rwkv.WithConstraint(rwkv.NewJSONConstraint()))
+		} else {
+			opt, err := schemaOption(format)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, opt)
+		}
+	}
+	return opts, nil
+}
+
+// ollamaMetrics are the durations and token counts of the last response of a stream, in nanoseconds.
+type ollamaMetrics struct {
+	TotalDuration      time.Duration `json:"total_duration,omitempty"`
+	LoadDuration       time.Duration `json:"load_duration,omitempty"`
+	PromptEvalCount    int           `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int           `json:"eval_count,omitempty"`
+	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
+}
+
+// ollamaRun is a generation of /api/generate or /api/chat.
+type ollamaRun struct {
+	model *Model
+	// tokens are evaluated before the prompt, the context of a previous /api/generate response
+	tokens []int
+	prompt string
+	stops  []string
+	trim   bool
+	opts   []rwkv.PredictOption
+}
+
+// run evaluates the prompt on a context of the pool and streams the generated text to send.
+// It returns the generation, all the evaluated tokens and the metrics.
+func (run *ollamaRun) run(ctx context.Context, send func(text string) bool) (*rwkv.Generation, []int, ollamaMetrics, error) {
+	var metrics ollamaMetrics
+	start := time.Now()
+	promptTokens, err := run.model.Pool.Model().Tokenize(run.prompt)
+	if err != nil {
+		return nil, nil, metrics, err
+	}
+	tokens := append(append([]int(nil), run.tokens...), promptTokens...)
+
+	state, done, err := run.model.newState(ctx)
+	if err != nil {
+		return nil, nil, metrics, err
+	}
+	defer done()
+	metrics.LoadDuration = time.Since(start)
+
+	evalStart := time.Now()
+	if err = state.FeedTokens(tokens); err != nil {
+		return nil, nil, metrics, err
+	}
+	metrics.PromptEvalCount = len(tokens)
+	metrics.PromptEvalDuration = time.Since(evalStart)
+
+	genStart := time.Now()
+	filter := &stopFilter{stops: run.stops, trim: run.trim}
+	gen, err := state.GenerateStream("", func(text string) bool {
+		text = filter.push(text)
+		return ctx.Err() == nil && (len(text) == 0 || send(text))
+	}, run.opts...)
+	if err != nil {
+		return nil, nil, metrics, err
+	}
+	if text := filter.flush(gen.Text); len(text) > 0 {
+		send(text)
+	}
+	account(ctx, len(tokens), len(gen.Tokens))
+	metrics.EvalCount = len(gen.Tokens)
+	metrics.EvalDuration = time.Since(genStart)
+	metrics.TotalDuration = time.Since(start)
+	return gen, append(tokens, gen.Tokens...), metrics, nil
+}
+
+// serve runs the generation and writes the responses, one per chunk of text and a last one with done set
+// when streaming, or only the last one with the whole text.
+// chunk builds a response from a piece of text, last completes the final response.
+func (run *ollamaRun) serve(w http.ResponseWriter, r *http.Request, stream bool, chunk func(text string) any, last func(text string, gen *rwkv.Generation, tokens []int, metrics ollamaMetrics) any) {
+	if !stream {
+		var sb strings.Builder
+		gen, tokens, metrics, err := run.run(r.Context(), func(text string) bool {
+			sb.WriteString(text)
+			return true
+		})
+		if err != nil {
+			writeOllamaError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, last(sb.String(), gen, tokens, metrics))
+		return
+	}
+
+	out := newNDJSONStream(w)
+	gen, tokens, metrics, err := run.run(r.Context(), func(text string) bool {
+		return out.send(chunk(text))
+	})
+	if err != nil {
+		out.send(ollamaError{Error: err.Error()})
+		return
+	}
+	out.send(last("", gen, tokens, metrics))
+}
+
+// ndjsonStream writes one JSON value per line.
+type ndjsonStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newNDJSONStream(w http.ResponseWriter) *ndjsonStream {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	return &ndjsonStream{w: w, flusher: flusher}
+}
+
+// send writes v as a line, it returns false once the client is gone.
+func (s *ndjsonStream) send(v any) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return false
+	}
+	if _, err = s.w.Write(append(data, '\n')); err != nil {
+		return false
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return true
+}
+
+// streaming reports whether a request streams, which is the default of the Ollama API.
+func streaming(stream *bool) bool {
+	return stream == nil || *stream
+}
+
+type generateRequest struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+	System string `json:"system"`
+	// Context continues the conversation of a previous response.
+	Context []int `json:"context"`
+	// Raw feeds the prompt without the chat template.
+	Raw     bool            `json:"raw"`
+	Format  json.RawMessage `json:"format"`
+	Stream  *bool           `json:"stream"`
+	Options ollamaOptions   `json:"options"`
+}
+
+type generateResponse struct {
+	Model      string    `json:"model"`
+	CreatedAt  time.Time `json:"created_at"`
+	Response   string    `json:"response"`
+	Done       bool      `json:"done"`
+	DoneReason string    `json:"done_reason,omitempty"`
+	Context    []int     `json:"context,omitempty"`
+	ollamaMetrics
+}
+
+func (s *Server) handleGenerate(w http.ResponseWriter, r *http.Request) {
+	var req generateRequest
+	if !decodeOllama(w, r, &req) {
+		return
+	}
+	m, release := s.ollamaLookup(w, req.Model)
+	if m == nil {
+		return
+	}
+	defer release()
+	// an empty request only loads the model, which is always loaded here
+	if len(req.Prompt) == 0 && len(req.Context) == 0 {
+		writeJSON(w, http.StatusOK, generateResponse{Model: req.Model, CreatedAt: time.Now(), Done: true, DoneReason: "load"})
+		return
+	}
+
+	run := &ollamaRun{model: m, tokens: req.Context, prompt: req.Prompt}
+	var stops []string
+	if req.Raw {
+		if len(req.Options.Stop) == 0 {
+			stops = []string{m.Pool.Model().Options().StopString}
+		}
+	} else {
+		var sb strings.Builder
+		if len(req.System) > 0 {
+			sb.WriteString(m.Template.Format(rwkv.ChatMessage{Role: rwkv.ChatRoleSystem, Content: req.System}))
+		}
+		sb.WriteString(m.Template.Format(rwkv.ChatMessage{Role: rwkv.ChatRoleUser, Content: req.Prompt}))
+		sb.WriteString(m.Template.Prefix(rwkv.ChatRoleAssistant))
+		run.prompt = sb.String()
+		run.trim = true
+		stops = []string{m.Template.Separator()}
+	}
+	opts, err := req.Options.options(req.Format, stops...)
+	if err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	run.opts = opts
+	run.stops = append(stops, req.Options.Stop...)
+
+	run.serve(w, r, streaming(req.Stream), func(text string) any {
+		return generateResponse{Model: req.Model, CreatedAt: time.Now(), Response: text}
+	}, func(text string, gen *rwkv.Generation, tokens []int, metrics ollamaMetrics) any {
+		return generateResponse{
+			Model:         req.Model,
+			CreatedAt:     time.Now(),
+			Response:      text,
+			Done:          true,
+			DoneReason:    string(gen.FinishReason),
+			Context:       tokens,
+			ollamaMetrics: metrics,
+		}
+	})
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []chatMessage   `json:"messages"`
+	Format   json.RawMessage `json:"format"`
+	Stream   *bool           `json:"stream"`
+	Options  ollamaOptions   `json:"options"`
+}
+
+type ollamaChatResponse struct {
+	Model      string    `json:"model"`
+	CreatedAt  time.Time `json:"created_at"`
+	Message    chatReply `json:"message"`
+	Done       bool      `json:"done"`
+	DoneReason string    `json:"done_reason,omitempty"`
+	ollamaMetrics
+}
+
+func (s *Server) handleChat(w http.ResponseWriter, r *http.Request) {
+	var req ollamaChatRequest
+	if !decodeOllama(w, r, &req) {
+		return
+	}
+	m, release := s.ollamaLookup(w, req.Model)
+	if m == nil {
+		return
+	}
+	defer release()
+	prompt, err := chatPrompt(m.Template, req.Messages)
+	if err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	stops := []string{m.Template.Separator()}
+	opts, err := req.Options.options(req.Format, stops...)
+	if err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	run := &ollamaRun{model: m, prompt: prompt, stops: append(stops, req.Options.Stop...), trim: true, opts: opts}
+	run.serve(w, r, streaming(req.Stream), func(text string) any {
+		return ollamaChatResponse{Model: req.Model, CreatedAt: time.Now(), Message: chatReply{Role: "assistant", Content: text}}
+	}, func(text string, gen *rwkv.Generation, tokens []int, metrics ollamaMetrics) any {
+		return ollamaChatResponse{
+			Model:         req.Model,
+			CreatedAt:     time.Now(),
+			Message:       chatReply{Role: "assistant", Content: text},
+			Done:          true,
+			DoneReason:    string(gen.FinishReason),
+			ollamaMetrics: metrics,
+		}
+	})
+}
+
+type ollamaEmbeddingRequest struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+}
+
+type ollamaEmbeddingResponse struct {
+	Embedding []float32 `json:"embedding"`
+}
+
+func (s *Server) handleOllamaEmbeddings(w http.ResponseWriter, r *http.Request) {
+	var req ollamaEmbeddingRequest
+	if !decodeOllama(w, r, &req) {
+		return
+	}
+	m, release := s.ollamaLookup(w, req.Model)
+	if m == nil {
+		return
+	}
+	defer release()
+	emb, err := m.Pool.Embed(r.Context(), req.Prompt, m.Embed)
+	if err != nil {
+		writeOllamaError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, ollamaEmbeddingResponse{Embedding: emb})
+}
+
+type tagList struct {
+	Models []tagInfo `json:"models"`
+}
+
+type tagInfo struct {
+	Name       string     `json:"name"`
+	Model      string     `json:"model"`
+	ModifiedAt time.Time  `json:"modified_at"`
+	Size       int64      `json:"size"`
+	Digest     string     `json:"digest"`
+	Details    tagDetails `json:"details"`
+}
+
+type tagDetails struct {
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+var (
+	parameterSize     = regexp.MustCompile(`(?i)(?:^|[-_.])(\d+(?:\.\d+)?[bm])(?:$|[-_.])`)
+	quantizationLevel = regexp.MustCompile(`(?i)(?:^|[-_.])(q[458]_[01]|fp?16|fp?32)(?:$|[-_.])`)
+)
+
+func (m *Model) tag() tagInfo {
+	info := tagInfo{
+		Name:       m.Name + ollamaTag,
+		Model:      m.Name + ollamaTag,
+		ModifiedAt: m.Created,
+		Details:    tagDetails{Format: "ggml", Family: "rwkv", Families: []string{"rwkv"}},
+	}
+	if match := parameterSize.FindStringSubmatch(m.Name); match != nil {
+		info.Details.ParameterSize = strings.ToUpper(match[1])
+	}
+	if match := quantizationLevel.FindStringSubmatch(m.Name); match != nil {
+		info.Details.QuantizationLevel = strings.ToUpper(match[1])
+	}
+	if len(m.Path) > 0 {
+		if stat, err := os.Stat(m.Path); err == nil {
+			info.Size = stat.Size()
+		}
+		info.Digest = m.fileDigest()
+	}
+	return info
+}
+
+func (s *Server) handleTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeOllamaError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+		return
+	}
+	list := tagList{Models: []tagInfo{}}
+	for _, m := range s.list() {
+		list.Models = append(list.Models, m.tag())
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// decodeOllama reads the JSON body of a POST request, or writes the error.
+func decodeOllama(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeOllamaError(w, http.StatusMethodNotAllowed, "only POST is allowed")
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,792 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/seasonjs/rwkv"
+)
+
+// stringList is a string or an array of strings.
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*l = stringList{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("must be a string or an array of strings")
+	}
+	*l = list
+	return nil
+}
+
+// samplingParams are the generation parameters shared by completions and chat completions.
+type samplingParams struct {
+	MaxTokens   *int               `json:"max_tokens"`
+	Temperature *float32           `json:"temperature"`
+	TopP        *float32           `json:"top_p"`
+	Stop        stringList         `json:"stop"`
+	N           *int               `json:"n"`
+	LogitBias   map[string]float32 `json:"logit_bias"`
+	Stream      bool               `json:"stream"`
+	// StreamOptions.IncludeUsage sends the usage in a last chunk without choices.
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+}
+
+// options converts the parameters into predict options, stop replaces the default stop strings when not empty.
+// The tokens of logit_bias must be in the vocabulary of vocab tokens.
+func (p *samplingParams) options(stop []string, vocab int) ([]rwkv.PredictOption, error) {
+	var opts []rwkv.PredictOption
+	if p.MaxTokens != nil {
+		if *p.MaxTokens <= 0 {
+			return nil, errors.New("max_tokens must be positive")
+		}
+		opts = append(opts, rwkv.WithMaxTokens(*p.MaxTokens))
+	}
+	if p.Temperature != nil {
+		if *p.Temperature < 0 || *p.Temperature > 2 {
+			return nil, errors.New("temperature must be between 0 and 2")
+		}
+		opts = append(opts, rwkv.WithTemperature(*p.Temperature))
+	}
+	if p.TopP != nil {
+		if *p.TopP <= 0 || *p.TopP > 1 {
+			return nil, errors.New("top_p must be in (0, 1]")
+		}
+		opts = append(opts, rwkv.WithTopP(*p.TopP))
+	}
+	if len(stop) > 0 {
+		opts = append(opts, rwkv.WithStopStrings(stop...))
+	}
+	if len(p.LogitBias) > 0 {
+		bias := make(map[int]float32, len(p.LogitBias))
+		for key, value := range p.LogitBias {
+			token, err := strconv.Atoi(key)
+			if err != nil {
+				return nil, fmt.Errorf("logit_bias key %q is not a token id", key)
+			}
+			if token < 0 || token >= vocab {
+				return nil, fmt.Errorf("logit_bias token %d is out of the vocabulary of %d tokens", token, vocab)
+			}
+			bias[token] = value
+		}
+		opts = append(opts, rwkv.WithLogitBias(bias))
+	}
+	return opts, nil
+}
+
+func (p *samplingParams) n() (int, error) {
+	if p.N == nil {
+		return 1, nil
+	}
+	if *p.N <= 0 {
+		return 0, errors.New("n must be positive")
+	}
+	if p.Stream && *p.N > 1 {
+		return 0, errors.New("n must be 1 when streaming")
+	}
+	return *p.N, nil
+}
+
+func (p *samplingParams) includeUsage() bool {
+	return p.StreamOptions != nil && p.StreamOptions.IncludeUsage
+}
+
+type usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func (u *usage) add(prompt, completion int) {
+	u.PromptTokens += prompt
+	u.CompletionTokens += completion
+	u.TotalTokens += prompt + completion
+}
+
+type completionRequest struct {
+	Model  string     `json:"model"`
+	Prompt stringList `json:"prompt"`
+	Echo   bool       `json:"echo"`
+	// Logprobs is the number of alternatives returned with every token.
+	Logprobs *int `json:"logprobs"`
+	samplingParams
+}
+
+type completionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []completionChoice `json:"choices"`
+	Usage   *usage             `json:"usage,omitempty"`
+}
+
+type completionChoice struct {
+	Text         string              `json:"text"`
+	Index        int                 `json:"index"`
+	Logprobs     *completionLogprobs `json:"logprobs"`
+	FinishReason *string             `json:"finish_reason"`
+}
+
+// completionLogprobs is the logprobs format of the completions API.
+type completionLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float64            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float64 `json:"top_logprobs"`
+	TextOffset    []int                `json:"text_offset"`
+}
+
+func newCompletionLogprobs(logprobs []rwkv.TokenLogprob, offset int) *completionLogprobs {
+	lp := &completionLogprobs{}
+	for _, token := range logprobs {
+		top := make(map[string]float64, len(token.TopLogprobs))
+		for _, alt := range token.TopLogprobs {
+			top[alt.Text] = alt.Logprob
+		}
+		lp.Tokens = append(lp.Tokens, token.Text)
+		lp.TokenLogprobs = append(lp.TokenLogprobs, token.Logprob)
+		lp.TopLogprobs = append(lp.TopLogprobs, top)
+		lp.TextOffset = append(lp.TextOffset, offset)
+		offset += len(token.Text)
+	}
+	return lp
+}
+
+func (s *Server) handleCompletions(w http.ResponseWriter, r *http.Request) {
+	var req completionRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	m, release := s.model(w, req.Model)
+	if m == nil {
+		return
+	}
+	defer release()
+	if len(req.Prompt) == 0 {
+		writeError(w, http.StatusBadRequest, "", "prompt is required")
+		return
+	}
+	n, err := req.n()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	if req.Stream && len(req.Prompt) > 1 {
+		writeError(w, http.StatusBadRequest, "", "only one prompt can be streamed")
+		return
+	}
+	opts, err := req.options(req.Stop, m.vocabSize())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	if req.Logprobs != nil {
+		if *req.Logprobs < 0 {
+			writeError(w, http.StatusBadRequest, "", "logprobs can not be negative")
+			return
+		}
+		opts = append(opts, rwkv.WithLogprobs(*req.Logprobs))
+	}
+
+	resp := completionResponse{
+		ID:      newID("cmpl-"),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   m.Name,
+	}
+	if req.Stream {
+		s.streamCompletion(w, r, m, &req, resp, opts)
+		return
+	}
+	resp.Usage = &usage{}
+	for i, prompt := range req.Prompt {
+		gens, err := m.predictN(r.Context(), prompt, n, opts)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		promptTokens, err := m.Pool.Model().Tokenize(prompt)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		for j, gen := range gens {
+			choice := completionChoice{Text: gen.Text, Index: i*n + j, FinishReason: finishReason(gen)}
+			if req.Echo {
+				choice.Text = prompt + choice.Text
+			}
+			if req.Logprobs != nil {
+				offset := 0
+				if req.Echo {
+					offset = len(prompt)
+				}
+				choice.Logprobs = newCompletionLogprobs(gen.Logprobs, offset)
+			}
+			resp.Choices = append(resp.Choices, choice)
+			resp.Usage.add(0, len(gen.Tokens))
+		}
+		resp.Usage.add(len(promptTokens), 0)
+	}
+	account(r.Context(), resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// predictN returns n completions of the prompt from a new state.
+func (m *Model) predictN(ctx context.Context, prompt string, n int, opts []rwkv.PredictOption) ([]*rwkv.Generation, error) {
+	state, done, err := m.newState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return state.PredictN(prompt, n, opts...)
+}
+
+func (s *Server) streamCompletion(w http.ResponseWriter, r *http.Request, m *Model, req *completionRequest, resp completionResponse, opts []rwkv.PredictOption) {
+	prompt := req.Prompt[0]
+	stops := req.Stop
+	if len(stops) == 0 {
+		stops = []string{m.Pool.Model().Options().StopString}
+	}
+	state, done, err := m.newState(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	defer done()
+	stream := newEventStream(w)
+	chunk := func(text string, lp *completionLogprobs, finish *string) completionResponse {
+		resp.Choices = []completionChoice{{Text: text, Logprobs: lp, FinishReason: finish}}
+		return resp
+	}
+	if req.Echo && !stream.send(chunk(prompt, nil, nil)) {
+		return
+	}
+	filter := &stopFilter{stops: stops}
+	gen, err := state.GenerateStream(prompt, func(text string) bool {
+		if r.Context().Err() != nil {
+			return false
+		}
+		if text = filter.push(text); len(text) == 0 {
+			return true
+		}
+		return stream.send(chunk(text, nil, nil))
+	}, opts...)
+	if err != nil {
+		stream.send(apiError{Error: apiErrorBody{Message: err.Error(), Type: "server_error"}})
+		return
+	}
+	promptTokens, err := m.Pool.Model().Tokenize(prompt)
+	if err == nil {
+		account(r.Context(), len(promptTokens), len(gen.Tokens))
+	}
+	var lp *completionLogprobs
+	if req.Logprobs != nil {
+		lp = newCompletionLogprobs(gen.Logprobs, 0)
+	}
+	if !stream.send(chunk(filter.flush(gen.Text), lp, finishReason(gen))) {
+		return
+	}
+	if req.includeUsage() && err == nil {
+		resp.Choices = []completionChoice{}
+		resp.Usage = &usage{}
+		resp.Usage.add(len(promptTokens), len(gen.Tokens))
+		stream.send(resp)
+	}
+	stream.done()
+}
+
+func finishReason(gen *rwkv.Generation) *string {
+	reason := string(gen.FinishReason)
+	return &reason
+}
+
+// stopFilter holds back the streamed text which may be the start of a stop string,
+// so that a stream never shows a stop string.
+type stopFilter struct {
+	stops []string
+	// trim drops the spaces around the text, like rwkv.Chat does with its replies
+	trim    bool
+	text    string
+	sent    int
+	started bool
+}
+
+// push adds a chunk of generated text and returns the text which can be sent.
+func (f *stopFilter) push(chunk string) string {
+	f.text += chunk
+	end := len(f.text)
+	for _, stop := range f.stops {
+		if len(stop) == 0 {
+			continue
+		}
+		if i := strings.Index(f.text, stop); i >= 0 {
+			end = min(end, i)
+			continue
+		}
+		for k := min(len(stop)-1, len(f.text)); k > 0; k-- {
+			if strings.HasSuffix(f.text, stop[:k]) {
+				end = min(end, len(f.text)-k)
+				break
+			}
+		}
+	}
+	if end <= f.sent {
+		return ""
+	}
+	out := f.text[f.sent:end]
+	f.sent = end
+	return f.trimStart(out)
+}
+
+// flush returns the rest of the final text which has not been sent.
+func (f *stopFilter) flush(final string) string {
+	if len(final) <= f.sent {
+		return ""
+	}
+	out := f.trimStart(final[f.sent:])
+	f.sent = len(final)
+	if f.trim {
+		out = strings.TrimRight(out, " \t\r\n")
+	}
+	return out
+}
+
+func (f *stopFilter) trimStart(out string) string {
+	if f.trim && !f.started {
+		out = strings.TrimLeft(out, " \t\r\n")
+		f.started = len(out) > 0
+	}
+	return out
+}
+
+// chatContent is a string or an array of text parts.
+type chatContent string
+
+func (c *chatContent) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*c = chatContent(s)
+		return nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return errors.New("content must be a string or an array of parts")
+	}
+	var sb strings.Builder
+	for _, part := range parts {
+		if part.Type != "text" {
+			return fmt.Errorf("content part of type %q is not supported", part.Type)
+		}
+		sb.WriteString(part.Text)
+	}
+	*c = chatContent(sb.String())
+	return nil
+}
+
+type chatMessage struct {
+	Role    string      `json:"role"`
+	Content chatContent `json:"content"`
+}
+
+var chatRoles = map[string]rwkv.ChatRole{
+	"system":    rwkv.ChatRoleSystem,
+	"developer": rwkv.ChatRoleSystem,
+	"user":      rwkv.ChatRoleUser,
+	"assistant": rwkv.ChatRoleAssistant,
+	"tool":      rwkv.ChatRoleTool,
+}
+
+type responseFormat struct {
+	Type       string `json:"type"`
+	JSONSchema *struct {
+		Name   string          `json:"name"`
+		Schema json.RawMessage `json:"schema"`
+	} `json:"json_schema"`
+}
+
+// option returns the constraint of the response format, nil for plain text.
+func (f *responseFormat) option() (rwkv.PredictOption, error) {
+	switch f.Type {
+	case "", "text":
+		return nil, nil
+	case "json_object":
+		return rwkv.WithConstraint(rwkv.NewJSONConstraint()), nil
+	case "json_schema":
+		if f.JSONSchema == nil || len(f.JSONSchema.Schema) == 0 {
+			return nil, errors.New("response_format.json_schema.schema is required")
+		}
+		return schemaOption(f.JSONSchema.Schema)
+	}
+	return nil, fmt.Errorf("response_format type %q is not supported", f.Type)
+}
+
+// schemaOption compiles a JSON schema into a grammar constraint.
+func schemaOption(data json.RawMessage) (rwkv.PredictOption, error) {
+	var schema rwkv.JSONSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("invalid json schema: %w", err)
+	}
+	g, err := rwkv.CompileSchema(&schema)
+	if err != nil {
+		return nil, err
+	}
+	return rwkv.WithGrammar(g), nil
+}
+
+type chatRequest struct {
+	Model               string          `json:"model"`
+	Messages            []chatMessage   `json:"messages"`
+	MaxCompletionTokens *int            `json:"max_completion_tokens"`
+	Logprobs            bool            `json:"logprobs"`
+	TopLogprobs         int             `json:"top_logprobs"`
+	ResponseFormat      *responseFormat `json:"response_format"`
+	samplingParams
+}
+
+type chatResponse struct {
+	ID      string       `json:"id"`
+	Object  string       `json:"object"`
+	Created int64        `json:"created"`
+	Model   string       `json:"model"`
+	Choices []chatChoice `json:"choices"`
+	Usage   *usage       `json:"usage,omitempty"`
+}
+
+type chatChoice struct {
+	Index        int           `json:"index"`
+	Message      *chatReply    `json:"message,omitempty"`
+	Delta        *chatReply    `json:"delta,omitempty"`
+	Logprobs     *chatLogprobs `json:"logprobs"`
+	FinishReason *string       `json:"finish_reason"`
+}
+
+type chatReply struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content"`
+}
+
+type chatLogprobs struct {
+	Content []chatTokenLogprob `json:"content"`
+}
+
+type chatTokenLogprob struct {
+	Token       string             `json:"token"`
+	Logprob     float64            `json:"logprob"`
+	Bytes       []int              `json:"bytes"`
+	TopLogprobs []chatTokenLogprob `json:"top_logprobs,omitempty"`
+}
+
+func newChatLogprobs(logprobs []rwkv.TokenLogprob) *chatLogprobs {
+	lp := &chatLogprobs{Content: []chatTokenLogprob{}}
+	for _, token := range logprobs {
+		entry := chatTokenLogprob{Token: token.Text, Logprob: token.Logprob, Bytes: byteInts(token.Bytes)}
+		for _, alt := range token.TopLogprobs {
+			entry.TopLogprobs = append(entry.TopLogprobs, chatTokenLogprob{Token: alt.Text, Logprob: alt.Logprob, Bytes: byteInts([]byte(alt.Text))})
+		}
+		lp.Content = append(lp.Content, entry)
+	}
+	return lp
+}
+
+func byteInts(b []byte) []int {
+	ints := make([]int, len(b))
+	for i, v := range b {
+		ints[i] = int(v)
+	}
+	return ints
+}
+
+// chatPrompt renders the messages and starts the assistant reply.
+func chatPrompt(template rwkv.ChatTemplate, messages []chatMessage) (string, error) {
+	if len(messages) == 0 {
+		return "", errors.New("messages can not be empty")
+	}
+	var sb strings.Builder
+	for _, msg := range messages {
+		role, ok := chatRoles[msg.Role]
+		if !ok {
+			return "", fmt.Errorf("message role %q is not supported", msg.Role)
+		}
+		sb.WriteString(template.Format(rwkv.ChatMessage{Role: role, Content: string(msg.Content)}))
+	}
+	sb.WriteString(template.Prefix(rwkv.ChatRoleAssistant))
+	return sb.String(), nil
+}
+
+// chatOptions returns the stop strings and the options of a chat request, the message separator stops the reply.
+func (req *chatRequest) chatOptions(m *Model) ([]string, []rwkv.PredictOption, error) {
+	if req.MaxCompletionTokens != nil {
+		req.MaxTokens = req.MaxCompletionTokens
+	}
+	stops := append([]string{m.Template.Separator()}, req.Stop...)
+	opts, err := req.options(stops, m.vocabSize())
+	if err != nil {
+		return nil, nil, err
+	}
+	if req.Logprobs {
+		opts = append(opts, rwkv.WithLogprobs(req.TopLogprobs))
+	}
+	if req.ResponseFormat != nil {
+		opt, err := req.ResponseFormat.option()
+		if err != nil {
+			return nil, nil, err
+		}
+		if opt != nil {
+			opts = append(opts, opt)
+		}
+	}
+	return stops, opts, nil
+}
+
+func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	var req chatRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	m, release := s.model(w, req.Model)
+	if m == nil {
+		return
+	}
+	defer release()
+	prompt, err := chatPrompt(m.Template, req.Messages)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	n, err := req.n()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	stops, opts, err := req.chatOptions(m)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	promptTokens, err := m.Pool.Model().Tokenize(prompt)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	state, done, err := m.newState(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	defer done()
+
+	resp := chatResponse{
+		ID:      newID("chatcmpl-"),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   m.Name,
+	}
+	if req.Stream {
+		resp.Object = "chat.completion.chunk"
+		s.streamChat(w, r, state, &req, resp, prompt, len(promptTokens), stops, opts)
+		return
+	}
+	gens, err := state.PredictN(prompt, n, opts...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	resp.Usage = &usage{}
+	resp.Usage.add(len(promptTokens), 0)
+	for i, gen := range gens {
+		choice := chatChoice{
+			Index:        i,
+			Message:      &chatReply{Role: "assistant", Content: strings.TrimSpace(gen.Text)},
+			FinishReason: finishReason(gen),
+		}
+		if req.Logprobs {
+			choice.Logprobs = newChatLogprobs(gen.Logprobs)
+		}
+		resp.Choices = append(resp.Choices, choice)
+		resp.Usage.add(0, len(gen.Tokens))
+	}
+	account(r.Context(), resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// streamChat streams the reply to the prompt, it returns the generation or nil when it failed.
+func (s *Server) streamChat(w http.ResponseWriter, r *http.Request, state *rwkv.RwkvState, req *chatRequest, resp chatResponse, prompt string, promptTokens int, stops []string, opts []rwkv.PredictOption) *rwkv.Generation {
+	stream := newEventStream(w)
+	chunk := func(delta chatReply, lp *chatLogprobs, finish *string) chatResponse {
+		resp.Choices = []chatChoice{{Delta: &delta, Logprobs: lp, FinishReason: finish}}
+		return resp
+	}
+	if !stream.send(chunk(chatReply{Role: "assistant"}, nil, nil)) {
+		return nil
+	}
+	filter := &stopFilter{stops: stops, trim: true}
+	send := func(text string) bool {
+		return len(text) == 0 || stream.send(chunk(chatReply{Content: text}, nil, nil))
+	}
+	gen, err := state.GenerateStream(prompt, func(text string) bool {
+		return r.Context().Err() == nil && send(filter.push(text))
+	}, opts...)
+	if err != nil {
+		stream.send(apiError{Error: apiErrorBody{Message: err.Error(), Type: "server_error"}})
+		return nil
+	}
+	account(r.Context(), promptTokens, len(gen.Tokens))
+	if !send(filter.flush(gen.Text)) {
+		return gen
+	}
+	var lp *chatLogprobs
+	if req.Logprobs {
+		lp = newChatLogprobs(gen.Logprobs)
+	}
+	if !stream.send(chunk(chatReply{}, lp, finishReason(gen))) {
+		return gen
+	}
+	if req.includeUsage() {
+		resp.Choices = []chatChoice{}
+		resp.Usage = &usage{}
+		resp.Usage.add(promptTokens, len(gen.Tokens))
+		stream.send(resp)
+	}
+	stream.done()
+	return gen
+}
+
+type embeddingRequest struct {
+	Model          string     `json:"model"`
+	Input          stringList `json:"input"`
+	EncodingFormat string     `json:"encoding_format"`
+}
+
+type embeddingResponse struct {
+	Object string      `json:"object"`
+	Data   []embedding `json:"data"`
+	Model  string      `json:"model"`
+	Usage  usage       `json:"usage"`
+}
+
+type embedding struct {
+	Object string `json:"object"`
+	Index  int    `json:"index"`
+	// Embedding is a []float32, or a base64 string of little endian float32 values.
+	Embedding any `json:"embedding"`
+}
+
+func (s *Server) handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	var req embeddingRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	m, release := s.model(w, req.Model)
+	if m == nil {
+		return
+	}
+	defer release()
+	if len(req.Input) == 0 {
+		writeError(w, http.StatusBadRequest, "", "input is required")
+		return
+	}
+	if req.EncodingFormat != "" && req.EncodingFormat != "float" && req.EncodingFormat != "base64" {
+		writeError(w, http.StatusBadRequest, "", fmt.Sprintf("encoding_format %q is not supported", req.EncodingFormat))
+		return
+	}
+	resp := embeddingResponse{Object: "list", Model: m.Name}
+	for i, input := range req.Input {
+		tokens, err := m.Pool.Model().Tokenize(input)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		if err = throttle(r.Context(), len(tokens)); err != nil {
+			writeError(w, http.StatusServiceUnavailable, "", err.Error())
+			return
+		}
+		emb, err := m.Pool.Embed(r.Context(), input, m.Embed)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		data := embedding{Object: "embedding", Index: i, Embedding: emb}
+		if req.EncodingFormat == "base64" {
+			data.Embedding = encodeFloats(emb)
+		}
+		resp.Data = append(resp.Data, data)
+		resp.Usage.add(len(tokens), 0)
+	}
+	account(r.Context(), resp.Usage.PromptTokens, 0)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func encodeFloats(values []float32) string {
+	b := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(v))
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+type modelList struct {
+	Object string      `json:"object"`
+	Data   []modelInfo `json:"data"`
+}
+
+type modelInfo struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+func (m *Model) info() modelInfo {
+	return modelInfo{ID: m.Name, Object: "model", Created: m.Created.Unix(), OwnedBy: "rwkv"}
+}
+
+func (s *Server) handleModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "", "only GET is allowed")
+		return
+	}
+	list := modelList{Object: "list", Data: []modelInfo{}}
+	for _, m := range s.list() {
+		list.Data = append(list.Data, m.info())
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleModel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "", "only GET is allowed")
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/v1/models/")
+	m := s.info(name)
+	if m == nil {
+		writeError(w, http.StatusNotFound, "model_not_found", fmt.Sprintf("the model %q does not exist", name))
+		return
+	}
+	writeJSON(w, http.StatusOK, m.info())
+}
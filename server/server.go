@@ -0,0 +1,354 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+// Package server exposes RWKV models over HTTP with the request and response schemas of the OpenAI API
+// and of the Ollama API, so that existing clients can talk to a local model.
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/seasonjs/rwkv"
+)
+
+// Model is a model served under a name.
+type Model struct {
+	// Name is the model id of the requests.
+	Name string
+	// Pool holds the contexts the requests are evaluated on, one per concurrent request.
+	Pool *rwkv.ContextPool
+	// Template renders the messages of chat completions, rwkv.WorldChatTemplate by default.
+	Template rwkv.ChatTemplate
+	// Embed configures the embeddings.
+	Embed rwkv.EmbedOptions
+	// Created is reported by /v1/models.
+	Created time.Time
+	// Path is the model file, reported by /api/tags with its size and digest.
+	Path string
+
+	// model is closed with the pool when the model has been loaded by LoadDir
+	model *rwkv.RwkvModel
+	file  *modelFile
+}
+
+// newState returns a new state of the model, evaluated on the contexts of the pool with the other
+// requests, see rwkv.ContextPool.Attach. done must be called once the state is not evaluated anymore.
+func (m *Model) newState(ctx context.Context) (state *rwkv.RwkvState, done func(), err error) {
+	state, err = m.Pool.Model().InitState()
+	if err != nil {
+		return nil, nil, err
+	}
+	done, err = m.attach(ctx, state)
+	if err != nil {
+		return nil, nil, err
+	}
+	return state, done, nil
+}
+
+// attach schedules the evaluation of the state on the contexts of the pool,
+// with the priority and limits of the API key of ctx.
+func (m *Model) attach(ctx context.Context, state *rwkv.RwkvState) (func(), error) {
+	job, err := m.Pool.Attach(ctx, state, jobOptions(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return job.Detach, nil
+}
+
+// vocabSize returns the number of tokens of the vocabulary of the model, 0 when it has no contexts.
+func (m *Model) vocabSize() int {
+	if m.Pool == nil {
+		return 0
+	}
+	return m.Pool.Model().VocabSize()
+}
+
+// modelFile caches the digest of a model file.
+type modelFile struct {
+	once   sync.Once
+	digest string
+}
+
+// Close frees the contexts of the model, and the model itself when it has been loaded by LoadDir.
+func (m *Model) Close() error {
+	if m.Pool != nil {
+		if err := m.Pool.Close(); err != nil {
+			return err
+		}
+	}
+	if m.model != nil {
+		return m.model.Close()
+	}
+	return nil
+}
+
+// Server is an http.Handler serving the models.
+type Server struct {
+	models map[string]*Model
+	names  []string
+	mux    *http.ServeMux
+
+	registry *rwkv.Registry
+	// files of the registry models, so that their digests are computed once
+	filesMu sync.Mutex
+	files   map[string]*modelFile
+
+	metrics *Metrics
+
+	// clients by hash of their API key, nil when the requests are not authenticated
+	clients map[[sha256.Size]byte]*client
+
+	store      SessionStore
+	sessionsMu sync.Mutex
+	sessions   map[string]*session
+}
+
+// New returns a server for the models, the names must be unique.
+func New(models ...*Model) (*Server, error) {
+	s := &Server{
+		models:   make(map[string]*Model),
+		mux:      http.NewServeMux(),
+		files:    make(map[string]*modelFile),
+		sessions: make(map[string]*session),
+	}
+	for _, m := range models {
+		if len(m.Name) == 0 {
+			return nil, errors.New("model name can not be empty")
+		}
+		if _, ok := s.models[m.Name]; ok {
+			return nil, fmt.Errorf("model %q is served twice", m.Name)
+		}
+		if m.Template == nil {
+			m.Template = rwkv.WorldChatTemplate()
+		}
+		if m.Created.IsZero() {
+			m.Created = time.Now()
+		}
+		m.file = &modelFile{}
+		s.models[m.Name] = m
+		s.names = append(s.names, m.Name)
+	}
+	s.mux.HandleFunc("/v1/models", s.handleModels)
+	s.mux.HandleFunc("/v1/models/", s.handleModel)
+	s.mux.HandleFunc("/v1/completions", s.handleCompletions)
+	s.mux.HandleFunc("/v1/chat/completions", s.handleChatCompletions)
+	s.mux.HandleFunc("/v1/embeddings", s.handleEmbeddings)
+	s.mux.HandleFunc("/v1/sessions", s.handleSessions)
+	s.mux.HandleFunc("/v1/sessions/", s.handleSession)
+	s.mux.HandleFunc("/api/tags", s.handleTags)
+	s.mux.HandleFunc("/api/generate", s.handleGenerate)
+	s.mux.HandleFunc("/api/chat", s.handleChat)
+	s.mux.HandleFunc("/api/embeddings", s.handleOllamaEmbeddings)
+	return s, nil
+}
+
+// UseRegistry serves the models of the registry too, they are loaded on their first request.
+// The specs must have contexts, the requests are evaluated on the pool of the model.
+// A model given to New hides a registry model of the same name.
+func (s *Server) UseRegistry(registry *rwkv.Registry) {
+	s.registry = registry
+}
+
+// Close closes all the models given to New, the registry is closed by its owner.
+func (s *Server) Close() error {
+	for _, name := range s.names {
+		if err := s.models[name].Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.clients != nil && r.URL.Path != "/metrics" {
+		s.serveAuthenticated(w, r)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// model returns the model of a request and the function releasing it, or writes the error.
+func (s *Server) model(w http.ResponseWriter, name string) (*Model, func()) {
+	m, release, err := s.lookup(name)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "", err.Error())
+		return nil, nil
+	}
+	if m == nil {
+		writeError(w, http.StatusNotFound, "model_not_found", fmt.Sprintf("the model %q does not exist", name))
+		return nil, nil
+	}
+	return m, release
+}
+
+// lookup returns the model of the name and the function releasing it, a registry model is loaded first.
+// It returns a nil model when there is no model of the name.
+func (s *Server) lookup(name string) (*Model, func(), error) {
+	if m, ok := s.models[name]; ok {
+		return m, func() {}, nil
+	}
+	if s.registry == nil {
+		return nil, nil, nil
+	}
+	spec, ok := s.registry.Spec(name)
+	if !ok {
+		return nil, nil, nil
+	}
+	lease, err := s.registry.Acquire(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if lease.Pool == nil {
+		lease.Release()
+		return nil, nil, fmt.Errorf("the model %q has no contexts", name)
+	}
+	m := s.registryModel(name, spec)
+	m.Pool = lease.Pool
+	return m, lease.Release, nil
+}
+
+// info returns the model of the name without loading it, or nil.
+func (s *Server) info(name string) *Model {
+	if m, ok := s.models[name]; ok {
+		return m
+	}
+	if s.registry == nil {
+		return nil
+	}
+	if spec, ok := s.registry.Spec(name); ok {
+		return s.registryModel(name, spec)
+	}
+	return nil
+}
+
+// list returns all the models without loading them.
+func (s *Server) list() []*Model {
+	var models []*Model
+	for _, name := range s.names {
+		models = append(models, s.models[name])
+	}
+	if s.registry != nil {
+		for _, name := range s.registry.Names() {
+			if _, ok := s.models[name]; !ok {
+				models = append(models, s.info(name))
+			}
+		}
+	}
+	return models
+}
+
+// registryModel describes a model of the registry, its pool is set once it is loaded.
+func (s *Server) registryModel(name string, spec rwkv.ModelSpec) *Model {
+	m := &Model{Name: name, Path: spec.Path, Template: rwkv.RavenChatTemplate()}
+	if spec.Options.TokenizerType == rwkv.World {
+		m.Template = rwkv.WorldChatTemplate()
+	}
+	if info, err := os.Stat(spec.Path); err == nil {
+		m.Created = info.ModTime()
+	}
+	s.filesMu.Lock()
+	defer s.filesMu.Unlock()
+	if m.file = s.files[spec.Path]; m.file == nil {
+		m.file = &modelFile{}
+		s.files[spec.Path] = m.file
+	}
+	return m
+}
+
+// apiError is the error body of the OpenAI API.
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	errType := "invalid_request_error"
+	if status >= http.StatusInternalServerError {
+		errType = "server_error"
+	}
+	body := apiError{Error: apiErrorBody{Message: message, Type: errType}}
+	if len(code) > 0 {
+		body.Error.Code = &code
+	}
+	writeJSON(w, status, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// decode reads the JSON body of a POST request, or writes the error.
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "", "only POST is allowed")
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "", "invalid request body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// eventStream writes server-sent events.
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newEventStream(w http.ResponseWriter) *eventStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	return &eventStream{w: w, flusher: flusher}
+}
+
+// send writes v as a data event, it returns false once the client is gone.
+func (e *eventStream) send(v any) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return false
+	}
+	return e.write(data)
+}
+
+func (e *eventStream) done() {
+	e.write([]byte("[DONE]"))
+}
+
+func (e *eventStream) write(data []byte) bool {
+	if _, err := fmt.Fprintf(e.w, "data: %s\n\n", data); err != nil {
+		return false
+	}
+	if e.flusher != nil {
+		e.flusher.Flush()
+	}
+	return true
+}
+
+func newID(prefix string) string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
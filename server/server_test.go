@@ -0,0 +1,455 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/seasonjs/rwkv"
+)
+
+func assert(t *testing.T, con bool, message ...string) {
+	if !con {
+		if len(message) == 0 {
+			t.Error("fail with here, result is false")
+		} else {
+			t.Error(message)
+		}
+	}
+}
+
+func post(t *testing.T, srv *httptest.Server, path, body string) *http.Response {
+	resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// events reads the data of a server-sent event stream until [DONE].
+func events(t *testing.T, resp *http.Response) []string {
+	defer resp.Body.Close()
+	var data []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if line == "[DONE]" {
+			return data
+		}
+		data = append(data, line)
+	}
+	t.Error("stream ended without [DONE]")
+	return data
+}
+
+func TestStopFilter(t *testing.T) {
+	f := &stopFilter{stops: []string{"\n\n", "User:"}}
+	var out string
+	for _, chunk := range []string{"Hello", " Us", "e", " world\n", "\nUser: hi"} {
+		out += f.push(chunk)
+	}
+	assert(t, out == "Hello Use world", out)
+	assert(t, f.flush("Hello Use world") == "")
+
+	f = &stopFilter{stops: []string{"\n\n"}}
+	assert(t, f.push("a\n") == "a")
+	assert(t, f.flush("a\n") == "\n")
+}
+
+func TestStringList(t *testing.T) {
+	var req completionRequest
+	err := json.Unmarshal([]byte(`{"prompt":"hello","stop":["a","b"]}`), &req)
+	assert(t, err == nil)
+	assert(t, len(req.Prompt) == 1 && req.Prompt[0] == "hello")
+	assert(t, len(req.Stop) == 2 && req.Stop[1] == "b")
+
+	err = json.Unmarshal([]byte(`{"prompt":[1,2]}`), &req)
+	assert(t, err != nil)
+
+	var msg chatMessage
+	err = json.Unmarshal([]byte(`{"role":"user","content":[{"type":"text","text":"a"},{"type":"text","text":"b"}]}`), &msg)
+	assert(t, err == nil)
+	assert(t, msg.Content == "ab")
+}
+
+func TestSamplingParams_LogitBias(t *testing.T) {
+	var p samplingParams
+	for _, tc := range []struct {
+		bias string
+		ok   bool
+	}{
+		{`{"0":1,"99":-100}`, true},
+		{`{"100":1}`, false},
+		{`{"999999":1}`, false},
+		{`{"-1":1}`, false},
+		{`{"a":1}`, false},
+	} {
+		assert(t, json.Unmarshal([]byte(`{"logit_bias":`+tc.bias+`}`), &p) == nil)
+		_, err := p.options(nil, 100)
+		assert(t, (err == nil) == tc.ok, tc.bias)
+		p.LogitBias = nil
+	}
+}
+
+func TestServer_Validation(t *testing.T) {
+	s, err := New(&Model{Name: "rwkv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	t.Run("models", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/v1/models")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var list modelList
+		assert(t, json.NewDecoder(resp.Body).Decode(&list) == nil)
+		assert(t, len(list.Data) == 1 && list.Data[0].ID == "rwkv")
+
+		resp, err = http.Get(srv.URL + "/v1/models/other")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert(t, resp.StatusCode == http.StatusNotFound)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, c := range []struct {
+			path, body string
+			status     int
+		}{
+			{"/v1/completions", `{"model":"other","prompt":"hi"}`, http.StatusNotFound},
+			{"/v1/completions", `{"model":"rwkv"`, http.StatusBadRequest},
+			{"/v1/completions", `{"model":"rwkv"}`, http.StatusBadRequest},
+			{"/v1/completions", `{"model":"rwkv","prompt":"hi","temperature":3}`, http.StatusBadRequest},
+			{"/v1/completions", `{"model":"rwkv","prompt":"hi","stream":true,"n":2}`, http.StatusBadRequest},
+			{"/v1/chat/completions", `{"model":"rwkv","messages":[]}`, http.StatusBadRequest},
+			{"/v1/chat/completions", `{"model":"rwkv","messages":[{"role":"robot","content":"hi"}]}`, http.StatusBadRequest},
+			{"/v1/embeddings", `{"model":"rwkv","input":[]}`, http.StatusBadRequest},
+		} {
+			resp := post(t, srv, c.path, c.body)
+			var body apiError
+			assert(t, json.NewDecoder(resp.Body).Decode(&body) == nil)
+			resp.Body.Close()
+			assert(t, resp.StatusCode == c.status, c.body, resp.Status)
+			assert(t, len(body.Error.Message) > 0, c.body)
+		}
+
+		resp, err := http.Get(srv.URL + "/v1/completions")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert(t, resp.StatusCode == http.StatusMethodNotAllowed)
+	})
+}
+
+func TestOllama_Validation(t *testing.T) {
+	s, err := New(&Model{Name: "RWKV-5-World-0.4B-v2-20231113-ctx4096-Q5_1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	t.Run("tags", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/api/tags")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var list tagList
+		assert(t, json.NewDecoder(resp.Body).Decode(&list) == nil)
+		assert(t, len(list.Models) == 1)
+		tag := list.Models[0]
+		assert(t, tag.Name == "RWKV-5-World-0.4B-v2-20231113-ctx4096-Q5_1:latest", tag.Name)
+		assert(t, tag.Details.ParameterSize == "0.4B", tag.Details.ParameterSize)
+		assert(t, tag.Details.QuantizationLevel == "Q5_1", tag.Details.QuantizationLevel)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, c := range []struct {
+			path, body string
+			status     int
+		}{
+			{"/api/generate", `{"model":"other","prompt":"hi"}`, http.StatusNotFound},
+			{"/api/generate", `{"model":"rwkv"`, http.StatusBadRequest},
+			{"/api/generate", `{"model":"RWKV-5-World-0.4B-v2-20231113-ctx4096-Q5_1:latest","prompt":"hi","options":{"top_p":2}}`, http.StatusBadRequest},
+			{"/api/chat", `{"model":"RWKV-5-World-0.4B-v2-20231113-ctx4096-Q5_1","messages":[]}`, http.StatusBadRequest},
+		} {
+			resp := post(t, srv, c.path, c.body)
+			var body ollamaError
+			assert(t, json.NewDecoder(resp.Body).Decode(&body) == nil)
+			resp.Body.Close()
+			assert(t, resp.StatusCode == c.status, c.body, resp.Status)
+			assert(t, len(body.Error) > 0, c.body)
+		}
+	})
+
+	t.Run("load", func(t *testing.T) {
+		resp := post(t, srv, "/api/generate", `{"model":"RWKV-5-World-0.4B-v2-20231113-ctx4096-Q5_1"}`)
+		defer resp.Body.Close()
+		var body generateResponse
+		assert(t, json.NewDecoder(resp.Body).Decode(&body) == nil)
+		assert(t, body.Done && body.DoneReason == "load")
+	})
+}
+
+func TestServer_Registry(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"RWKV-5-World-3B-v2-Q8_0", "RWKV-4-Raven-7B-v12"} {
+		if err := os.WriteFile(filepath.Join(dir, name+".bin"), []byte("weights"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	registry := rwkv.NewRegistry(rwkv.RegistryOptions{})
+	defer registry.Close()
+	_, err := registry.RegisterDir(dir, rwkv.ModelSpec{Contexts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(&Model{Name: "rwkv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UseRegistry(registry)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list modelList
+	assert(t, json.NewDecoder(resp.Body).Decode(&list) == nil)
+	resp.Body.Close()
+	assert(t, len(list.Data) == 3)
+	assert(t, list.Data[1].ID == "RWKV-4-Raven-7B-v12", list.Data[1].ID)
+
+	resp, err = http.Get(srv.URL + "/api/tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags tagList
+	assert(t, json.NewDecoder(resp.Body).Decode(&tags) == nil)
+	resp.Body.Close()
+	assert(t, len(tags.Models) == 3)
+	tag := tags.Models[2]
+	assert(t, tag.Size == int64(len("weights")))
+	assert(t, strings.HasPrefix(tag.Digest, "sha256:"), tag.Digest)
+	assert(t, tag.Details.ParameterSize == "3B" && tag.Details.QuantizationLevel == "Q8_0")
+
+	// the files are not models, loading them fails
+	resp = post(t, srv, "/v1/completions", `{"model":"RWKV-4-Raven-7B-v12","prompt":"hi"}`)
+	resp.Body.Close()
+	assert(t, resp.StatusCode == http.StatusServiceUnavailable, resp.Status)
+	assert(t, len(registry.Loaded()) == 0)
+}
+
+func TestServer(t *testing.T) {
+	model, err := rwkv.NewRwkvAutoModel(rwkv.RwkvOptions{
+		MaxTokens:     20,
+		StopString:    "\n\n",
+		Temperature:   0.8,
+		TopP:          0.5,
+		TokenizerType: rwkv.Normal,
+		PrintError:    true,
+		CpuThreads:    2,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer model.Close()
+
+	err = model.LoadFromFile("../models/RWKV-4b-Pile-171M-20230202-7922-f16.bin")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	pool, err := model.NewContextPool(2, 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer pool.Close()
+
+	s, err := New(&Model{Name: "rwkv", Pool: pool, Template: rwkv.RavenChatTemplate()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	t.Run("completions", func(t *testing.T) {
+		resp := post(t, srv, "/v1/completions", `{"model":"rwkv","prompt":"hello","max_tokens":5,"n":2,"logprobs":2}`)
+		defer resp.Body.Close()
+		var body completionResponse
+		assert(t, json.NewDecoder(resp.Body).Decode(&body) == nil)
+		assert(t, len(body.Choices) == 2)
+		assert(t, body.Usage.CompletionTokens <= 10)
+		for _, choice := range body.Choices {
+			assert(t, choice.Logprobs != nil && len(choice.Logprobs.Tokens) > 0)
+		}
+	})
+
+	t.Run("completions logit bias", func(t *testing.T) {
+		resp := post(t, srv, "/v1/completions", `{"model":"rwkv","prompt":"hello","logit_bias":{"999999":1}}`)
+		resp.Body.Close()
+		assert(t, resp.StatusCode == http.StatusBadRequest, resp.Status)
+	})
+
+	t.Run("completions stream", func(t *testing.T) {
+		resp := post(t, srv, "/v1/completions", `{"model":"rwkv","prompt":"hello","max_tokens":5,"stream":true}`)
+		assert(t, resp.Header.Get("Content-Type") == "text/event-stream")
+		chunks := events(t, resp)
+		assert(t, len(chunks) > 0)
+		var last completionResponse
+		assert(t, json.Unmarshal([]byte(chunks[len(chunks)-1]), &last) == nil)
+		assert(t, last.Choices[0].FinishReason != nil)
+	})
+
+	t.Run("chat completions", func(t *testing.T) {
+		resp := post(t, srv, "/v1/chat/completions", `{"model":"rwkv","messages":[{"role":"user","content":"hello"}],"max_tokens":10}`)
+		defer resp.Body.Close()
+		var body chatResponse
+		assert(t, json.NewDecoder(resp.Body).Decode(&body) == nil)
+		assert(t, len(body.Choices) == 1)
+		assert(t, body.Choices[0].Message.Role == "assistant")
+	})
+
+	t.Run("chat completions stream", func(t *testing.T) {
+		resp := post(t, srv, "/v1/chat/completions", `{"model":"rwkv","messages":[{"role":"user","content":"hello"}],"max_tokens":10,"stream":true}`)
+		chunks := events(t, resp)
+		assert(t, len(chunks) >= 2)
+		var first chatResponse
+		assert(t, json.Unmarshal([]byte(chunks[0]), &first) == nil)
+		assert(t, first.Object == "chat.completion.chunk" && first.Choices[0].Delta.Role == "assistant")
+	})
+
+	t.Run("embeddings", func(t *testing.T) {
+		resp := post(t, srv, "/v1/embeddings", `{"model":"rwkv","input":["hello","world"]}`)
+		defer resp.Body.Close()
+		var body struct {
+			Data []struct {
+				Embedding []float32 `json:"embedding"`
+			} `json:"data"`
+		}
+		assert(t, json.NewDecoder(resp.Body).Decode(&body) == nil)
+		assert(t, len(body.Data) == 2 && len(body.Data[0].Embedding) > 0)
+	})
+
+	t.Run("sessions", func(t *testing.T) {
+		resp := post(t, srv, "/v1/sessions", `{"model":"rwkv","messages":[{"role":"system","content":"be brief"}]}`)
+		var info sessionInfo
+		assert(t, json.NewDecoder(resp.Body).Decode(&info) == nil)
+		resp.Body.Close()
+		assert(t, len(info.ID) > 0 && info.Tokens > 0)
+
+		for i := 0; i < 2; i++ {
+			resp = post(t, srv, "/v1/sessions/"+info.ID+"/messages", `{"messages":[{"role":"user","content":"hello"}],"max_tokens":10}`)
+			var body chatResponse
+			assert(t, json.NewDecoder(resp.Body).Decode(&body) == nil)
+			resp.Body.Close()
+			assert(t, len(body.Choices) == 1)
+			// only the new message is evaluated
+			assert(t, body.Usage.PromptTokens < 10)
+		}
+
+		resp, err := http.Get(srv.URL + "/v1/sessions/" + info.ID + "/state")
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp, err = http.Post(srv.URL+"/v1/sessions?model=rwkv", "application/octet-stream", bytes.NewReader(state))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var imported sessionInfo
+		assert(t, json.NewDecoder(resp.Body).Decode(&imported) == nil)
+		resp.Body.Close()
+		assert(t, imported.ID != info.ID && imported.Tokens > info.Tokens)
+
+		large := append(state, make([]byte, maxImportHistory)...)
+		resp, err = http.Post(srv.URL+"/v1/sessions?model=rwkv", "application/octet-stream", bytes.NewReader(large))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert(t, resp.StatusCode == http.StatusRequestEntityTooLarge, resp.Status)
+	})
+}
+
+func TestOllama(t *testing.T) {
+	models, err := LoadDir("../models", DirOptions{
+		Options:  rwkv.RwkvOptions{MaxTokens: 20, StopString: "\n\n", Temperature: 0.8, TopP: 0.5, CpuThreads: 2},
+		PoolSize: 2,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s, err := New(models...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	name := models[0].Name
+
+	t.Run("generate stream", func(t *testing.T) {
+		resp := post(t, srv, "/api/generate", `{"model":"`+name+`","prompt":"hello","options":{"num_predict":5}}`)
+		defer resp.Body.Close()
+		assert(t, resp.Header.Get("Content-Type") == "application/x-ndjson")
+		var last generateResponse
+		decoder := json.NewDecoder(resp.Body)
+		for decoder.More() {
+			assert(t, decoder.Decode(&last) == nil)
+		}
+		assert(t, last.Done && len(last.Context) > 0)
+		assert(t, last.EvalCount <= 5)
+	})
+
+	t.Run("generate with context", func(t *testing.T) {
+		resp := post(t, srv, "/api/generate", `{"model":"`+name+`","prompt":"hello","stream":false,"context":[1,2,3]}`)
+		defer resp.Body.Close()
+		var body generateResponse
+		assert(t, json.NewDecoder(resp.Body).Decode(&body) == nil)
+		assert(t, body.Done && body.PromptEvalCount > 3)
+	})
+
+	t.Run("chat", func(t *testing.T) {
+		resp := post(t, srv, "/api/chat", `{"model":"`+name+`","messages":[{"role":"user","content":"hello"}],"stream":false}`)
+		defer resp.Body.Close()
+		var body ollamaChatResponse
+		assert(t, json.NewDecoder(resp.Body).Decode(&body) == nil)
+		assert(t, body.Done && body.Message.Role == "assistant")
+	})
+
+	t.Run("embeddings", func(t *testing.T) {
+		resp := post(t, srv, "/api/embeddings", `{"model":"`+name+`","prompt":"hello"}`)
+		defer resp.Body.Close()
+		var body ollamaEmbeddingResponse
+		assert(t, json.NewDecoder(resp.Body).Decode(&body) == nil)
+		assert(t, len(body.Embedding) > 0)
+	})
+}
@@ -0,0 +1,541 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seasonjs/rwkv"
+)
+
+// ErrSessionNotFound is returned by a SessionStore which has no session of the id.
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionStore persists the sessions between their requests.
+// Without a store the sessions are kept in memory until they are deleted.
+type SessionStore interface {
+	Save(id string, data []byte) error
+	// Load returns ErrSessionNotFound when there is no session of the id.
+	Load(id string) ([]byte, error)
+	Delete(id string) error
+}
+
+// DirStore stores every session in a file of a directory.
+type DirStore struct {
+	dir string
+}
+
+// NewDirStore returns a store writing into dir, which is created if needed.
+func NewDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DirStore{dir: dir}, nil
+}
+
+func (d *DirStore) path(id string) string {
+	return filepath.Join(d.dir, id+".session")
+}
+
+func (d *DirStore) Save(id string, data []byte) error {
+	// write then rename, so that a crash never leaves a truncated session
+	tmp, err := os.CreateTemp(d.dir, id+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path(id))
+}
+
+func (d *DirStore) Load(id string) ([]byte, error) {
+	data, err := os.ReadFile(d.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrSessionNotFound
+	}
+	return data, err
+}
+
+func (d *DirStore) Delete(id string) error {
+	err := os.Remove(d.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrSessionNotFound
+	}
+	return err
+}
+
+// UseSessionStore persists the sessions into the store, a session is only in memory while a request uses it.
+func (s *Server) UseSessionStore(store SessionStore) {
+	s.store = store
+}
+
+var sessionID = regexp.MustCompile(`^sess_[0-9a-f]{24}$`)
+
+// session is a conversation whose state is kept between the requests, so that a turn only evaluates the new message.
+type session struct {
+	// mu is held by the request using the session
+	mu sync.Mutex
+
+	ID       string
+	Model    string
+	Created  time.Time
+	LastUsed time.Time
+	Messages []chatMessage
+	// Owner is the API key the session has been created with, only its requests find the session
+	Owner string `json:",omitempty"`
+
+	// state is evaluated with model, it is nil until the session is used when it has been loaded from data
+	state *rwkv.RwkvState
+	model *rwkv.RwkvModel
+	data  []byte
+}
+
+// stateOn returns the state of the session for the model, a session restored from the store or created on
+// another load of the model gets its state from the export.
+func (sess *session) stateOn(model *rwkv.RwkvModel) (*rwkv.RwkvState, error) {
+	if sess.state != nil && sess.model == model {
+		return sess.state, nil
+	}
+	data := sess.data
+	if sess.state != nil {
+		var buf bytes.Buffer
+		if _, err := sess.state.WriteTo(&buf); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+	state, err := model.ReadState(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	sess.state, sess.model, sess.data = state, model, nil
+	return state, nil
+}
+
+// encode returns the session as a u32 length, the JSON metadata and the state export.
+func (sess *session) encode() ([]byte, error) {
+	meta, err := json.Marshal(sess)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(meta)))
+	buf.Write(meta)
+	if sess.state == nil {
+		buf.Write(sess.data)
+	} else if _, err = sess.state.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeSession(data []byte) (*session, error) {
+	if len(data) < 4 {
+		return nil, errors.New("invalid session data")
+	}
+	n := binary.LittleEndian.Uint32(data)
+	if uint64(n) > uint64(len(data)-4) {
+		return nil, errors.New("invalid session data")
+	}
+	sess := &session{}
+	if err := json.Unmarshal(data[4:4+n], sess); err != nil {
+		return nil, err
+	}
+	sess.data = data[4+n:]
+	return sess, nil
+}
+
+type sessionInfo struct {
+	ID       string        `json:"id"`
+	Object   string        `json:"object"`
+	Model    string        `json:"model"`
+	Created  int64         `json:"created"`
+	LastUsed int64         `json:"last_used"`
+	Messages []chatMessage `json:"messages"`
+	// Tokens is the number of tokens in the state, when it is loaded.
+	Tokens int `json:"tokens,omitempty"`
+}
+
+func (sess *session) info() sessionInfo {
+	info := sessionInfo{
+		ID:       sess.ID,
+		Object:   "session",
+		Model:    sess.Model,
+		Created:  sess.Created.Unix(),
+		LastUsed: sess.LastUsed.Unix(),
+		Messages: sess.Messages,
+	}
+	if info.Messages == nil {
+		info.Messages = []chatMessage{}
+	}
+	if sess.state != nil {
+		info.Tokens = sess.state.TokenCount()
+	}
+	return info
+}
+
+// acquireSession returns the session of the id locked for the request, or writes the error.
+// The sessions of other API keys are not found.
+func (s *Server) acquireSession(w http.ResponseWriter, r *http.Request, id string) *session {
+	owner := sessionOwner(r.Context())
+	s.sessionsMu.Lock()
+	sess, ok := s.sessions[id]
+	if !ok && s.store != nil && sessionID.MatchString(id) {
+		data, err := s.store.Load(id)
+		if err != nil && !errors.Is(err, ErrSessionNotFound) {
+			s.sessionsMu.Unlock()
+			writeError(w, http.StatusInternalServerError, "", err.Error())
+			return nil
+		}
+		if err == nil {
+			if sess, err = decodeSession(data); err != nil {
+				s.sessionsMu.Unlock()
+				writeError(w, http.StatusInternalServerError, "", err.Error())
+				return nil
+			}
+			if ok = sess.Owner == owner; ok {
+				s.sessions[id] = sess
+			}
+		}
+	}
+	s.sessionsMu.Unlock()
+	if !ok || sess.Owner != owner {
+		writeError(w, http.StatusNotFound, "session_not_found", fmt.Sprintf("the session %q does not exist", id))
+		return nil
+	}
+	if !sess.mu.TryLock() {
+		writeError(w, http.StatusConflict, "session_busy", "the session is used by another request")
+		return nil
+	}
+	return sess
+}
+
+// releaseSession saves the session into the store and unlocks it.
+func (s *Server) releaseSession(sess *session) error {
+	defer sess.mu.Unlock()
+	if s.store == nil {
+		return nil
+	}
+	data, err := sess.encode()
+	if err == nil {
+		err = s.store.Save(sess.ID, data)
+	}
+	// the session stays in memory when it could not be saved, so that it isn't lost
+	if err != nil {
+		return err
+	}
+	s.sessionsMu.Lock()
+	delete(s.sessions, sess.ID)
+	s.sessionsMu.Unlock()
+	return nil
+}
+
+type sessionRequest struct {
+	Model    string        `json:"model"`
+	Messages []chatMessage `json:"messages"`
+}
+
+// maxImportHistory bounds the token history of an imported state export, 4 bytes per token.
+const maxImportHistory = 4 << 20
+
+// importLimit returns the size of the largest state export of the model accepted by an import:
+// the export of a new state, which is the header, the state and the logits, and the token history.
+func importLimit(model *rwkv.RwkvModel) (int64, error) {
+	state, err := model.InitState()
+	if err != nil {
+		return 0, err
+	}
+	n, err := state.WriteTo(io.Discard)
+	return n + maxImportHistory, err
+}
+
+// handleSessions creates a session, from messages or from a state export.
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	var req sessionRequest
+	importing := r.Method == http.MethodPost && r.Header.Get("Content-Type") == "application/octet-stream"
+	if importing {
+		req.Model = r.URL.Query().Get("model")
+	} else if !decode(w, r, &req) {
+		return
+	}
+	m, release := s.model(w, req.Model)
+	if m == nil {
+		return
+	}
+	defer release()
+	var export []byte
+	if importing {
+		limit, err := importLimit(m.Pool.Model())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		if export, err = io.ReadAll(http.MaxBytesReader(w, r.Body, limit)); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, http.StatusRequestEntityTooLarge, "", fmt.Sprintf("the state export is larger than %d bytes", limit))
+			} else {
+				writeError(w, http.StatusBadRequest, "", "invalid request body: "+err.Error())
+			}
+			return
+		}
+	}
+	var prompt string
+	for _, msg := range req.Messages {
+		role, ok := chatRoles[msg.Role]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "", fmt.Sprintf("message role %q is not supported", msg.Role))
+			return
+		}
+		prompt += m.Template.Format(rwkv.ChatMessage{Role: role, Content: string(msg.Content)})
+	}
+
+	var state *rwkv.RwkvState
+	var err error
+	if export != nil {
+		if state, err = m.Pool.Model().ReadState(bytes.NewReader(export)); err != nil {
+			writeError(w, http.StatusBadRequest, "", "invalid state: "+err.Error())
+			return
+		}
+	} else if state, err = m.Pool.Model().InitState(); err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	done, err := m.attach(r.Context(), state)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	defer done()
+	if len(prompt) > 0 {
+		tokens, err := m.Pool.Model().Tokenize(prompt)
+		if err == nil {
+			err = state.FeedTokens(tokens)
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		account(r.Context(), len(tokens), 0)
+	}
+
+	now := time.Now()
+	sess := &session{
+		ID:       newID("sess_"),
+		Model:    m.Name,
+		Created:  now,
+		LastUsed: now,
+		Messages: req.Messages,
+		Owner:    sessionOwner(r.Context()),
+		state:    state,
+		model:    m.Pool.Model(),
+	}
+	sess.mu.Lock()
+	s.sessionsMu.Lock()
+	s.sessions[sess.ID] = sess
+	s.sessionsMu.Unlock()
+	info := sess.info()
+	if err = s.releaseSession(sess); err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// handleSession serves /v1/sessions/{id}, /v1/sessions/{id}/messages and /v1/sessions/{id}/state.
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/sessions/"), "/")
+	switch action {
+	case "":
+		switch r.Method {
+		case http.MethodGet:
+			s.getSession(w, r, id)
+		case http.MethodDelete:
+			s.deleteSession(w, r, id)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			writeError(w, http.StatusMethodNotAllowed, "", "only GET and DELETE are allowed")
+		}
+	case "messages":
+		s.sendMessages(w, r, id)
+	case "state":
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeError(w, http.StatusMethodNotAllowed, "", "only GET is allowed")
+			return
+		}
+		s.exportSession(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) getSession(w http.ResponseWriter, r *http.Request, id string) {
+	sess := s.acquireSession(w, r, id)
+	if sess == nil {
+		return
+	}
+	info := sess.info()
+	_ = s.releaseSession(sess)
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (s *Server) deleteSession(w http.ResponseWriter, r *http.Request, id string) {
+	sess := s.acquireSession(w, r, id)
+	if sess == nil {
+		return
+	}
+	defer sess.mu.Unlock()
+	if s.store != nil {
+		if err := s.store.Delete(id); err != nil && !errors.Is(err, ErrSessionNotFound) {
+			writeError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+	}
+	s.sessionsMu.Lock()
+	delete(s.sessions, id)
+	s.sessionsMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "object": "session.deleted", "deleted": true})
+}
+
+// exportSession downloads the state of the session, it can be imported into a new session.
+func (s *Server) exportSession(w http.ResponseWriter, r *http.Request, id string) {
+	sess := s.acquireSession(w, r, id)
+	if sess == nil {
+		return
+	}
+	defer s.releaseSession(sess)
+	var buf bytes.Buffer
+	if sess.state == nil {
+		buf.Write(sess.data)
+	} else if _, err := sess.state.WriteTo(&buf); err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".state"))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// sendMessages adds the new messages of a chat request to the session and replies to them.
+func (s *Server) sendMessages(w http.ResponseWriter, r *http.Request, id string) {
+	var req chatRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	sess := s.acquireSession(w, r, id)
+	if sess == nil {
+		return
+	}
+	defer s.releaseSession(sess)
+	if len(req.Model) > 0 && req.Model != sess.Model {
+		writeError(w, http.StatusBadRequest, "", fmt.Sprintf("the session uses the model %q", sess.Model))
+		return
+	}
+	if n, err := req.n(); err != nil || n != 1 {
+		writeError(w, http.StatusBadRequest, "", "n must be 1 in a session")
+		return
+	}
+	m, release := s.model(w, sess.Model)
+	if m == nil {
+		return
+	}
+	defer release()
+	prompt, err := chatPrompt(m.Template, req.Messages)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	stops, opts, err := req.chatOptions(m)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	promptTokens, err := m.Pool.Model().Tokenize(prompt)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	state, err := sess.stateOn(m.Pool.Model())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	done, err := m.attach(r.Context(), state)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	defer done()
+
+	resp := chatResponse{
+		ID:      newID("chatcmpl-"),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   m.Name,
+	}
+	var gen *rwkv.Generation
+	if req.Stream {
+		resp.Object = "chat.completion.chunk"
+		gen = s.streamChat(w, r, state, &req, resp, prompt, len(promptTokens), stops, opts)
+	} else if gen, err = state.Generate(prompt, opts...); err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+	}
+	sess.LastUsed = time.Now()
+	if gen == nil {
+		// the messages may have been evaluated, the session keeps them without a reply
+		sess.Messages = append(sess.Messages, req.Messages...)
+		return
+	}
+	// keep the state in the template format when the reply has been cut
+	if gen.Stop != m.Template.Separator() {
+		separator, err := m.Pool.Model().Tokenize(m.Template.Separator())
+		if err == nil {
+			err = state.FeedTokens(separator)
+		}
+		if err != nil && !req.Stream {
+			writeError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+	}
+	reply := strings.TrimSpace(gen.Text)
+	sess.Messages = append(sess.Messages, req.Messages...)
+	sess.Messages = append(sess.Messages, chatMessage{Role: "assistant", Content: chatContent(reply)})
+	if req.Stream {
+		return
+	}
+	choice := chatChoice{
+		Message:      &chatReply{Role: "assistant", Content: reply},
+		FinishReason: finishReason(gen),
+	}
+	if req.Logprobs {
+		choice.Logprobs = newChatLogprobs(gen.Logprobs)
+	}
+	resp.Choices = []chatChoice{choice}
+	resp.Usage = &usage{}
+	resp.Usage.add(len(promptTokens), len(gen.Tokens))
+	account(r.Context(), resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,186 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDirStore(t *testing.T) {
+	store, err := NewDirStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Load("sess_1")
+	assert(t, errors.Is(err, ErrSessionNotFound))
+	assert(t, store.Save("sess_1", []byte("one")) == nil)
+	assert(t, store.Save("sess_1", []byte("two")) == nil)
+	data, err := store.Load("sess_1")
+	assert(t, err == nil && string(data) == "two")
+	assert(t, store.Delete("sess_1") == nil)
+	assert(t, errors.Is(store.Delete("sess_1"), ErrSessionNotFound))
+}
+
+func TestServer_Sessions(t *testing.T) {
+	store, err := NewDirStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(&Model{Name: "rwkv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UseSessionStore(store)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// a session without a loaded state, as it is read from the store
+	sess := &session{
+		ID:       newID("sess_"),
+		Model:    "rwkv",
+		Created:  time.Unix(1700000000, 0),
+		LastUsed: time.Unix(1700000000, 0),
+		Messages: []chatMessage{{Role: "user", Content: "hi"}},
+		data:     []byte("RWKS-state"),
+	}
+	data, err := sess.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, store.Save(sess.ID, data) == nil)
+
+	t.Run("get", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/v1/sessions/" + sess.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var info sessionInfo
+		assert(t, json.NewDecoder(resp.Body).Decode(&info) == nil)
+		assert(t, info.ID == sess.ID && info.Model == "rwkv" && info.Created == 1700000000)
+		assert(t, len(info.Messages) == 1 && info.Messages[0].Content == "hi")
+		// the session is saved back and dropped from memory
+		assert(t, len(s.sessions) == 0)
+	})
+
+	t.Run("state", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/v1/sessions/" + sess.ID + "/state")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		assert(t, resp.Header.Get("Content-Type") == "application/octet-stream")
+		assert(t, string(body) == "RWKS-state")
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, c := range []struct {
+			path, body string
+			status     int
+		}{
+			{"/v1/sessions", `{"model":"other"}`, http.StatusNotFound},
+			{"/v1/sessions", `{"model":"rwkv","messages":[{"role":"robot","content":"hi"}]}`, http.StatusBadRequest},
+			{"/v1/sessions/sess_000000000000000000000000/messages", `{"messages":[{"role":"user","content":"hi"}]}`, http.StatusNotFound},
+			{"/v1/sessions/" + sess.ID + "/messages", `{"model":"other","messages":[{"role":"user","content":"hi"}]}`, http.StatusBadRequest},
+			{"/v1/sessions/" + sess.ID + "/messages", `{"messages":[{"role":"user","content":"hi"}],"n":2}`, http.StatusBadRequest},
+		} {
+			resp := post(t, srv, c.path, c.body)
+			resp.Body.Close()
+			assert(t, resp.StatusCode == c.status, c.path, c.body, resp.Status)
+		}
+
+		// a request using the session makes the others wait for it
+		locked := s.acquireSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), sess.ID)
+		resp, err := http.Get(srv.URL + "/v1/sessions/" + sess.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert(t, resp.StatusCode == http.StatusConflict)
+		assert(t, s.releaseSession(locked) == nil)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/v1/sessions/"+sess.ID, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert(t, resp.StatusCode == http.StatusOK)
+		_, err = store.Load(sess.ID)
+		assert(t, errors.Is(err, ErrSessionNotFound))
+
+		resp, err = http.Get(srv.URL + "/v1/sessions/" + sess.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert(t, resp.StatusCode == http.StatusNotFound)
+	})
+
+	t.Run("decode", func(t *testing.T) {
+		decoded, err := decodeSession(data)
+		assert(t, err == nil && decoded.ID == sess.ID && bytes.Equal(decoded.data, sess.data))
+		_, err = decodeSession(data[:6])
+		assert(t, err != nil)
+	})
+}
+
+func TestServer_SessionOwner(t *testing.T) {
+	store, err := NewDirStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(&Model{Name: "rwkv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UseSessionStore(store)
+	assert(t, s.UseAPIKeys(APIKey{Key: "sk-a"}, APIKey{Key: "sk-b"}) == nil)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	ctx, done, _ := s.Authenticate(context.Background(), "sk-a")
+	done()
+	sess := &session{ID: newID("sess_"), Model: "rwkv", Owner: sessionOwner(ctx), data: []byte("RWKS-state")}
+	data, err := sess.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, store.Save(sess.ID, data) == nil)
+
+	do := func(method, path, key string) int {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		assert(t, do(method, "/v1/sessions/"+sess.ID, "sk-b") == http.StatusNotFound, method)
+	}
+	assert(t, do(http.MethodGet, "/v1/sessions/"+sess.ID+"/state", "sk-b") == http.StatusNotFound)
+	assert(t, len(s.sessions) == 0, "the session of another key is not loaded")
+
+	assert(t, do(http.MethodGet, "/v1/sessions/"+sess.ID, "sk-a") == http.StatusOK)
+	assert(t, do(http.MethodGet, "/v1/sessions/"+sess.ID+"/state", "sk-a") == http.StatusOK)
+
+	// a session in memory is found by its owner only too
+	s.sessions[sess.ID] = sess
+	assert(t, do(http.MethodGet, "/v1/sessions/"+sess.ID, "sk-b") == http.StatusNotFound)
+	assert(t, do(http.MethodDelete, "/v1/sessions/"+sess.ID, "sk-a") == http.StatusOK)
+}
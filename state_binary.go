@@ -0,0 +1,172 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+)
+
+// stateMagic starts the binary export of a state, "RWKS".
+var stateMagic = [4]byte{'R', 'W', 'K', 'S'}
+
+const (
+	stateVersion = 1
+
+	stateFlagHistoryLost = 1 << 0
+)
+
+// WriteTo exports the state, its logits and its token history, so that the conversation can be
+// restored later with ReadState, on the same model or on another load of the same model file.
+// The values are little-endian, the format is:
+//
+//	"RWKS" version:u32 flags:u32 state_len:u32 logits_len:u32 state:f32* logits:f32*
+//	segments:u32 (role_len:u8 role tokens:u32 token:u32*)*
+//
+// It doesn't call into rwkv.cpp, so a state can be exported after its model has been closed.
+func (s *RwkvState) WriteTo(w io.Writer) (n int64, err error) {
+	if s == nil || len(s.state) == 0 {
+		return 0, errors.New("you must call InitState first")
+	}
+	_, span := s.rwkvModel.startSpan(s.spanContext(nil), SpanStateSave)
+	defer func() {
+		span.SetAttributes(slog.Int64(AttrStateBytes, n))
+		span.End(err)
+	}()
+	bw := bufio.NewWriter(w)
+	cw := &countWriter{w: bw}
+	var flags uint32
+	if s.historyLost {
+		flags |= stateFlagHistoryLost
+	}
+	header := []uint32{stateVersion, flags, uint32(len(s.state)), uint32(len(s.logits))}
+	if _, err := cw.Write(stateMagic[:]); err != nil {
+		return cw.n, err
+	}
+	if err := binary.Write(cw, binary.LittleEndian, header); err != nil {
+		return cw.n, err
+	}
+	if err := binary.Write(cw, binary.LittleEndian, s.state); err != nil {
+		return cw.n, err
+	}
+	if err := binary.Write(cw, binary.LittleEndian, s.logits); err != nil {
+		return cw.n, err
+	}
+	if err := binary.Write(cw, binary.LittleEndian, uint32(len(s.history))); err != nil {
+		return cw.n, err
+	}
+	for _, segment := range s.history {
+		if len(segment.Role) > math.MaxUint8 {
+			return cw.n, errors.New("token role is too long")
+		}
+		if _, err := cw.Write(append([]byte{byte(len(segment.Role))}, segment.Role...)); err != nil {
+			return cw.n, err
+		}
+		tokens := make([]uint32, 1+len(segment.Tokens))
+		tokens[0] = uint32(len(segment.Tokens))
+		for i, token := range segment.Tokens {
+			tokens[i+1] = uint32(token)
+		}
+		if err := binary.Write(cw, binary.LittleEndian, tokens); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, bw.Flush()
+}
+
+// ReadState imports a state exported by RwkvState.WriteTo, the state and logits lengths must match the model.
+func (m *RwkvModel) ReadState(r io.Reader) (*RwkvState, error) {
+	s, err := m.InitState()
+	if err != nil {
+		return nil, err
+	}
+	_, span := m.startSpan(context.Background(), SpanStateLoad)
+	err = s.readFrom(bufio.NewReader(r))
+	span.SetAttributes(slog.Int(AttrTokens, s.TokenCount()))
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readFrom replaces the state, logits and history of s with an export of the same lengths.
+func (s *RwkvState) readFrom(r *bufio.Reader) error {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return err
+	}
+	if magic != stateMagic {
+		return errors.New("not a state export")
+	}
+	var header [4]uint32
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	version, flags, stateLen, logitsLen := header[0], header[1], header[2], header[3]
+	if version != stateVersion {
+		return errors.New("unsupported state export version")
+	}
+	if int(stateLen) != len(s.state) || int(logitsLen) != len(s.logits) {
+		return errors.New("state length is not match")
+	}
+	if err := binary.Read(r, binary.LittleEndian, s.state); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.LittleEndian, s.logits); err != nil {
+		return err
+	}
+	var segments uint32
+	if err := binary.Read(r, binary.LittleEndian, &segments); err != nil {
+		return err
+	}
+	var history []TokenSegment
+	for i := uint32(0); i < segments; i++ {
+		roleLen, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		role := make([]byte, roleLen)
+		if _, err = io.ReadFull(r, role); err != nil {
+			return err
+		}
+		var n uint32
+		if err = binary.Read(r, binary.LittleEndian, &n); err != nil {
+			return err
+		}
+		segment := TokenSegment{Role: TokenRole(role)}
+		// read in chunks, so that a corrupted count can't allocate more than the data
+		chunk := make([]uint32, 1024)
+		for n > 0 {
+			c := chunk[:min(n, uint32(len(chunk)))]
+			if err = binary.Read(r, binary.LittleEndian, c); err != nil {
+				return err
+			}
+			for _, token := range c {
+				segment.Tokens = append(segment.Tokens, int(token))
+			}
+			n -= uint32(len(c))
+		}
+		history = append(history, segment)
+	}
+	s.history = history
+	s.historyLost = flags&stateFlagHistoryLost != 0
+	return nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,42 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestStateBinary(t *testing.T) {
+	model := &RwkvModel{options: &RwkvOptions{TrackTokens: true}}
+	s := &RwkvState{
+		state:     []float32{1, 2, 3, -4},
+		logits:    []float32{0.5, -0.5},
+		rwkvModel: model,
+		history:   []TokenSegment{{Role: RolePrompt, Tokens: []int{1, 2}}, {Role: RoleOutput, Tokens: []int{3}}},
+	}
+	var buf bytes.Buffer
+	n, err := s.WriteTo(&buf)
+	assert(t, err == nil)
+	assert(t, n == int64(buf.Len()))
+	data := buf.Bytes()
+
+	out := &RwkvState{state: make([]float32, 4), logits: make([]float32, 2), rwkvModel: model}
+	err = out.readFrom(bufio.NewReader(bytes.NewReader(data)))
+	assert(t, err == nil)
+	assert(t, out.state[3] == -4 && out.logits[1] == -0.5)
+	assert(t, len(out.history) == 2 && out.history[0].Tokens[1] == 2 && out.history[1].Role == RoleOutput)
+	assert(t, !out.historyLost)
+
+	t.Run("length mismatch", func(t *testing.T) {
+		out := &RwkvState{state: make([]float32, 5), logits: make([]float32, 2), rwkvModel: model}
+		assert(t, out.readFrom(bufio.NewReader(bytes.NewReader(data))) != nil)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		out := &RwkvState{state: make([]float32, 4), logits: make([]float32, 2), rwkvModel: model}
+		assert(t, out.readFrom(bufio.NewReader(bytes.NewReader(data[:len(data)-2]))) != nil)
+	})
+}
@@ -0,0 +1,176 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Fork returns an independent copy of the state, which can continue on a different path than s.
+func (s *RwkvState) Fork() (*RwkvState, error) {
+	if err := checkState(s); err != nil {
+		return nil, err
+	}
+	state := make([]float32, len(s.state))
+	copy(state, s.state)
+	logits := make([]float32, len(s.logits))
+	copy(logits, s.logits)
+	return &RwkvState{
+		state:       state,
+		rwkvModel:   s.rwkvModel,
+		logits:      logits,
+		history:     s.Segments(),
+		historyLost: s.historyLost,
+		ctx:         s.ctx,
+		job:         s.job,
+	}, nil
+}
+
+// restore copies the state, logits and history of a fork back into s.
+func (s *RwkvState) restore(fork *RwkvState) {
+	copy(s.state, fork.state)
+	copy(s.logits, fork.logits)
+	s.history = fork.Segments()
+	s.historyLost = fork.historyLost
+}
+
+// Blend linearly interpolates between s and other, alpha = 0 gives s and alpha = 1 gives other.
+// Both states must come from compatible models, the result is a new state.
+func (s *RwkvState) Blend(other *RwkvState, alpha float32) (*RwkvState, error) {
+	return MixStates([]*RwkvState{s, other}, []float32{1 - alpha, alpha})
+}
+
+// MixStates computes the weighted average of several states.
+// The weights are normalized by their sum, so only their ratio matters.
+// For RWKV v4 the wkv numerator and denominator are mixed together with their max exponent,
+// so the result is the weighted average of the real attention values rather than of the scaled ones.
+func MixStates(states []*RwkvState, weights []float32) (*RwkvState, error) {
+	if len(states) == 0 {
+		return nil, errors.New("at least one state is required")
+	}
+	if len(states) != len(weights) {
+		return nil, errors.New("states and weights length is not match")
+	}
+	sum := float32(0)
+	for _, w := range weights {
+		sum += w
+	}
+	if sum == 0 {
+		return nil, errors.New("sum of weights can not be zero")
+	}
+
+	views := make([]*StateView, len(states))
+	for i, state := range states {
+		if err := checkCompatible(states[0], state); err != nil {
+			return nil, err
+		}
+		view, err := state.View()
+		if err != nil {
+			return nil, err
+		}
+		views[i] = view
+	}
+
+	out, err := states[0].Fork()
+	if err != nil {
+		return nil, err
+	}
+	outView, err := out.View()
+	if err != nil {
+		return nil, err
+	}
+	out.history, out.historyLost = nil, true
+	for i := range out.state {
+		out.state[i] = 0
+	}
+	for i := range out.logits {
+		out.logits[i] = 0
+	}
+	for i, state := range states {
+		w := weights[i] / sum
+		for j, v := range state.state {
+			out.state[j] += w * v
+		}
+		for j, v := range state.logits {
+			out.logits[j] += w * v
+		}
+	}
+
+	if outView.Version() == 4 {
+		for layer := 0; layer < outView.NLayer(); layer++ {
+			mixAttention(outView, views, weights, sum, layer)
+		}
+	}
+	return out, nil
+}
+
+// mixAttention mixes att_aa and att_bb relative to the largest att_pp,
+// since rwkv.cpp stores them scaled by exp(-att_pp).
+func mixAttention(out *StateView, views []*StateView, weights []float32, sum float32, layer int) {
+	aa, bb, pp := out.AttNum(layer), out.AttDen(layer), out.AttMax(layer)
+	for j := range pp {
+		maxP := float32(attMaxInit)
+		for _, view := range views {
+			if p := view.AttMax(layer)[j]; p > maxP {
+				maxP = p
+			}
+		}
+		a, b := float32(0), float32(0)
+		for i, view := range views {
+			scale := weights[i] / sum * float32(math.Exp(float64(view.AttMax(layer)[j]-maxP)))
+			a += scale * view.AttNum(layer)[j]
+			b += scale * view.AttDen(layer)[j]
+		}
+		aa[j], bb[j], pp[j] = a, b, maxP
+	}
+}
+
+// ReplaceLayers returns a copy of s where the given layers are taken from other.
+func (s *RwkvState) ReplaceLayers(other *RwkvState, layers ...int) (*RwkvState, error) {
+	if err := checkCompatible(s, other); err != nil {
+		return nil, err
+	}
+	out, err := s.Fork()
+	if err != nil {
+		return nil, err
+	}
+	outView, err := out.View()
+	if err != nil {
+		return nil, err
+	}
+	otherView, err := other.View()
+	if err != nil {
+		return nil, err
+	}
+	out.history, out.historyLost = nil, true
+	for _, layer := range layers {
+		if layer < 0 || layer >= outView.NLayer() {
+			return nil, fmt.Errorf("layer %d is out of range", layer)
+		}
+		copy(outView.Layer(layer), otherView.Layer(layer))
+	}
+	return out, nil
+}
+
+// checkCompatible reports whether the two states can be combined.
+func checkCompatible(a, b *RwkvState) error {
+	if err := checkState(a); err != nil {
+		return err
+	}
+	if err := checkState(b); err != nil {
+		return err
+	}
+	if a.rwkvModel == b.rwkvModel {
+		return nil
+	}
+	ca, cb := a.rwkvModel.cRwkv, b.rwkvModel.cRwkv
+	if len(a.state) != len(b.state) || len(a.logits) != len(b.logits) ||
+		ca.RwkvGetNLayer(a.rwkvModel.ctx) != cb.RwkvGetNLayer(b.rwkvModel.ctx) ||
+		ca.RwkvGetNEmbedding(a.rwkvModel.ctx) != cb.RwkvGetNEmbedding(b.rwkvModel.ctx) {
+		return errors.New("states come from incompatible models")
+	}
+	return nil
+}
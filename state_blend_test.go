@@ -0,0 +1,28 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMixAttention(t *testing.T) {
+	newView := func(aa, bb, pp float32) *StateView {
+		state := make([]float32, 5)
+		state[2], state[3], state[4] = aa, bb, pp
+		view, _ := NewStateView(state, 1, 1)
+		return view
+	}
+	a := newView(2, 4, 0)
+	b := newView(1, 1, float32(math.Log(4)))
+	out := newView(0, 0, 0)
+
+	mixAttention(out, []*StateView{a, b}, []float32{1, 1}, 2, 0)
+
+	// real numerators are a: 2, b: 4 and denominators are both 4, so the mix is 3/4 regardless of the scale
+	num := float64(out.AttNum(0)[0]) * math.Exp(float64(out.AttMax(0)[0]))
+	assert(t, math.Abs(num-3) < 1e-4)
+	assert(t, math.Abs(float64(out.AttNum(0)[0]/out.AttDen(0)[0])-0.75) < 1e-4)
+}
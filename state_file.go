@@ -0,0 +1,121 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// StateFileOptions controls how LoadInitStateFile maps a state file onto the model state.
+type StateFileOptions struct {
+	// Transpose swaps the key and value axes of every wkv head.
+	// Use it for raw dumps of the training kernel layout (head, value, key),
+	// files converted by models/convert_state_to_bin.py are already in rwkv.cpp layout.
+	Transpose bool
+}
+
+// LoadInitStateFile loads a pretrained state (for example a "state tuning" checkpoint)
+// and uses it instead of rwkv_init_state for every following InitState and CleanState.
+//
+// The file holds little-endian FP32 values and is either
+// a complete state of rwkv_get_state_len() elements,
+// or only the wkv heads of every layer of an RWKV v5 model,
+// which is what models/convert_state_to_bin.py writes.
+func (m *RwkvModel) LoadInitStateFile(path string, opts ...StateFileOptions) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return m.LoadInitState(f, opts...)
+}
+
+// LoadInitState reads a pretrained state in the format of LoadInitStateFile.
+func (m *RwkvModel) LoadInitState(r io.Reader, opts ...StateFileOptions) (err error) {
+	if err := hasCtx(m.ctx); err != nil {
+		return err
+	}
+	_, span := m.startSpan(context.Background(), SpanStateLoad)
+	defer func() { span.End(err) }()
+	var opt StateFileOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(slog.Int(AttrStateBytes, len(data)))
+	if len(data)%4 != 0 {
+		return errors.New("state file size is not a multiple of 4 bytes")
+	}
+	values := make([]float32, len(data)/4)
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, values); err != nil {
+		return err
+	}
+
+	state := make([]float32, m.cRwkv.RwkvGetStateLength(m.ctx))
+	m.cRwkv.RwkvInitState(m.ctx, state)
+	view, err := NewStateView(state, int(m.cRwkv.RwkvGetNLayer(m.ctx)), int(m.cRwkv.RwkvGetNEmbedding(m.ctx)))
+	if err != nil {
+		return err
+	}
+
+	headsLen := view.NEmbed() * view.HeadSize()
+	switch {
+	case len(values) == len(state):
+		copy(state, values)
+	case view.Version() >= 5 && len(values) == view.NLayer()*headsLen:
+		for layer := 0; layer < view.NLayer(); layer++ {
+			copy(view.WkvHeads(layer), values[layer*headsLen:(layer+1)*headsLen])
+		}
+	default:
+		return fmt.Errorf("state file has %d values, expect %d for a full state or %d for wkv heads only",
+			len(values), len(state), view.NLayer()*headsLen)
+	}
+
+	if opt.Transpose {
+		if view.Version() < 5 {
+			return errors.New("transpose is only supported by RWKV v5 states")
+		}
+		for layer := 0; layer < view.NLayer(); layer++ {
+			for head := 0; head < view.HeadCount(); head++ {
+				transposeSquare(view.WkvHead(layer, head), view.HeadSize())
+			}
+		}
+	}
+
+	m.initState = state
+	return nil
+}
+
+// ResetInitState makes InitState and CleanState start from rwkv_init_state again.
+func (m *RwkvModel) ResetInitState() {
+	m.initState = nil
+}
+
+// resetState fills the state with the initial state of the model.
+func (m *RwkvModel) resetState(ctx *RwkvCtx, state []float32) {
+	if m.initState != nil && len(m.initState) == len(state) {
+		copy(state, m.initState)
+		return
+	}
+	m.cRwkv.RwkvInitState(ctx, state)
+}
+
+func transposeSquare(matrix []float32, n int) {
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			matrix[i*n+j], matrix[j*n+i] = matrix[j*n+i], matrix[i*n+j]
+		}
+	}
+}
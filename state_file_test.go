@@ -0,0 +1,83 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTransposeSquare(t *testing.T) {
+	matrix := []float32{
+		1, 2, 3,
+		4, 5, 6,
+		7, 8, 9,
+	}
+	transposeSquare(matrix, 3)
+	expect := []float32{
+		1, 4, 7,
+		2, 5, 8,
+		3, 6, 9,
+	}
+	for i := range matrix {
+		assert(t, matrix[i] == expect[i])
+	}
+}
+
+// stateFile encodes the values as a state file.
+func stateFile(values ...float32) *bytes.Reader {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, values)
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestLoadInitState(t *testing.T) {
+	m, _ := newFakeModel(t, RwkvOptions{})
+	initState := func() []float32 {
+		state, err := m.InitState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state.state
+	}
+
+	t.Run("full state", func(t *testing.T) {
+		values := make([]float32, 32)
+		for i := range values {
+			values[i] = float32(i + 1)
+		}
+		assert(t, m.LoadInitState(stateFile(values...)) == nil)
+		assert(t, fmt.Sprint(initState()) == fmt.Sprint(values))
+	})
+
+	t.Run("wkv heads", func(t *testing.T) {
+		// 2 layers of 2 heads of 2x2
+		heads := []float32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+		assert(t, m.LoadInitState(stateFile(heads...)) == nil)
+		state := initState()
+		assert(t, fmt.Sprint(state[:16]) == "[0 0 0 0 0 0 0 0 1 2 3 4 5 6 7 8]", fmt.Sprint(state[:16]))
+		assert(t, fmt.Sprint(state[24:]) == "[9 10 11 12 13 14 15 16]", fmt.Sprint(state[24:]))
+
+		assert(t, m.LoadInitState(stateFile(heads...), StateFileOptions{Transpose: true}) == nil)
+		state = initState()
+		assert(t, fmt.Sprint(state[8:16]) == "[1 3 2 4 5 7 6 8]", fmt.Sprint(state[8:16]))
+	})
+
+	t.Run("mismatched file", func(t *testing.T) {
+		before := fmt.Sprint(initState())
+		err := m.LoadInitState(stateFile(1, 2, 3))
+		assert(t, err != nil && strings.Contains(err.Error(), "expect 32 for a full state or 16 for wkv heads only"))
+		err = m.LoadInitState(bytes.NewReader([]byte{1, 2, 3, 4, 5}))
+		assert(t, err != nil, "size is not a multiple of 4")
+		assert(t, fmt.Sprint(initState()) == before, "the loaded state is kept when a file is rejected")
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		m.ResetInitState()
+		assert(t, fmt.Sprint(initState()) == fmt.Sprint(make([]float32, 32)))
+	})
+}
@@ -0,0 +1,167 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// rwkv.cpp initializes the v4 att_pp vector with this value, see rwkv_init_state.
+const attMaxInit = -1e30
+
+// StateView gives typed access to the per-layer components of a raw RWKV state.
+//
+// RWKV v4 keeps 5 vectors of n_embed per layer: ffn_xx, att_xx, att_aa, att_bb and att_pp.
+// RWKV v5 and later keep ffn_xx, att_xx and one head_size x head_size wkv matrix per head.
+// All slices returned by a StateView share memory with the underlying state,
+// so writing to them changes the state.
+type StateView struct {
+	state    []float32
+	nLayer   int
+	nEmbed   int
+	version  int
+	headSize int
+}
+
+// NewStateView detects the model version from the state length and creates a view of the state.
+func NewStateView(state []float32, nLayer, nEmbed int) (*StateView, error) {
+	if nLayer <= 0 || nEmbed <= 0 {
+		return nil, errors.New("n_layer and n_embed must be positive")
+	}
+	if len(state)%(nLayer*nEmbed) != 0 {
+		return nil, fmt.Errorf("state length %d is not a multiple of n_layer*n_embed", len(state))
+	}
+	vectorsPerLayer := len(state) / (nLayer * nEmbed)
+	view := &StateView{
+		state:  state,
+		nLayer: nLayer,
+		nEmbed: nEmbed,
+	}
+	switch {
+	case vectorsPerLayer == 5:
+		view.version = 4
+	case vectorsPerLayer > 2 && nEmbed%(vectorsPerLayer-2) == 0:
+		view.version = 5
+		view.headSize = vectorsPerLayer - 2
+	default:
+		return nil, fmt.Errorf("unknown state layout with %d vectors per layer", vectorsPerLayer)
+	}
+	return view, nil
+}
+
+// View returns a StateView of the current state.
+func (s *RwkvState) View() (*StateView, error) {
+	if err := checkState(s); err != nil {
+		return nil, err
+	}
+	nLayer := int(s.rwkvModel.cRwkv.RwkvGetNLayer(s.rwkvModel.ctx))
+	nEmbed := int(s.rwkvModel.cRwkv.RwkvGetNEmbedding(s.rwkvModel.ctx))
+	return NewStateView(s.state, nLayer, nEmbed)
+}
+
+// Version returns the RWKV architecture version of the state, 4 or 5.
+// RWKV v6 shares the v5 layout and is reported as 5.
+func (v *StateView) Version() int {
+	return v.version
+}
+
+func (v *StateView) NLayer() int {
+	return v.nLayer
+}
+
+func (v *StateView) NEmbed() int {
+	return v.nEmbed
+}
+
+// HeadSize returns the size of a wkv head, it is 0 for RWKV v4.
+func (v *StateView) HeadSize() int {
+	return v.headSize
+}
+
+// HeadCount returns the number of wkv heads per layer, it is 0 for RWKV v4.
+func (v *StateView) HeadCount() int {
+	if v.headSize == 0 {
+		return 0
+	}
+	return v.nEmbed / v.headSize
+}
+
+// Layer returns the whole state of a layer.
+func (v *StateView) Layer(layer int) []float32 {
+	size := len(v.state) / v.nLayer
+	return v.state[layer*size : (layer+1)*size]
+}
+
+// FfnShift returns the token shift vector of the channel mixing block (ffn_xx).
+func (v *StateView) FfnShift(layer int) []float32 {
+	return v.vector(layer, 0)
+}
+
+// AttShift returns the token shift vector of the time mixing block (att_xx).
+func (v *StateView) AttShift(layer int) []float32 {
+	return v.vector(layer, 1)
+}
+
+// AttNum returns the wkv numerator (att_aa) of RWKV v4, nil for other versions.
+func (v *StateView) AttNum(layer int) []float32 {
+	if v.version != 4 {
+		return nil
+	}
+	return v.vector(layer, 2)
+}
+
+// AttDen returns the wkv denominator (att_bb) of RWKV v4, nil for other versions.
+func (v *StateView) AttDen(layer int) []float32 {
+	if v.version != 4 {
+		return nil
+	}
+	return v.vector(layer, 3)
+}
+
+// AttMax returns the wkv max exponent (att_pp) of RWKV v4, nil for other versions.
+func (v *StateView) AttMax(layer int) []float32 {
+	if v.version != 4 {
+		return nil
+	}
+	return v.vector(layer, 4)
+}
+
+// WkvHeads returns the wkv matrices of all heads in a layer, nil for RWKV v4.
+func (v *StateView) WkvHeads(layer int) []float32 {
+	if v.version == 4 {
+		return nil
+	}
+	start := v.nEmbed * 2
+	layerState := v.Layer(layer)
+	return layerState[start : start+v.nEmbed*v.headSize]
+}
+
+// WkvHead returns the head_size x head_size wkv matrix of a head in row-major order, nil for RWKV v4.
+func (v *StateView) WkvHead(layer, head int) []float32 {
+	heads := v.WkvHeads(layer)
+	if heads == nil {
+		return nil
+	}
+	size := v.headSize * v.headSize
+	return heads[head*size : (head+1)*size]
+}
+
+// ResetLayer sets a layer back to the values written by rwkv_init_state.
+func (v *StateView) ResetLayer(layer int) {
+	layerState := v.Layer(layer)
+	for i := range layerState {
+		layerState[i] = 0
+	}
+	if pp := v.AttMax(layer); pp != nil {
+		for i := range pp {
+			pp[i] = attMaxInit
+		}
+	}
+}
+
+func (v *StateView) vector(layer, index int) []float32 {
+	layerState := v.Layer(layer)
+	return layerState[index*v.nEmbed : (index+1)*v.nEmbed]
+}
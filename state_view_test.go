@@ -0,0 +1,62 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"testing"
+)
+
+func TestStateView(t *testing.T) {
+	t.Run("rwkv v4 layout", func(t *testing.T) {
+		nLayer, nEmbed := 2, 4
+		state := make([]float32, nLayer*nEmbed*5)
+		for i := range state {
+			state[i] = float32(i)
+		}
+		view, err := NewStateView(state, nLayer, nEmbed)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		assert(t, view.Version() == 4)
+		assert(t, view.HeadCount() == 0)
+		assert(t, view.FfnShift(1)[0] == 20)
+		assert(t, view.AttShift(1)[0] == 24)
+		assert(t, view.AttNum(0)[0] == 8)
+		assert(t, view.AttDen(0)[0] == 12)
+		assert(t, view.AttMax(0)[3] == 19)
+		assert(t, view.WkvHeads(0) == nil)
+
+		view.ResetLayer(0)
+		assert(t, state[0] == 0 && state[16] == attMaxInit && state[20] == 20)
+	})
+
+	t.Run("rwkv v5 layout", func(t *testing.T) {
+		nLayer, nEmbed, headSize := 2, 4, 2
+		state := make([]float32, nLayer*nEmbed*(2+headSize))
+		for i := range state {
+			state[i] = float32(i)
+		}
+		view, err := NewStateView(state, nLayer, nEmbed)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		assert(t, view.Version() == 5)
+		assert(t, view.HeadSize() == headSize)
+		assert(t, view.HeadCount() == 2)
+		assert(t, view.AttShift(1)[0] == 20)
+		assert(t, view.AttNum(0) == nil)
+		assert(t, len(view.WkvHeads(1)) == nEmbed*headSize)
+		assert(t, view.WkvHead(1, 1)[0] == 28)
+
+		view.WkvHead(0, 0)[0] = -1
+		assert(t, state[8] == -1)
+	})
+
+	t.Run("unknown layout", func(t *testing.T) {
+		_, err := NewStateView(make([]float32, 7), 2, 4)
+		assert(t, err != nil)
+	})
+}
@@ -4,6 +4,9 @@
 package rwkv
 
 import (
+	"bytes"
+	"log/slog"
+	"strings"
 	"testing"
 )
 
@@ -77,6 +80,21 @@ func TestWorldTokenizer(t *testing.T) {
 
 }
 
+func TestWorldTokenizer_Logger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	_, err := newWorldTokenizer(logger)
+	assert(t, err == nil)
+	assert(t, strings.Contains(buf.String(), "level=DEBUG"), buf.String())
+	assert(t, strings.Contains(buf.String(), "tokens="), buf.String())
+
+	buf.Reset()
+	logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	_, err = newWorldTokenizer(logger)
+	assert(t, err == nil)
+	assert(t, buf.Len() == 0, buf.String())
+}
+
 func TestEncodeUtf8(t *testing.T) {
 	t.Run("Test new line to ASCII", func(t *testing.T) {
 		str := string([]rune{
@@ -121,3 +139,39 @@ func TestEncodeUtf8(t *testing.T) {
 		t.Log(r)
 	})
 }
+
+func assertTokenBytes(t *testing.T, tk ByteTokenizer, input string) {
+	encode, err := tk.Encode(input)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tokens := tk.TokenBytes()
+	var out []byte
+	for _, token := range encode {
+		out = append(out, tokens[token]...)
+	}
+	assert(t, string(out) == input, string(out))
+}
+
+func TestTokenBytes(t *testing.T) {
+	normal, err := NewNormalTokenizer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	world, err := NewWorldTokenizer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	seq := "hello world, 你好世界\n\n{\"a\": 1}"
+	t.Run("Test Normal", func(t *testing.T) {
+		assertTokenBytes(t, normal, seq)
+		assert(t, normal.TokenBytes()[endOfTextToken] == nil)
+	})
+	t.Run("Test World", func(t *testing.T) {
+		assertTokenBytes(t, world, seq)
+		assert(t, world.TokenBytes()[endOfTextToken] == nil)
+	})
+}
@@ -0,0 +1,239 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	toolCallStart = "<tool_call>"
+	toolCallEnd   = "</tool_call>"
+
+	defaultMaxToolCalls = 4
+)
+
+// Tool is a Go function the model can call.
+type Tool struct {
+	Name        string
+	Description string
+	// Parameters is the JSON schema of the arguments object, it is shown to the model.
+	Parameters json.RawMessage
+	// Func is called with the arguments object written by the model.
+	Func func(args json.RawMessage) (string, error)
+}
+
+// ToolCall is a tool call written by the model and its result.
+type ToolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+	Result    string          `json:"-"`
+}
+
+// Agent lets the model call tools during a Chat.
+// The model starts a call with <tool_call>, then the call is generated as a JSON object
+// under a constraint built from the tool names and parameter schemas, so it always parses. The result of the tool is fed back into the same
+// state as a tool message, and the model continues its reply.
+type Agent struct {
+	chat       *Chat
+	tools      map[string]*Tool
+	maxCalls   int
+	constraint Constraint
+}
+
+// NewAgent registers the tools and describes them to the model in a system message.
+func NewAgent(chat *Chat, tools ...*Tool) (*Agent, error) {
+	if chat == nil {
+		return nil, errors.New("chat can not be nil")
+	}
+	a := &Agent{
+		chat:     chat,
+		tools:    make(map[string]*Tool, len(tools)),
+		maxCalls: defaultMaxToolCalls,
+	}
+	for _, tool := range tools {
+		if tool == nil || len(tool.Name) == 0 || tool.Func == nil {
+			return nil, errors.New("tool must have a name and a func")
+		}
+		if _, ok := a.tools[tool.Name]; ok {
+			return nil, fmt.Errorf("tool %s is registered twice", tool.Name)
+		}
+		a.tools[tool.Name] = tool
+	}
+	a.constraint = toolCallConstraint(tools)
+	if err := chat.Add(ChatMessage{Role: ChatRoleSystem, Content: describeTools(tools)}); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetMaxCalls limits the tool calls of a single reply.
+func (a *Agent) SetMaxCalls(n int) {
+	a.maxCalls = n
+}
+
+// Chat returns the underlying conversation.
+func (a *Agent) Chat() *Chat {
+	return a.chat
+}
+
+// Send adds a user message and returns the final reply together with the tool calls made for it.
+func (a *Agent) Send(content string, opts ...PredictOption) (string, []ToolCall, error) {
+	if err := a.chat.Add(ChatMessage{Role: ChatRoleUser, Content: content}); err != nil {
+		return "", nil, err
+	}
+	var calls []ToolCall
+	for {
+		stops := []string{a.chat.template.Separator()}
+		if len(calls) < a.maxCalls {
+			stops = append(stops, toolCallStart)
+		}
+		gen, err := a.chat.generate(nil, opts, stops...)
+		if err != nil {
+			return "", calls, err
+		}
+		if gen.Stop != toolCallStart {
+			reply, err := a.chat.finish(gen.Text, gen.Stop)
+			return reply, calls, err
+		}
+
+		start, err := a.fedAfterStart(gen)
+		if err != nil {
+			return "", calls, err
+		}
+		call, text, err := a.generateCall(start, opts)
+		if err != nil {
+			return "", calls, err
+		}
+		if err := a.chat.state.evalText(nil, RoleInput, toolCallEnd+a.chat.template.Separator()); err != nil {
+			return "", calls, err
+		}
+		// the message holds the call as the model wrote it, like the state
+		a.chat.messages = append(a.chat.messages, ChatMessage{
+			Role:    ChatRoleAssistant,
+			Content: strings.TrimSpace(gen.Text + toolCallStart + text + toolCallEnd),
+		})
+
+		call.Result = a.call(call)
+		calls = append(calls, call)
+		if err := a.chat.Add(ChatMessage{Role: ChatRoleTool, Content: call.Result}); err != nil {
+			return "", calls, err
+		}
+	}
+}
+
+// fedAfterStart returns the bytes of the last generated token which follow <tool_call>,
+// they have been fed into the state although the text of the generation ends before the stop string.
+func (a *Agent) fedAfterStart(gen *Generation) ([]byte, error) {
+	vocab, _, err := a.chat.state.rwkvModel.vocabulary()
+	if err != nil {
+		return nil, err
+	}
+	var fed []byte
+	for _, token := range gen.Tokens {
+		fed = append(fed, vocab[token]...)
+	}
+	i := bytes.Index(fed, []byte(toolCallStart))
+	if i < 0 {
+		return nil, nil
+	}
+	return fed[i+len(toolCallStart):], nil
+}
+
+// generateCall lets the model write the JSON object of a call, which starts with the bytes already fed.
+// It returns the call and its text.
+func (a *Agent) generateCall(start []byte, opts []PredictOption) (ToolCall, string, error) {
+	state := a.constraint.start()
+	for _, b := range start {
+		if state = state.next(b); state == nil {
+			return ToolCall{}, "", fmt.Errorf("tool call can not start with %q", start)
+		}
+	}
+	opts = append(append([]PredictOption(nil), opts...), WithStopStrings(), WithConstraint(resumedConstraint{state}))
+	gen, err := a.chat.state.generate(nil, newPredictOptions(a.chat.state.rwkvModel.options, opts))
+	if err != nil {
+		return ToolCall{}, "", err
+	}
+	text := string(start) + gen.Text
+	var call ToolCall
+	if err := json.Unmarshal([]byte(text), &call); err != nil {
+		return ToolCall{}, "", fmt.Errorf("tool call is incomplete, increase max tokens: %w", err)
+	}
+	return call, text, nil
+}
+
+// resumedConstraint continues a constraint from one of its states.
+type resumedConstraint struct {
+	state matchState
+}
+
+func (c resumedConstraint) start() matchState {
+	return c.state
+}
+
+// call runs the tool, errors are returned as result so that the model can react on them.
+func (a *Agent) call(call ToolCall) string {
+	tool, ok := a.tools[call.Name]
+	if !ok {
+		return fmt.Sprintf("error: unknown tool %q", call.Name)
+	}
+	args := call.Arguments
+	if len(args) == 0 {
+		args = json.RawMessage("{}")
+	}
+	result, err := tool.Func(args)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return result
+}
+
+// toolCallConstraint restricts a call to the registered tools and their parameter schemas.
+// It falls back to any JSON object when a schema is not supported.
+func toolCallConstraint(tools []*Tool) Constraint {
+	calls := make([]*JSONSchema, 0, len(tools))
+	for _, tool := range tools {
+		args := &JSONSchema{Type: "object"}
+		if len(tool.Parameters) > 0 {
+			if err := json.Unmarshal(tool.Parameters, args); err != nil {
+				return NewJSONConstraint()
+			}
+		}
+		calls = append(calls, &JSONSchema{
+			Type: "object",
+			Properties: map[string]*JSONSchema{
+				"name":      {Enum: []any{tool.Name}},
+				"arguments": args,
+			},
+			Required:      []string{"name", "arguments"},
+			propertyOrder: []string{"name", "arguments"},
+		})
+	}
+	g, err := CompileSchema(&JSONSchema{AnyOf: calls})
+	if err != nil {
+		return NewJSONConstraint()
+	}
+	return g
+}
+
+func describeTools(tools []*Tool) string {
+	var sb strings.Builder
+	sb.WriteString("You can use the following tools. To call a tool, write " + toolCallStart +
+		" followed by a JSON object with the tool name and its arguments, for example " +
+		toolCallStart + `{"name": "tool_name", "arguments": {}}` + toolCallEnd +
+		". The result of the call is given to you in a Tool message.\n")
+	sb.WriteString("Tools:\n")
+	for _, tool := range tools {
+		sb.WriteString("- " + tool.Name + ": " + tool.Description)
+		if len(tool.Parameters) > 0 {
+			sb.WriteString(" Arguments: " + string(tool.Parameters))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
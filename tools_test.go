@@ -0,0 +1,149 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAgent_Call(t *testing.T) {
+	weather := &Tool{
+		Name:        "get_weather",
+		Description: "Get the weather of a city.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`),
+		Func: func(args json.RawMessage) (string, error) {
+			var in struct {
+				City string `json:"city"`
+			}
+			if err := json.Unmarshal(args, &in); err != nil {
+				return "", err
+			}
+			if in.City == "" {
+				return "", errors.New("city is required")
+			}
+			return "sunny in " + in.City, nil
+		},
+	}
+	a := &Agent{tools: map[string]*Tool{weather.Name: weather}}
+
+	t.Run("call tool", func(t *testing.T) {
+		var call ToolCall
+		err := json.Unmarshal([]byte(`{"name": "get_weather", "arguments": {"city": "Paris"}}`), &call)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		assert(t, a.call(call) == "sunny in Paris")
+	})
+
+	t.Run("tool errors are results", func(t *testing.T) {
+		assert(t, a.call(ToolCall{Name: "get_weather"}) == "error: city is required")
+		assert(t, strings.HasPrefix(a.call(ToolCall{Name: "unknown"}), "error: unknown tool"))
+	})
+
+	t.Run("call constraint", func(t *testing.T) {
+		c := toolCallConstraint([]*Tool{weather})
+		assert(t, matchString(c, `{"name": "get_weather", "arguments": {"city": "Paris"}}`))
+		assert(t, !matchString(c, `{"name": "get_time", "arguments": {}}`))
+		assert(t, !matchString(c, `{"name": "get_weather", "arguments": {}}`))
+	})
+
+	t.Run("describe tools", func(t *testing.T) {
+		desc := describeTools([]*Tool{weather})
+		assert(t, strings.Contains(desc, toolCallStart))
+		assert(t, strings.Contains(desc, "- get_weather: Get the weather of a city. Arguments: {"))
+	})
+}
+
+// scriptRwkv is a fakeRwkv whose logits give all the probability to the next token of the script,
+// the script moves on when that token is evaluated.
+type scriptRwkv struct {
+	fakeRwkv
+	script []int
+	pos    int
+}
+
+func (r *scriptRwkv) RwkvEval(ctx *RwkvCtx, token uint32, in, state, logits []float32) error {
+	if err := r.fakeRwkv.RwkvEval(ctx, token, in, state, logits); err != nil {
+		return err
+	}
+	if r.pos < len(r.script) && r.script[r.pos] == int(token) {
+		r.pos++
+	}
+	if r.pos < len(r.script) {
+		logits[r.script[r.pos]] = 100
+	}
+	return nil
+}
+
+func TestAgent_Send(t *testing.T) {
+	m, _ := newFakeModel(t, RwkvOptions{MaxTokens: 40, TrackTokens: true})
+	vocab, _, err := m.vocabulary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(text string) []int {
+		tokens, err := m.tokenizer.Encode(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokens
+	}
+	// ">{" ends the start of the call and starts its JSON object
+	script := encode(" Let me check.<tool_call")
+	script = append(script, 797)
+	script = append(script, encode(`"name": "get_weather", "arguments": {"city": "Paris"}}`)...)
+	script = append(script, encode(" Nice weather.\n\n")...)
+	assert(t, string(vocab[797]) == ">{")
+	r := &scriptRwkv{script: script}
+	m.cRwkv = r
+
+	var args []string
+	weather := &Tool{
+		Name:       "get_weather",
+		Parameters: json.RawMessage(`{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`),
+		Func: func(in json.RawMessage) (string, error) {
+			args = append(args, string(in))
+			return "sunny in Paris", nil
+		},
+	}
+	state, err := m.InitState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat, err := NewChat(state, WorldChatTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewAgent(chat, weather)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, calls, err := agent.Send("What is the weather in Paris?")
+	assert(t, err == nil, "send")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, reply == "Nice weather.", reply)
+	assert(t, len(calls) == 1 && calls[0].Name == "get_weather" && calls[0].Result == "sunny in Paris")
+	assert(t, len(args) == 1 && args[0] == `{"city": "Paris"}`, args...)
+
+	messages := chat.Messages()
+	assert(t, len(messages) == 5)
+	call := `Let me check.<tool_call>{"name": "get_weather", "arguments": {"city": "Paris"}}</tool_call>`
+	assert(t, messages[2].Role == ChatRoleAssistant && messages[2].Content == call, messages[2].Content)
+	assert(t, messages[3].Role == ChatRoleTool && messages[3].Content == "sunny in Paris")
+	assert(t, messages[4].Role == ChatRoleAssistant && messages[4].Content == "Nice weather.")
+
+	// the state has seen the conversation exactly as it is written
+	var want strings.Builder
+	for _, msg := range messages {
+		want.WriteString(chat.template.Format(msg))
+	}
+	assert(t, m.Detokenize(chat.State().Tokens()) == want.String(), m.Detokenize(chat.State().Tokens()))
+}
@@ -0,0 +1,75 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Names of the spans started by the model.
+const (
+	SpanLoad       = "rwkv.load"
+	SpanGpuOffload = "rwkv.gpu_offload"
+	SpanTokenize   = "rwkv.tokenize"
+	SpanPrompt     = "rwkv.prompt"
+	SpanGenerate   = "rwkv.generate"
+	SpanStateSave  = "rwkv.state.save"
+	SpanStateLoad  = "rwkv.state.load"
+)
+
+// Keys of the span attributes.
+const (
+	AttrModelPath        = "rwkv.model.path"
+	AttrGpuLayers        = "rwkv.gpu.layers"
+	AttrTokens           = "rwkv.tokens"
+	AttrMaxTokens        = "rwkv.max_tokens"
+	AttrCompletionTokens = "rwkv.completion_tokens"
+	AttrFinishReason     = "rwkv.finish_reason"
+	AttrStateBytes       = "rwkv.state.bytes"
+)
+
+// Tracer starts the spans of the model operations, see RwkvOptions.Tracer.
+// It follows the OpenTelemetry tracer, an adapter only has to convert the attributes and record the error.
+type Tracer interface {
+	// Start starts a span as a child of the span held by ctx and returns a context holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a traced operation of the model.
+type Span interface {
+	// SetAttributes sets attributes of the span, like its token counts.
+	SetAttributes(attrs ...slog.Attr)
+	// End ends the span, err is the error of the operation, nil on success.
+	End(err error)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...slog.Attr) {}
+func (noopSpan) End(error)                  {}
+
+// startSpan starts a span with the tracer of the model, or does nothing when there is none.
+func (m *RwkvModel) startSpan(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span) {
+	if m.options.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	ctx, span := m.options.Tracer.Start(ctx, name)
+	if len(attrs) > 0 {
+		span.SetAttributes(attrs...)
+	}
+	return ctx, span
+}
+
+// spanContext returns the parent of the spans of the state: ctx when not nil,
+// else the context of the job of the state.
+func (s *RwkvState) spanContext(ctx context.Context) context.Context {
+	if ctx != nil {
+		return ctx
+	}
+	if job := s.attachedJob(); job != nil && job.ctx != nil {
+		return job.ctx
+	}
+	return context.Background()
+}
@@ -0,0 +1,99 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+type spanKey struct{}
+
+type testSpan struct {
+	name   string
+	parent *testSpan
+	attrs  map[string]slog.Value
+	ended  bool
+	err    error
+}
+
+func (s *testSpan) SetAttributes(attrs ...slog.Attr) {
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *testSpan) End(err error) {
+	s.ended, s.err = true, err
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(*testSpan)
+	span := &testSpan{name: name, parent: parent, attrs: make(map[string]slog.Value)}
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (t *testTracer) last(name string) *testSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.spans) - 1; i >= 0; i-- {
+		if t.spans[i].name == name {
+			return t.spans[i]
+		}
+	}
+	return nil
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &testTracer{}
+	tk, err := NewWorldTokenizer()
+	assert(t, err == nil)
+	model := &RwkvModel{options: &RwkvOptions{Tracer: tracer}, tokenizer: tk}
+	root := &testSpan{name: "request"}
+	ctx := context.WithValue(context.Background(), spanKey{}, root)
+
+	t.Run("tokenize", func(t *testing.T) {
+		tokens, err := model.tokenize(ctx, "hello world")
+		assert(t, err == nil)
+		span := tracer.last(SpanTokenize)
+		assert(t, span != nil && span.ended && span.parent == root)
+		assert(t, span.attrs[AttrTokens].Int64() == int64(len(tokens)))
+	})
+
+	t.Run("generate", func(t *testing.T) {
+		s := &RwkvState{state: []float32{0}, rwkvModel: model}
+		gen, err := s.generate(nil, newPredictOptions(model.options, []PredictOption{WithMaxTokens(0), WithContext(ctx)}))
+		assert(t, err == nil)
+		span := tracer.last(SpanGenerate)
+		assert(t, span != nil && span.ended && span.err == nil && span.parent == root)
+		assert(t, span.attrs[AttrCompletionTokens].Int64() == 0)
+		assert(t, span.attrs[AttrFinishReason].String() == string(gen.FinishReason))
+	})
+
+	t.Run("job context", func(t *testing.T) {
+		p := testPool(1)
+		p.model = model
+		s := &RwkvState{state: []float32{1, 2}, logits: []float32{3}, rwkvModel: model}
+		job, err := p.Attach(ctx, s, JobOptions{})
+		assert(t, err == nil)
+		defer job.Detach()
+		var buf bytes.Buffer
+		n, err := s.WriteTo(&buf)
+		assert(t, err == nil)
+		span := tracer.last(SpanStateSave)
+		assert(t, span != nil && span.ended && span.parent == root)
+		assert(t, span.attrs[AttrStateBytes].Int64() == n)
+	})
+}
@@ -0,0 +1,132 @@
+// Copyright (c) seasonjs. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+
+package rwkv
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/sugarme/tokenizer/pretokenizer"
+)
+
+// endOfTextToken is <|endoftext|> in both the 20B and the World vocabulary.
+const endOfTextToken = 0
+
+// ByteTokenizer is a Tokenizer which knows the raw bytes of every token.
+// Constrained decoding needs it to check tokens against a grammar.
+type ByteTokenizer interface {
+	Tokenizer
+	// TokenBytes returns the bytes of every token id, special tokens have nil bytes.
+	TokenBytes() [][]byte
+}
+
+// TokenBytes returns the bytes of every token in the World vocabulary.
+func (wt *WorldTokenizer) TokenBytes() [][]byte {
+	maxIndex := 0
+	for index := range wt.IndexToToken {
+		if index > maxIndex {
+			maxIndex = index
+		}
+	}
+	tokens := make([][]byte, maxIndex+1)
+	for index, token := range wt.IndexToToken {
+		tokens[index] = []byte(token)
+	}
+	return tokens
+}
+
+// TokenBytes returns the bytes of every token in the 20B vocabulary,
+// mapping the byte level BPE characters back to bytes.
+func (t *NormalTokenizer) TokenBytes() [][]byte {
+	special := make(map[string]bool)
+	for _, token := range t.tk.GetSpecialTokens() {
+		special[token] = true
+	}
+	modelVocab := t.tk.GetVocab(false)
+
+	tokens := make([][]byte, t.tk.GetVocabSize(true))
+	for id := range tokens {
+		token, ok := t.tk.IdToToken(id)
+		if !ok || special[token] {
+			continue
+		}
+		// added tokens, like runs of spaces, are not byte level encoded
+		if modelId, ok := modelVocab[token]; !ok || modelId != id {
+			tokens[id] = []byte(token)
+			continue
+		}
+		var buf []byte
+		for _, ch := range token {
+			b, ok := pretokenizer.CharBytes[string(ch)]
+			if !ok {
+				buf = nil
+				break
+			}
+			buf = append(buf, b)
+		}
+		tokens[id] = buf
+	}
+	return tokens
+}
+
+// tokenTrie is a byte trie of a vocabulary, shared by all constraints of a model.
+type tokenTrie struct {
+	nodes []trieNode
+}
+
+type trieNode struct {
+	// edges are sorted by byte
+	edges  []trieEdge
+	tokens []int
+}
+
+type trieEdge struct {
+	b    byte
+	node int32
+}
+
+func newTokenTrie(tokens [][]byte) *tokenTrie {
+	t := &tokenTrie{nodes: []trieNode{{}}}
+	for id, token := range tokens {
+		if len(token) == 0 {
+			continue
+		}
+		node := 0
+		for _, b := range token {
+			node = t.child(node, b)
+		}
+		t.nodes[node].tokens = append(t.nodes[node].tokens, id)
+	}
+	for i := range t.nodes {
+		edges := t.nodes[i].edges
+		sort.Slice(edges, func(a, b int) bool { return edges[a].b < edges[b].b })
+	}
+	return t
+}
+
+func (t *tokenTrie) child(node int, b byte) int {
+	for _, edge := range t.nodes[node].edges {
+		if edge.b == b {
+			return int(edge.node)
+		}
+	}
+	t.nodes = append(t.nodes, trieNode{})
+	next := len(t.nodes) - 1
+	t.nodes[node].edges = append(t.nodes[node].edges, trieEdge{b: b, node: int32(next)})
+	return next
+}
+
+// vocabulary returns the token bytes and trie of the model tokenizer, they are built once.
+func (m *RwkvModel) vocabulary() ([][]byte, *tokenTrie, error) {
+	m.vocabOnce.Do(func() {
+		tk, ok := m.tokenizer.(ByteTokenizer)
+		if !ok {
+			m.vocabErr = errors.New("the tokenizer doesn't support constrained decoding")
+			return
+		}
+		m.tokenBytes = tk.TokenBytes()
+		m.trie = newTokenTrie(m.tokenBytes)
+	})
+	return m.tokenBytes, m.trie, m.vocabErr
+}
@@ -8,7 +8,7 @@ import (
 	"embed"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"strconv"
 	"strings"
 	"unicode/utf8"
@@ -77,6 +77,10 @@ type WorldTokenizer struct {
 
 // NewWorldTokenizer initializes a new world tokenizer
 func NewWorldTokenizer() (*WorldTokenizer, error) {
+	return newWorldTokenizer(discardLogger)
+}
+
+func newWorldTokenizer(logger *slog.Logger) (*WorldTokenizer, error) {
 	f, err := worldTokenizerFS.Open("rwkv_vocab_v20230424.txt")
 	if err != nil {
 		return nil, err
@@ -124,9 +128,8 @@ func NewWorldTokenizer() (*WorldTokenizer, error) {
 	}
 
 	if nonStandardToken > 0 {
-		log.Print("rwkv_vocab_v20230424.txt contains non-standard utf-8 total: ",
-			nonStandardToken,
-			". they will not affect your normal use")
+		logger.Debug("rwkv_vocab_v20230424.txt contains non-standard utf-8, they will not affect your normal use",
+			"tokens", nonStandardToken)
 	}
 
 	if err := scanner.Err(); err != nil {